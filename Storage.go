@@ -1,6 +1,7 @@
 package libkv
 
 import (
+    "context"
     "crypto/tls"
     "errors"
     "time"
@@ -22,8 +23,45 @@ type Storage interface {
     Close()
 }
 
+// StorageContext mirrors Storage with a leading context.Context, so callers
+// control cancellation and deadlines instead of Config.ConnectionTimeout.
+type StorageContext interface {
+    Storage
+    PutContext(ctx context.Context, key string, value []byte, options *WriteOptions) error
+    GetContext(ctx context.Context, key string) (*KVPair, error)
+    DeleteContext(ctx context.Context, key string) error
+    ExistsContext(ctx context.Context, key string) (bool, error)
+    WatchContext(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *KVPair, error)
+    WatchMultiContext(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *KVPair, error)
+    WatchTreeContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan []*KVPair, error)
+    NewLockContext(ctx context.Context, key string, options *LockOptions) (Locker, error)
+    ListContext(ctx context.Context, dir string) ([]*KVPair, error)
+    DeleteTreeContext(ctx context.Context, dir string) error
+    AtomicPutContext(ctx context.Context, key string, value []byte, previous *KVPair, options *WriteOptions) (bool, *KVPair, error)
+    AtomicDeleteContext(ctx context.Context, key string, previous *KVPair) (bool, error)
+}
+
+// EventWatcher is implemented by the storages sending typed watch events.
+// A type assertion on the Storage tells whether they are available.
+type EventWatcher interface {
+    WatchEvents(stopCh <-chan struct{}, options *WatchOptions, keys ...string) (<-chan *WatchEvent, error)
+    WatchTreeEvents(dir string, stopCh <-chan struct{}, options *WatchOptions) (<-chan *WatchEvent, error)
+    WatchTreeDeltas(dir string, stopCh <-chan struct{}) (<-chan *WatchEvent, error)
+    WatchEventsContext(ctx context.Context, stopCh <-chan struct{}, options *WatchOptions, keys ...string) (<-chan *WatchEvent, error)
+    WatchTreeEventsContext(ctx context.Context, dir string, stopCh <-chan struct{}, options *WatchOptions) (<-chan *WatchEvent, error)
+    WatchTreeDeltasContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan *WatchEvent, error)
+}
+
+// TreeDeleter is implemented by the storages reporting how many keys
+// DeleteTree removed.
+type TreeDeleter interface {
+    DeleteTreeCount(dir string) (int, error)
+    DeleteTreeCountContext(ctx context.Context, dir string) (int, error)
+}
+
 type WriteOptions struct {
-    TTL time.Duration
+    TTL       time.Duration // Optional, remove the key once expired; consul raises it to 10s at least, zookeeper removes the key with the session instead
+    KeepAlive chan struct{} // Optional, keep the ttl alive until the chan is closed, then remove the key (etcdv3, consul, zookeeper)
 }
 
 type Config struct {
@@ -34,6 +72,11 @@ type Config struct {
     Username          string
     Password          string
     DB                int
+    Redlock           bool   // Optional, locks span every endpoint using the Redlock algorithm (redis)
+    Cluster           bool   // Optional, the endpoints are seeds of a cluster (redis)
+    MasterName        string // Optional, name of the master monitored by the sentinels given as endpoints (redis)
+    KeyspaceEvents    bool   // Optional, watches follow keyspace notifications, seeing deletes, expirations and foreign writes (redis)
+    SharedLocks       bool   // Optional, locks are shared with other processes using the same path (leveldb)
 }
 
 func DefaultConfig() *Config {
@@ -45,6 +88,11 @@ func DefaultConfig() *Config {
         Username:          "",
         Password:          "",
         DB:                0,
+        Redlock:           false,
+        Cluster:           false,
+        MasterName:        "",
+        KeyspaceEvents:    false,
+        SharedLocks:       false,
     }
 }
 
@@ -59,6 +107,69 @@ type KVPair struct {
     Value     []byte
     LastIndex uint64
 }
+
+// WatchOptions tune WatchEvents and WatchTreeEvents, nil watching the
+// changes from now on and waiting for the consumer.
+//
+// Resuming from a Revision needs a log of the past changes: etcd keeps its
+// own, sql a table of them, and leveldb and boltdb their last 1024
+// revisions alongside the data, so they survive a reopen. redis, consul,
+// zookeeper and file keep none and refuse a Revision with
+// ErrAPINotSupported.
+type WatchOptions struct {
+    Revision uint64        // Optional, resume after this revision, sending the changes missed since first; fails with ErrCompacted once they are no longer retained (etcdv3, sql, leveldb, boltdb, memory)
+    Buffer   int           // Optional, events kept pending for a slow consumer before Overflow applies
+    Overflow WatchOverflow // Optional, what to do with the events the consumer is too slow for
+    Errors   chan<- error  // Optional, receives the errors the watch recovers from and the one stopping it, without blocking
+}
+
+// WatchOverflow is what a watch does once WatchOptions.Buffer events wait
+// for the consumer.
+type WatchOverflow int
+
+const (
+    WatchBlock    WatchOverflow = iota // waits for the consumer, holding back the watch
+    WatchDrop                          // drops the new events, reporting ErrWatchOverflow
+    WatchCoalesce                      // merges the pending events of each key into one, whatever the buffer
+)
+
+// WatchOp is the kind of change reported by a WatchEvent. The backends unable
+// to tell an expiration from a delete report both as WatchDelete.
+type WatchOp int
+
+const (
+    WatchPut WatchOp = iota + 1
+    WatchDelete
+    WatchExpire
+    WatchSnapshot
+)
+
+func (op WatchOp) String() string {
+    switch op {
+    case WatchPut:
+        return "put"
+    case WatchDelete:
+        return "delete"
+    case WatchExpire:
+        return "expire"
+    case WatchSnapshot:
+        return "snapshot"
+    }
+    return "unknown"
+}
+
+// WatchEvent is a change of a watched key, sent by WatchEvents and
+// WatchTreeEvents. WatchTreeDeltas starts with a WatchSnapshot event holding
+// the whole tree, the following events apply to it in order, see Tree.
+type WatchEvent struct {
+    Op       WatchOp
+    Key      string
+    Pair     *KVPair   // the value written, nil once removed
+    Previous *KVPair   // the value replaced or removed, nil when missing or unknown to the backend
+    Revision uint64    // revision of the change, 0 when unknown to the backend
+    Snapshot []*KVPair // the pairs of the tree, WatchSnapshot only
+}
+
 type LockOptions struct {
     Value     []byte        // Optional, value to associate with the lock
     TTL       time.Duration // Optional, expiration ttl associated with the lock
@@ -66,6 +177,9 @@ type LockOptions struct {
 }
 
 type Locker interface {
+    // Lock blocks until the lock is acquired or stopChan is closed, in which
+    // case it returns a nil channel and no error. The returned channel is
+    // closed when the lock is lost or released.
     Lock(stopChan chan struct{}) (<-chan struct{}, error)
     Unlock() error
 }
@@ -0,0 +1,516 @@
+package boltdb
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
+    bolt "go.etcd.io/bbolt"
+    "sync"
+)
+
+func init() {
+    libkv.AddStorage("boltdb", New)
+}
+func New(endpoints []string, opt *libkv.Config) (libkv.Storage, error) {
+    if opt == nil {
+        opt = libkv.DefaultConfig()
+    }
+    if len(endpoints) == 0 {
+        return nil, errors.New("boltdb path unspecified")
+    }
+    if opt.Bucket == "" {
+        return nil, errors.New("boltdb bucket unspecified")
+    }
+    db, err := bolt.Open(endpoints[0], 0600, &bolt.Options{Timeout: opt.ConnectionTimeout})
+    if err != nil {
+        return nil, err
+    }
+    s := &boltdbImpl{
+        db:        db,
+        bucket:    []byte(opt.Bucket),
+        logBucket: []byte(opt.Bucket + "\x00libkv/log"),
+        done:      make(chan struct{}),
+    }
+    err = db.Update(func(tx *bolt.Tx) error {
+        b, err := tx.CreateBucketIfNotExists(s.bucket)
+        if err != nil || tx.Bucket(s.logBucket) != nil {
+            return err
+        }
+        // the log starts at the current revision
+        lb, err := tx.CreateBucket(s.logBucket)
+        if err != nil {
+            return err
+        }
+        return lb.SetSequence(b.Sequence())
+    })
+    var rev uint64
+    if err == nil {
+        rev, err = s.revision()
+    }
+    if err != nil {
+        _ = db.Close()
+        return nil, err
+    }
+    s.hub.Init(s.changes, rev, &s.mu)
+    return s, nil
+}
+
+var _ libkv.StorageContext = (*boltdbImpl)(nil)
+var _ libkv.EventWatcher = (*boltdbImpl)(nil)
+
+// Values are stored behind the revision they were written at, taken from
+// the sequence of the bucket:
+//
+//     revision(8) | value
+//
+// The changes of the last revisions are logged in a sibling bucket, by
+// revision, its sequence being the revision the log was started at.
+type boltdbImpl struct {
+    db        *bolt.DB
+    bucket    []byte
+    logBucket []byte
+    mu        sync.Mutex // publishes the changes in the order they are committed
+    hub       watch.Hub
+    done      chan struct{}
+    closed    sync.Once
+}
+
+func encodeRevision(rev uint64) []byte {
+    b := make([]byte, 8)
+    binary.BigEndian.PutUint64(b, rev)
+    return b
+}
+
+func encodeValue(rev uint64, value []byte) []byte {
+    b := make([]byte, 8+len(value))
+    binary.BigEndian.PutUint64(b, rev)
+    copy(b[8:], value)
+    return b
+}
+
+func decodeValue(key, b []byte) *libkv.KVPair {
+    pair := &libkv.KVPair{Key: string(key)}
+    if len(b) >= 8 {
+        pair.LastIndex = binary.BigEndian.Uint64(b)
+        pair.Value = append([]byte(nil), b[8:]...)
+    }
+    return pair
+}
+
+func putEvent(key string, value, prev []byte) *libkv.WatchEvent {
+    event := &libkv.WatchEvent{
+        Op:   libkv.WatchPut,
+        Key:  key,
+        Pair: &libkv.KVPair{Key: key, Value: append([]byte(nil), value...)},
+    }
+    if prev != nil {
+        event.Previous = decodeValue([]byte(key), prev)
+    }
+    return event
+}
+
+func deleteEvent(key string, prev []byte) *libkv.WatchEvent {
+    return &libkv.WatchEvent{
+        Op:       libkv.WatchDelete,
+        Key:      key,
+        Previous: decodeValue([]byte(key), prev),
+    }
+}
+
+// update runs fn in a write transaction and publishes the changes it
+// returns, tagged with the revision of the transaction. The revision is
+// only taken when fn changed something.
+func (s *boltdbImpl) update(fn func(b *bolt.Bucket, rev uint64) ([]*libkv.WatchEvent, error)) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var (
+        events []*libkv.WatchEvent
+        rev    uint64
+    )
+    err := s.db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(s.bucket)
+        rev = b.Sequence() + 1
+        var err error
+        if events, err = fn(b, rev); err != nil || len(events) == 0 {
+            return err
+        }
+        if err = b.SetSequence(rev); err != nil {
+            return err
+        }
+        for _, event := range events {
+            event.Revision = rev
+            if event.Pair != nil {
+                event.Pair.LastIndex = rev
+            }
+        }
+        return s.log(tx, rev, events)
+    })
+    if err != nil || len(events) == 0 {
+        return err
+    }
+    s.hub.Notify(rev, events...)
+    return nil
+}
+
+func (s *boltdbImpl) Put(key string, value []byte, options *libkv.WriteOptions) error {
+    return s.PutContext(context.Background(), key, value, options)
+}
+
+func (s *boltdbImpl) PutContext(ctx context.Context, key string, value []byte, options *libkv.WriteOptions) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if options != nil && options.TTL > 0 {
+        return common.ErrTTLUnsupported
+    }
+    return s.update(func(b *bolt.Bucket, rev uint64) ([]*libkv.WatchEvent, error) {
+        event := putEvent(key, value, b.Get([]byte(key)))
+        if err := b.Put([]byte(key), encodeValue(rev, value)); err != nil {
+            return nil, err
+        }
+        return []*libkv.WatchEvent{event}, nil
+    })
+}
+
+func (s *boltdbImpl) Get(key string) (*libkv.KVPair, error) {
+    return s.GetContext(context.Background(), key)
+}
+
+func (s *boltdbImpl) GetContext(ctx context.Context, key string) (*libkv.KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    var pair *libkv.KVPair
+    err := s.db.View(func(tx *bolt.Tx) error {
+        v := tx.Bucket(s.bucket).Get([]byte(key))
+        if v == nil {
+            return common.ErrKeyNotFound
+        }
+        pair = decodeValue([]byte(key), v)
+        return nil
+    })
+    return pair, err
+}
+
+func (s *boltdbImpl) Delete(key string) error {
+    return s.DeleteContext(context.Background(), key)
+}
+
+func (s *boltdbImpl) DeleteContext(ctx context.Context, key string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    err := s.update(func(b *bolt.Bucket, rev uint64) ([]*libkv.WatchEvent, error) {
+        v := b.Get([]byte(key))
+        if v == nil {
+            return nil, common.ErrKeyNotFound
+        }
+        event := deleteEvent(key, v)
+        return []*libkv.WatchEvent{event}, b.Delete([]byte(key))
+    })
+    if err == common.ErrKeyNotFound {
+        return nil
+    }
+    return err
+}
+
+func (s *boltdbImpl) Exists(key string) (bool, error) {
+    return s.ExistsContext(context.Background(), key)
+}
+
+func (s *boltdbImpl) ExistsContext(ctx context.Context, key string) (bool, error) {
+    _, err := s.GetContext(ctx, key)
+    if err == common.ErrKeyNotFound {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+func (s *boltdbImpl) Watch(key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchContext(context.Background(), key, stopCh)
+}
+
+func (s *boltdbImpl) WatchContext(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(ctx, stopCh, key)
+}
+
+func (s *boltdbImpl) WatchMulti(stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(context.Background(), stopCh, keys...)
+}
+
+func (s *boltdbImpl) WatchMultiContext(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    var (
+        initial []*libkv.KVPair
+        w       *watch.Watcher
+    )
+    err := s.hub.Hold(func(uint64) error {
+        err := s.db.View(func(tx *bolt.Tx) error {
+            b := tx.Bucket(s.bucket)
+            for _, key := range keys {
+                if v := b.Get([]byte(key)); v != nil {
+                    initial = append(initial, decodeValue([]byte(key), v))
+                }
+            }
+            return nil
+        })
+        if err == nil {
+            w = s.hub.Watch(keys...)
+        }
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return w.Pairs(ctx, stopCh, s.done, initial), nil
+}
+
+func (s *boltdbImpl) WatchTree(dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    return s.WatchTreeContext(context.Background(), dir, stopCh)
+}
+
+func (s *boltdbImpl) WatchTreeContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    w := s.hub.WatchTree(dir)
+    list, err := s.ListContext(ctx, dir)
+    if err != nil {
+        w.Close()
+        return nil, err
+    }
+    return w.Lists(ctx, stopCh, s.done, list, func(ctx context.Context) ([]*libkv.KVPair, error) {
+        return s.ListContext(ctx, dir)
+    }), nil
+}
+
+func (s *boltdbImpl) WatchEvents(stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchEventsContext(context.Background(), stopCh, options, keys...)
+}
+
+func (s *boltdbImpl) WatchEventsContext(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    w, err := s.hub.WatchFrom(options, keys...)
+    if err != nil {
+        return nil, err
+    }
+    return w.Events(ctx, stopCh, s.done, options), nil
+}
+
+func (s *boltdbImpl) WatchTreeEvents(dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeEventsContext(context.Background(), dir, stopCh, options)
+}
+
+func (s *boltdbImpl) WatchTreeEventsContext(ctx context.Context, dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    w, err := s.hub.WatchTreeFrom(options, dir)
+    if err != nil {
+        return nil, err
+    }
+    return w.Events(ctx, stopCh, s.done, options), nil
+}
+
+// log records the changes of revision rev, dropping the ones falling out
+// of the retained revisions.
+func (s *boltdbImpl) log(tx *bolt.Tx, rev uint64, events []*libkv.WatchEvent) error {
+    lb := tx.Bucket(s.logBucket)
+    if len(events) > 0 {
+        if err := lb.Put(encodeRevision(rev), watch.EncodeEvents(events)); err != nil {
+            return err
+        }
+    }
+    if rev > watch.HistorySize {
+        return lb.Delete(encodeRevision(rev - watch.HistorySize))
+    }
+    return nil
+}
+
+// changes reads the log after rev.
+func (s *boltdbImpl) changes(rev uint64) ([]*libkv.WatchEvent, error) {
+    var events []*libkv.WatchEvent
+    err := s.db.View(func(tx *bolt.Tx) error {
+        lb := tx.Bucket(s.logBucket)
+        if rev < watch.Retained(lb.Sequence(), tx.Bucket(s.bucket).Sequence()) {
+            return common.ErrCompacted
+        }
+        c := lb.Cursor()
+        for k, v := c.Seek(encodeRevision(rev + 1)); k != nil; k, v = c.Next() {
+            logged, err := watch.DecodeEvents(binary.BigEndian.Uint64(k), v)
+            if err != nil {
+                return err
+            }
+            events = append(events, logged...)
+        }
+        return nil
+    })
+    return events, err
+}
+
+// revision returns the revision of the last write.
+func (s *boltdbImpl) revision() (uint64, error) {
+    var rev uint64
+    err := s.db.View(func(tx *bolt.Tx) error {
+        rev = tx.Bucket(s.bucket).Sequence()
+        return nil
+    })
+    return rev, err
+}
+
+func (s *boltdbImpl) WatchTreeDeltas(dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeDeltasContext(context.Background(), dir, stopCh)
+}
+
+func (s *boltdbImpl) WatchTreeDeltasContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    var w *watch.Watcher
+    snapshot := &libkv.WatchEvent{Op: libkv.WatchSnapshot, Key: dir}
+    err := s.hub.Hold(func(rev uint64) error {
+        snapshot.Revision = rev
+        err := s.db.View(func(tx *bolt.Tx) error {
+            prefix := []byte(dir)
+            c := tx.Bucket(s.bucket).Cursor()
+            for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+                snapshot.Snapshot = append(snapshot.Snapshot, decodeValue(k, v))
+            }
+            return nil
+        })
+        if err == nil {
+            w = s.hub.WatchTree(dir)
+        }
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return w.Events(ctx, stopCh, s.done, nil, snapshot), nil
+}
+
+func (s *boltdbImpl) NewLock(key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    return s.NewLockContext(context.Background(), key, options)
+}
+
+func (s *boltdbImpl) NewLockContext(ctx context.Context, key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    return nil, common.ErrAPINotSupported
+}
+
+func (s *boltdbImpl) List(dir string) ([]*libkv.KVPair, error) {
+    return s.ListContext(context.Background(), dir)
+}
+
+func (s *boltdbImpl) ListContext(ctx context.Context, dir string) ([]*libkv.KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    result := make([]*libkv.KVPair, 0, 16)
+    err := s.db.View(func(tx *bolt.Tx) error {
+        prefix := []byte(dir)
+        c := tx.Bucket(s.bucket).Cursor()
+        for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+            result = append(result, decodeValue(k, v))
+        }
+        return nil
+    })
+    return result, err
+}
+
+func (s *boltdbImpl) DeleteTree(dir string) error {
+    return s.DeleteTreeContext(context.Background(), dir)
+}
+
+func (s *boltdbImpl) DeleteTreeContext(ctx context.Context, dir string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return s.update(func(b *bolt.Bucket, rev uint64) ([]*libkv.WatchEvent, error) {
+        var (
+            prefix  = []byte(dir)
+            deleted []*libkv.WatchEvent
+            c       = b.Cursor()
+        )
+        for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+            deleted = append(deleted, deleteEvent(string(k), v))
+        }
+        for _, event := range deleted {
+            if err := b.Delete([]byte(event.Key)); err != nil {
+                return nil, err
+            }
+        }
+        return deleted, nil
+    })
+}
+
+func (s *boltdbImpl) AtomicPut(key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    return s.AtomicPutContext(context.Background(), key, value, previous, options)
+}
+
+func (s *boltdbImpl) AtomicPutContext(ctx context.Context, key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return false, nil, err
+    }
+    if options != nil && options.TTL > 0 {
+        return false, nil, common.ErrTTLUnsupported
+    }
+    var pair *libkv.KVPair
+    err := s.update(func(b *bolt.Bucket, rev uint64) ([]*libkv.WatchEvent, error) {
+        v := b.Get([]byte(key))
+        switch {
+        case v == nil && previous != nil:
+            return nil, common.ErrKeyModified
+        case v != nil && previous == nil:
+            return nil, common.ErrKeyExists
+        case v != nil && decodeValue(nil, v).LastIndex != previous.LastIndex:
+            return nil, common.ErrKeyModified
+        }
+        event := putEvent(key, value, v)
+        if err := b.Put([]byte(key), encodeValue(rev, value)); err != nil {
+            return nil, err
+        }
+        pair = &libkv.KVPair{Key: key, Value: value, LastIndex: rev}
+        return []*libkv.WatchEvent{event}, nil
+    })
+    if err != nil {
+        return false, nil, err
+    }
+    return true, pair, nil
+}
+
+func (s *boltdbImpl) AtomicDelete(key string, previous *libkv.KVPair) (bool, error) {
+    return s.AtomicDeleteContext(context.Background(), key, previous)
+}
+
+func (s *boltdbImpl) AtomicDeleteContext(ctx context.Context, key string, previous *libkv.KVPair) (bool, error) {
+    if err := ctx.Err(); err != nil {
+        return false, err
+    }
+    if previous == nil {
+        return false, common.ErrPreviousNotSpecified
+    }
+    err := s.update(func(b *bolt.Bucket, rev uint64) ([]*libkv.WatchEvent, error) {
+        v := b.Get([]byte(key))
+        if v == nil {
+            return nil, common.ErrKeyNotFound
+        }
+        if decodeValue(nil, v).LastIndex != previous.LastIndex {
+            return nil, common.ErrKeyModified
+        }
+        event := deleteEvent(key, v)
+        return []*libkv.WatchEvent{event}, b.Delete([]byte(key))
+    })
+    if err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+func (s *boltdbImpl) Close() {
+    s.closed.Do(func() {
+        close(s.done)
+        _ = s.db.Close()
+    })
+}
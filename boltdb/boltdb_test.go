@@ -0,0 +1,265 @@
+package boltdb
+
+import (
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/stretchr/testify/assert"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func newTestStorage(t *testing.T, path string) libkv.Storage {
+    opt := libkv.DefaultConfig()
+    opt.Bucket = "libkv"
+    kv, err := New([]string{path}, opt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return kv
+}
+
+func TestNew(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "kv.db")
+    _, err := New([]string{path}, nil)
+    assert.NotNil(t, err)
+
+    kv := newTestStorage(t, path)
+    _, err = kv.Get("/test_dir/node1")
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    assert.Equal(t, common.ErrTTLUnsupported, kv.Put("/test_dir/node1", []byte("v"), &libkv.WriteOptions{TTL: time.Second}))
+
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+    assert.Nil(t, kv.Put("/test_dir2/node1", []byte("other"), nil))
+    list, err := kv.List("/test_dir/")
+    assert.Nil(t, err)
+    assert.Len(t, list, 2)
+    assert.Equal(t, "value1", string(list[0].Value))
+    assert.True(t, list[1].LastIndex > list[0].LastIndex)
+    kv.Close()
+
+    kv = newTestStorage(t, path)
+    defer kv.Close()
+    pair, err := kv.Get("/test_dir/node2")
+    assert.Nil(t, err)
+    assert.Equal(t, list[1].LastIndex, pair.LastIndex)
+
+    assert.Nil(t, kv.DeleteTree("/test_dir/"))
+    list, err = kv.List("/test_dir")
+    assert.Nil(t, err)
+    assert.Len(t, list, 1)
+    assert.Equal(t, "/test_dir2/node1", list[0].Key)
+
+    // a second Close does nothing
+    kv.Close()
+    kv.Close()
+}
+
+func TestAtomic(t *testing.T) {
+    kv := newTestStorage(t, filepath.Join(t.TempDir(), "kv.db"))
+    defer kv.Close()
+    key := "/atomic/node"
+
+    _, err := kv.AtomicDelete(key, nil)
+    assert.Equal(t, common.ErrPreviousNotSpecified, err)
+
+    ok, pair, err := kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    _, _, err = kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Equal(t, common.ErrKeyExists, err)
+
+    ok, next, err := kv.AtomicPut(key, []byte("v2"), pair, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    assert.True(t, next.LastIndex > pair.LastIndex)
+    _, _, err = kv.AtomicPut(key, []byte("v3"), pair, nil)
+    assert.Equal(t, common.ErrKeyModified, err)
+    _, err = kv.AtomicDelete(key, pair)
+    assert.Equal(t, common.ErrKeyModified, err)
+
+    ok, err = kv.AtomicDelete(key, next)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    _, err = kv.AtomicDelete(key, next)
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    _, _, err = kv.AtomicPut(key, []byte("v4"), next, nil)
+    assert.Equal(t, common.ErrKeyModified, err)
+}
+
+func TestWatch(t *testing.T) {
+    kv := newTestStorage(t, filepath.Join(t.TempDir(), "kv.db"))
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.Watch(key, stopCh)
+    assert.Nil(t, err)
+    treeCh, err := kv.WatchTree("/test_dir/", stopCh)
+    assert.Nil(t, err)
+
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    assert.Nil(t, kv.Delete(key))
+
+    for _, want := range []string{"value0", "value1", ""} {
+        select {
+        case pair := <-ch:
+            assert.Equal(t, want, string(pair.Value))
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for watch")
+        }
+    }
+    deadline := time.After(time.Second)
+    for {
+        select {
+        case list := <-treeCh:
+            if len(list) == 0 {
+                return
+            }
+        case <-deadline:
+            t.Fatal("timeout waiting for tree watch")
+        }
+    }
+}
+
+// receiveEvents reads n events from ch, formatted as "op key value (previous)".
+func receiveEvents(t *testing.T, ch <-chan *libkv.WatchEvent, n int) []string {
+    var events []string
+    for i := 0; i < n; i++ {
+        select {
+        case event := <-ch:
+            s := event.Op.String() + " " + event.Key
+            if event.Pair != nil {
+                s += " " + string(event.Pair.Value)
+            }
+            if event.Previous != nil {
+                s += " (" + string(event.Previous.Value) + ")"
+            }
+            events = append(events, s)
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for events")
+        }
+    }
+    return events
+}
+
+func TestWatchEvents(t *testing.T) {
+    kv := newTestStorage(t, filepath.Join(t.TempDir(), "kv.db"))
+    defer kv.Close()
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, nil)
+    assert.Nil(t, err)
+
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("other"), nil))
+    assert.Nil(t, kv.DeleteTree("/test_dir/"))
+
+    assert.Equal(t, []string{
+        "put /test_dir/node1 value1 (value0)",
+        "put /test_dir/node2 other",
+        "delete /test_dir/node1 (value1)",
+        "delete /test_dir/node2 (other)",
+    }, receiveEvents(t, ch, 4))
+}
+
+func TestWatchResume(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "kv.db")
+    kv := newTestStorage(t, path)
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    pair, err := kv.Get("/test_dir/node1")
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+    assert.Nil(t, kv.Delete("/test_dir/node1"))
+    kv.Close()
+
+    // the log survives a reopen
+    kv = newTestStorage(t, path)
+    defer kv.Close()
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    options := &libkv.WatchOptions{Revision: pair.LastIndex}
+    ch, err := kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, options)
+    assert.Nil(t, err)
+    assert.Equal(t, []string{
+        "put /test_dir/node2 value2",
+        "delete /test_dir/node1 (value1)",
+    }, receiveEvents(t, ch, 2))
+
+    for i := 0; i < 1024; i++ {
+        assert.Nil(t, kv.Put("/test_dir/node3", []byte("value3"), nil))
+    }
+    _, err = kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, options)
+    assert.Equal(t, common.ErrCompacted, err)
+}
+
+func TestTxn(t *testing.T) {
+    kv := newTestStorage(t, filepath.Join(t.TempDir(), "kv.db"))
+    defer kv.Close()
+    blob, version := "/test_dir/blob", "/test_dir/version"
+    assert.Nil(t, kv.Put(blob, []byte("value1"), nil))
+    pair, err := kv.Get(blob)
+    assert.Nil(t, err)
+
+    txn := &libkv.Txn{
+        Compare: []libkv.Compare{libkv.RevisionEquals(blob, pair.LastIndex), libkv.KeyExists(version, false)},
+        Then:    []libkv.TxnOp{libkv.OpPut(blob, []byte("value2"), nil), libkv.OpPut(version, []byte("2"), nil), libkv.OpGet(blob)},
+        Else:    []libkv.TxnOp{libkv.OpGet(blob)},
+    }
+    result, err := kv.(libkv.Transactor).Txn(txn)
+    assert.Nil(t, err)
+    assert.True(t, result.Succeeded)
+    assert.Len(t, result.Pairs, 3)
+    assert.Equal(t, "value2", string(result.Pairs[2].Value))
+    assert.Equal(t, result.Pairs[0].LastIndex, result.Pairs[2].LastIndex)
+    pair, err = kv.Get(version)
+    assert.Nil(t, err)
+    assert.Equal(t, "2", string(pair.Value))
+
+    result, err = kv.(libkv.Transactor).Txn(txn)
+    assert.Nil(t, err)
+    assert.False(t, result.Succeeded)
+    assert.Len(t, result.Pairs, 1)
+    assert.Equal(t, "value2", string(result.Pairs[0].Value))
+
+    result, err = kv.(libkv.Transactor).Txn(&libkv.Txn{
+        Compare: []libkv.Compare{libkv.ValueEquals(version, []byte("2"))},
+        Then:    []libkv.TxnOp{libkv.OpDelete(version), libkv.OpGet(version)},
+    })
+    assert.Nil(t, err)
+    assert.True(t, result.Succeeded)
+    assert.Equal(t, []*libkv.KVPair{nil, nil}, result.Pairs)
+    exists, err := kv.Exists(version)
+    assert.Nil(t, err)
+    assert.False(t, exists)
+}
+
+func TestRevisionWithoutChanges(t *testing.T) {
+    kv := newTestStorage(t, filepath.Join(t.TempDir(), "kv.db"))
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    pair, err := kv.Get(key)
+    assert.Nil(t, err)
+
+    // reads, failed compares and empty deletes leave the revision as is
+    _, err = kv.(libkv.Transactor).Txn(&libkv.Txn{Then: []libkv.TxnOp{libkv.OpGet(key)}})
+    assert.Nil(t, err)
+    result, err := kv.(libkv.Transactor).Txn(&libkv.Txn{
+        Compare: []libkv.Compare{libkv.KeyExists(key, false)},
+        Then:    []libkv.TxnOp{libkv.OpPut(key, []byte("value2"), nil)},
+    })
+    assert.Nil(t, err)
+    assert.False(t, result.Succeeded)
+    assert.Nil(t, kv.DeleteTree("/test_empty/"))
+
+    assert.Nil(t, kv.Put(key, []byte("value3"), nil))
+    next, err := kv.Get(key)
+    assert.Nil(t, err)
+    assert.Equal(t, pair.LastIndex+1, next.LastIndex)
+}
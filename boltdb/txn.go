@@ -0,0 +1,76 @@
+package boltdb
+
+import (
+    "context"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    bolt "go.etcd.io/bbolt"
+)
+
+var _ libkv.Transactor = (*boltdbImpl)(nil)
+
+func (s *boltdbImpl) Txn(txn *libkv.Txn) (*libkv.TxnResult, error) {
+    return s.TxnContext(context.Background(), txn)
+}
+
+// TxnContext runs the compares and the operations of the branch in one
+// write transaction.
+func (s *boltdbImpl) TxnContext(ctx context.Context, txn *libkv.Txn) (*libkv.TxnResult, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    for _, ops := range [][]libkv.TxnOp{txn.Then, txn.Else} {
+        for _, op := range ops {
+            if op.Type == libkv.TxnPut && op.Options != nil && op.Options.TTL > 0 {
+                return nil, common.ErrTTLUnsupported
+            }
+        }
+    }
+    var result *libkv.TxnResult
+    err := s.update(func(b *bolt.Bucket, rev uint64) ([]*libkv.WatchEvent, error) {
+        get := func(key string) *libkv.KVPair {
+            if v := b.Get([]byte(key)); v != nil {
+                return decodeValue([]byte(key), v)
+            }
+            return nil
+        }
+        result = &libkv.TxnResult{Succeeded: true}
+        for _, c := range txn.Compare {
+            if !c.Holds(get(c.Key)) {
+                result.Succeeded = false
+                break
+            }
+        }
+        ops := txn.Then
+        if !result.Succeeded {
+            ops = txn.Else
+        }
+        var events []*libkv.WatchEvent
+        for _, op := range ops {
+            v := b.Get([]byte(op.Key))
+            switch op.Type {
+            case libkv.TxnPut:
+                events = append(events, putEvent(op.Key, op.Value, v))
+                if err := b.Put([]byte(op.Key), encodeValue(rev, op.Value)); err != nil {
+                    return nil, err
+                }
+                result.Pairs = append(result.Pairs, &libkv.KVPair{Key: op.Key, Value: op.Value, LastIndex: rev})
+            case libkv.TxnDelete:
+                if v != nil {
+                    events = append(events, deleteEvent(op.Key, v))
+                    if err := b.Delete([]byte(op.Key)); err != nil {
+                        return nil, err
+                    }
+                }
+                result.Pairs = append(result.Pairs, nil)
+            default:
+                result.Pairs = append(result.Pairs, get(op.Key))
+            }
+        }
+        return events, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
@@ -3,5 +3,15 @@ package common
 import "errors"
 
 var (
-    ErrAPINotSupported = errors.New("api not supported")
+    ErrAPINotSupported      = errors.New("api not supported")
+    ErrKeyNotFound          = errors.New("key not found")
+    ErrKeyModified          = errors.New("key modified, unable to complete atomic operation")
+    ErrKeyExists            = errors.New("key exists, unable to complete atomic operation")
+    ErrPreviousNotSpecified = errors.New("previous pair should be provided for the atomic operation")
+    ErrLockLost             = errors.New("lock lost")
+    ErrLockNotHeld          = errors.New("lock not held")
+    ErrUnreachable          = errors.New("storage unreachable")
+    ErrTTLUnsupported       = errors.New("ttl not supported")
+    ErrCompacted            = errors.New("revision compacted, resync required")
+    ErrWatchOverflow        = errors.New("watch overflow, events dropped")
 )
@@ -0,0 +1,224 @@
+package consul
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// client talks to the Consul HTTP API, moving on to the next endpoint when
+// the current one can't be reached.
+type client struct {
+    endpoints []string
+    http      *http.Client
+    username  string
+    password  string
+
+    mu      sync.Mutex
+    current int
+}
+
+type response struct {
+    status int
+    index  uint64 // X-Consul-Index
+    body   []byte
+}
+
+type kvEntry struct {
+    Key         string
+    Value       []byte
+    CreateIndex uint64
+    ModifyIndex uint64
+    Session     string
+}
+
+// txnOp is one operation of a /v1/txn request, only KV operations are used.
+type txnOp struct {
+    KV txnKV
+}
+
+type txnKV struct {
+    Verb    string
+    Key     string
+    Value   []byte `json:",omitempty"`
+    Index   uint64 `json:",omitempty"`
+    Session string `json:",omitempty"`
+}
+
+func newClient(endpoints []string, opt *libkv.Config) (*client, error) {
+    tlsConfig, err := newTLSConfig(opt)
+    if err != nil {
+        return nil, err
+    }
+    scheme := "http"
+    if tlsConfig != nil {
+        scheme = "https"
+    }
+    c := &client{
+        http: &http.Client{
+            Transport: &http.Transport{
+                Proxy:           http.ProxyFromEnvironment,
+                TLSClientConfig: tlsConfig,
+            },
+        },
+        username: opt.Username,
+        password: opt.Password,
+    }
+    for _, addr := range endpoints {
+        if !strings.Contains(addr, "://") {
+            addr = scheme + "://" + addr
+        }
+        c.endpoints = append(c.endpoints, strings.TrimSuffix(addr, "/"))
+    }
+    return c, nil
+}
+
+func newTLSConfig(opt *libkv.Config) (*tls.Config, error) {
+    if opt.ClientTLS == nil {
+        return opt.TLS, nil
+    }
+    config := &tls.Config{}
+    if opt.TLS != nil {
+        config = opt.TLS.Clone()
+    }
+    if opt.ClientTLS.CertFile != "" {
+        cert, err := tls.LoadX509KeyPair(opt.ClientTLS.CertFile, opt.ClientTLS.KeyFile)
+        if err != nil {
+            return nil, err
+        }
+        config.Certificates = []tls.Certificate{cert}
+    }
+    if opt.ClientTLS.CACertFile != "" {
+        pem, err := ioutil.ReadFile(opt.ClientTLS.CACertFile)
+        if err != nil {
+            return nil, err
+        }
+        config.RootCAs = x509.NewCertPool()
+        if !config.RootCAs.AppendCertsFromPEM(pem) {
+            return nil, errors.New("consul: no certificate found in " + opt.ClientTLS.CACertFile)
+        }
+    }
+    return config, nil
+}
+
+// do sends the request and returns the response, a 404 is not an error.
+func (c *client) do(ctx context.Context, method, path string, query url.Values, body []byte) (*response, error) {
+    c.mu.Lock()
+    start := c.current
+    c.mu.Unlock()
+
+    var lastErr error
+    for i := 0; i < len(c.endpoints); i++ {
+        n := (start + i) % len(c.endpoints)
+        resp, err := c.send(ctx, c.endpoints[n], method, path, query, body)
+        if err == nil {
+            c.mu.Lock()
+            c.current = n
+            c.mu.Unlock()
+            return resp, nil
+        }
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+        lastErr = err
+    }
+    return nil, fmt.Errorf("%w: %v", common.ErrUnreachable, lastErr)
+}
+
+// send returns an error only when endpoint could not be reached, the
+// status of the response is left to the caller.
+func (c *client) send(ctx context.Context, endpoint, method, path string, query url.Values, body []byte) (*response, error) {
+    u, err := url.Parse(endpoint)
+    if err != nil {
+        return nil, err
+    }
+    u.Path += path
+    u.RawQuery = query.Encode()
+    var r io.Reader
+    if body != nil {
+        r = bytes.NewReader(body)
+    }
+    req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+    if err != nil {
+        return nil, err
+    }
+    if c.username != "" || c.password != "" {
+        req.SetBasicAuth(c.username, c.password)
+    }
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    data, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+    return &response{status: resp.StatusCode, index: index, body: data}, nil
+}
+
+// call is do, failing on any status but success and 404.
+func (c *client) call(ctx context.Context, method, path string, query url.Values, body []byte) (*response, error) {
+    resp, err := c.do(ctx, method, path, query, body)
+    if err != nil {
+        return nil, err
+    }
+    if resp.status != http.StatusNotFound && resp.status/100 != 2 {
+        return nil, fmt.Errorf("consul: %s %s: %d %s", method, path, resp.status, strings.TrimSpace(string(resp.body)))
+    }
+    return resp, nil
+}
+
+// txn runs the operations as one transaction and returns the entry of the
+// last one, or nil when a check failed and the transaction was rolled back.
+func (c *client) txn(ctx context.Context, ops []txnOp) (*kvEntry, error) {
+    body, err := json.Marshal(ops)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := c.do(ctx, http.MethodPut, "/v1/txn", nil, body)
+    if err != nil {
+        return nil, err
+    }
+    if resp.status == http.StatusConflict {
+        return nil, nil
+    }
+    if resp.status/100 != 2 {
+        return nil, fmt.Errorf("consul: PUT /v1/txn: %d %s", resp.status, strings.TrimSpace(string(resp.body)))
+    }
+    var result struct {
+        Results []struct {
+            KV *kvEntry
+        }
+    }
+    if err = resp.decode(&result); err != nil {
+        return nil, err
+    }
+    if n := len(result.Results); n == 0 || result.Results[n-1].KV == nil {
+        return nil, errors.New("consul: transaction returned no entry")
+    }
+    return result.Results[len(result.Results)-1].KV, nil
+}
+
+func (resp *response) decode(v interface{}) error {
+    return json.Unmarshal(resp.body, v)
+}
+
+// succeeded reports the result of a cas, acquire or release write.
+func (resp *response) succeeded() bool {
+    return strings.TrimSpace(string(resp.body)) == "true"
+}
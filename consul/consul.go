@@ -0,0 +1,623 @@
+package consul
+
+import (
+    "context"
+    "errors"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// watchWait bounds a single blocking query, consul caps it at 10 minutes.
+const watchWait = 5 * time.Minute
+
+func init() {
+    libkv.AddStorage("consul", New)
+}
+func New(endpoints []string, opt *libkv.Config) (libkv.Storage, error) {
+    if opt == nil {
+        opt = libkv.DefaultConfig()
+    }
+    if len(endpoints) == 0 {
+        return nil, errors.New("consul endpoints unspecified")
+    }
+    c, err := newClient(endpoints, opt)
+    if err != nil {
+        return nil, err
+    }
+    return &consulImpl{
+        client:  c,
+        timeout: opt.ConnectionTimeout,
+        done:    make(chan struct{}),
+    }, nil
+}
+
+var _ libkv.StorageContext = (*consulImpl)(nil)
+var _ libkv.EventWatcher = (*consulImpl)(nil)
+
+// Consul keys have no leading slash, it is stripped from the keys sent and
+// restored on the keys returned by List and WatchTree.
+type consulImpl struct {
+    client  *client
+    timeout time.Duration
+    done    chan struct{}
+    closed  sync.Once
+}
+
+func (s *consulImpl) withTimeout() (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func kvPath(key string) string {
+    return "/v1/kv/" + strings.TrimPrefix(key, "/")
+}
+
+// get reads key, waiting for a change past index when index is not 0.
+func (s *consulImpl) get(ctx context.Context, key string, index uint64) (*kvEntry, uint64, error) {
+    resp, err := s.client.call(ctx, http.MethodGet, kvPath(key), waitQuery(index), nil)
+    if err != nil {
+        return nil, 0, err
+    }
+    if resp.status == http.StatusNotFound {
+        return nil, resp.index, common.ErrKeyNotFound
+    }
+    var entries []*kvEntry
+    if err = resp.decode(&entries); err != nil {
+        return nil, 0, err
+    }
+    if len(entries) == 0 {
+        return nil, resp.index, common.ErrKeyNotFound
+    }
+    return entries[0], resp.index, nil
+}
+
+// list reads the keys under dir, waiting for a change past index when index
+// is not 0.
+func (s *consulImpl) list(ctx context.Context, dir string, index uint64) ([]*libkv.KVPair, uint64, error) {
+    query := waitQuery(index)
+    query.Set("recurse", "")
+    resp, err := s.client.call(ctx, http.MethodGet, kvPath(dir), query, nil)
+    if err != nil {
+        return nil, 0, err
+    }
+    kvs := make([]*libkv.KVPair, 0)
+    if resp.status == http.StatusNotFound {
+        return kvs, resp.index, nil
+    }
+    var entries []*kvEntry
+    if err = resp.decode(&entries); err != nil {
+        return nil, 0, err
+    }
+    lead := dir[:len(dir)-len(strings.TrimPrefix(dir, "/"))]
+    for _, entry := range entries {
+        kvs = append(kvs, &libkv.KVPair{
+            Key:       lead + entry.Key,
+            Value:     entry.Value,
+            LastIndex: entry.ModifyIndex,
+        })
+    }
+    return kvs, resp.index, nil
+}
+
+func waitQuery(index uint64) url.Values {
+    query := url.Values{}
+    if index > 0 {
+        query.Set("index", strconv.FormatUint(index, 10))
+        query.Set("wait", watchWait.String())
+    }
+    return query
+}
+
+// put writes key. A ttl write is held by a session which deletes the key
+// once it expires.
+func (s *consulImpl) put(ctx context.Context, key string, value []byte, options *libkv.WriteOptions) (bool, error) {
+    if options == nil || options.TTL <= 0 {
+        return s.putPersistent(ctx, key, value)
+    }
+
+    session, err := s.createSession(ctx, key, options.TTL)
+    if err != nil {
+        return false, err
+    }
+    query := url.Values{"acquire": {session}}
+    resp, err := s.client.call(ctx, http.MethodPut, kvPath(key), query, value)
+    if err == nil && !resp.succeeded() {
+        // the key is held by the session of an earlier ttl write, take it over
+        var entry *kvEntry
+        entry, _, err = s.get(ctx, key, 0)
+        if err == nil && entry.Session != "" && entry.Session != session {
+            release := url.Values{"release": {entry.Session}}
+            if _, err = s.client.call(ctx, http.MethodPut, kvPath(key), release, nil); err == nil {
+                resp, err = s.client.call(ctx, http.MethodPut, kvPath(key), query, value)
+            }
+        }
+    }
+    if err != nil || !resp.succeeded() {
+        s.destroySession(session)
+        if err != nil {
+            return false, err
+        }
+        return false, nil
+    }
+    s.keepAlive(session, options.TTL, options.KeepAlive)
+    return true, nil
+}
+
+// putPersistent writes key without ttl. A key held by the session of an
+// earlier ttl write is released along, or the session would still delete
+// it, and the session is destroyed.
+func (s *consulImpl) putPersistent(ctx context.Context, key string, value []byte) (bool, error) {
+    query := url.Values{}
+    for {
+        entry, _, err := s.get(ctx, key, 0)
+        if err != nil && err != common.ErrKeyNotFound {
+            return false, err
+        }
+        session := ""
+        if entry != nil {
+            session = entry.Session
+        }
+        if session != "" {
+            query.Set("release", session)
+        } else {
+            query.Del("release")
+        }
+        resp, err := s.client.call(ctx, http.MethodPut, kvPath(key), query, value)
+        if err != nil {
+            return false, err
+        }
+        if resp.succeeded() {
+            if session != "" {
+                s.destroySession(session)
+            }
+            return true, nil
+        }
+        if session == "" {
+            return false, nil
+        }
+        // held by another session in between, read it again
+    }
+}
+
+// putCAS writes value if the key is still at index cas, 0 meaning it doesn't
+// exist, and returns the index of the write, or 0 when the check failed. The
+// check and the write run in one transaction, whose result carries the index.
+func (s *consulImpl) putCAS(ctx context.Context, key string, value []byte, cas uint64, options *libkv.WriteOptions) (uint64, error) {
+    name := strings.TrimPrefix(key, "/")
+    check := txnKV{Verb: "check-index", Key: name, Index: cas}
+    if cas == 0 {
+        check = txnKV{Verb: "check-not-exists", Key: name}
+    }
+    ops := []txnOp{{KV: check}}
+    if options != nil && options.TTL > 0 {
+        session, err := s.createSession(ctx, key, options.TTL)
+        if err != nil {
+            return 0, err
+        }
+        entry, err := s.client.txn(ctx, append(ops, txnOp{KV: txnKV{Verb: "lock", Key: name, Value: value, Session: session}}))
+        if err != nil || entry == nil {
+            s.destroySession(session)
+            return 0, err
+        }
+        s.keepAlive(session, options.TTL, options.KeepAlive)
+        return entry.ModifyIndex, nil
+    }
+
+    // like putPersistent, free the key from the session of a ttl write
+    entry, _, err := s.get(ctx, key, 0)
+    if err != nil && err != common.ErrKeyNotFound {
+        return 0, err
+    }
+    write := txnKV{Verb: "set", Key: name, Value: value}
+    if entry != nil && entry.Session != "" {
+        write = txnKV{Verb: "unlock", Key: name, Value: value, Session: entry.Session}
+    }
+    written, err := s.client.txn(ctx, append(ops, txnOp{KV: write}))
+    if err != nil || written == nil {
+        return 0, err
+    }
+    if write.Session != "" {
+        s.destroySession(write.Session)
+    }
+    return written.ModifyIndex, nil
+}
+
+func (s *consulImpl) Put(key string, value []byte, options *libkv.WriteOptions) error {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.PutContext(ctx, key, value, options)
+}
+
+func (s *consulImpl) PutContext(ctx context.Context, key string, value []byte, options *libkv.WriteOptions) error {
+    ok, err := s.put(ctx, key, value, options)
+    if err == nil && !ok {
+        return common.ErrKeyModified
+    }
+    return err
+}
+
+func (s *consulImpl) Get(key string) (*libkv.KVPair, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.GetContext(ctx, key)
+}
+
+func (s *consulImpl) GetContext(ctx context.Context, key string) (*libkv.KVPair, error) {
+    entry, _, err := s.get(ctx, key, 0)
+    if err != nil {
+        return nil, err
+    }
+    return &libkv.KVPair{
+        Key:       key,
+        Value:     entry.Value,
+        LastIndex: entry.ModifyIndex,
+    }, nil
+}
+
+func (s *consulImpl) Delete(key string) error {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.DeleteContext(ctx, key)
+}
+
+func (s *consulImpl) DeleteContext(ctx context.Context, key string) error {
+    _, err := s.client.call(ctx, http.MethodDelete, kvPath(key), nil, nil)
+    return err
+}
+
+func (s *consulImpl) Exists(key string) (bool, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.ExistsContext(ctx, key)
+}
+
+func (s *consulImpl) ExistsContext(ctx context.Context, key string) (bool, error) {
+    _, err := s.GetContext(ctx, key)
+    if err == common.ErrKeyNotFound {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+func (s *consulImpl) Watch(key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchContext(context.Background(), key, stopCh)
+}
+
+func (s *consulImpl) WatchContext(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(ctx, stopCh, key)
+}
+
+func (s *consulImpl) WatchMulti(stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(context.Background(), stopCh, keys...)
+}
+
+func (s *consulImpl) WatchMultiContext(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    watchCh := make(chan *libkv.KVPair)
+    ctx, cancel := s.watchContext(ctx, stopCh)
+    var wg sync.WaitGroup
+    for _, key := range keys {
+        wg.Add(1)
+        go func(key string) {
+            defer wg.Done()
+            s.watchKey(ctx, key, watchCh)
+        }(key)
+    }
+    go func() {
+        wg.Wait()
+        cancel()
+        close(watchCh)
+    }()
+    return watchCh, nil
+}
+
+// watchContext returns a context cancelled once the watch is stopped, which
+// also interrupts the pending blocking query.
+func (s *consulImpl) watchContext(ctx context.Context, stopCh <-chan struct{}) (context.Context, context.CancelFunc) {
+    ctx, cancel := context.WithCancel(ctx)
+    go func() {
+        select {
+        case <-stopCh:
+        case <-s.done:
+        case <-ctx.Done():
+        }
+        cancel()
+    }()
+    return ctx, cancel
+}
+
+// watchKey sends the current value of key, then every change of it through
+// blocking queries. A deleted key is sent with an empty value, a failed
+// query is tried again.
+func (s *consulImpl) watchKey(ctx context.Context, key string, watchCh chan<- *libkv.KVPair) {
+    var (
+        index    uint64
+        modified uint64
+    )
+    for {
+        entry, next, err := s.get(ctx, key, index)
+        if err != nil && err != common.ErrKeyNotFound {
+            if ctx.Err() != nil || !watch.Wait(ctx.Done()) {
+                return
+            }
+            continue
+        }
+        var pair *libkv.KVPair
+        switch {
+        case entry != nil && entry.ModifyIndex != modified:
+            modified = entry.ModifyIndex
+            pair = &libkv.KVPair{Key: key, Value: entry.Value, LastIndex: modified}
+        case entry == nil && modified != 0:
+            modified = 0
+            pair = &libkv.KVPair{Key: key, LastIndex: next}
+        }
+        if pair != nil {
+            select {
+            case watchCh <- pair:
+            case <-ctx.Done():
+                return
+            }
+        }
+        index = nextIndex(index, next)
+    }
+}
+
+// nextIndex follows the consul advice on blocking queries: start over when
+// the index goes backwards and never wait on 0.
+func nextIndex(index, next uint64) uint64 {
+    if next < index || next == 0 {
+        return 1
+    }
+    return next
+}
+
+func (s *consulImpl) WatchTree(dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    return s.WatchTreeContext(context.Background(), dir, stopCh)
+}
+
+func (s *consulImpl) WatchTreeContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    watchCh := make(chan []*libkv.KVPair)
+    ctx, cancel := s.watchContext(ctx, stopCh)
+    go func() {
+        defer close(watchCh)
+        defer cancel()
+        var index uint64
+        for {
+            list, next, err := s.list(ctx, dir, index)
+            if err != nil {
+                if ctx.Err() != nil || !watch.Wait(ctx.Done()) {
+                    return
+                }
+                continue
+            }
+            if next != index {
+                select {
+                case watchCh <- list:
+                case <-ctx.Done():
+                    return
+                }
+            }
+            index = nextIndex(index, next)
+        }
+    }()
+    return watchCh, nil
+}
+
+func (s *consulImpl) WatchEvents(stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchEventsContext(context.Background(), stopCh, options, keys...)
+}
+
+func (s *consulImpl) WatchEventsContext(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    if options != nil && options.Revision != 0 {
+        return nil, common.ErrAPINotSupported
+    }
+    ctx, cancel := s.watchContext(ctx, stopCh)
+    loops := make([]func(sink *watch.Sink), 0, len(keys))
+    for _, key := range keys {
+        key := key
+        loop, err := s.watchEvents(ctx, func(ctx context.Context, index uint64) ([]*libkv.KVPair, uint64, error) {
+            entry, next, err := s.get(ctx, key, index)
+            if err == common.ErrKeyNotFound {
+                return nil, next, nil
+            }
+            if err != nil {
+                return nil, 0, err
+            }
+            return []*libkv.KVPair{{Key: key, Value: entry.Value, LastIndex: entry.ModifyIndex}}, next, nil
+        }, nil)
+        if err != nil {
+            cancel()
+            return nil, err
+        }
+        loops = append(loops, loop)
+    }
+    sink := watch.NewSink(ctx.Done(), options)
+    var wg sync.WaitGroup
+    for _, loop := range loops {
+        wg.Add(1)
+        go func(loop func(sink *watch.Sink)) {
+            defer wg.Done()
+            loop(sink)
+        }(loop)
+    }
+    go func() {
+        wg.Wait()
+        cancel()
+        sink.Close()
+    }()
+    return sink.C(), nil
+}
+
+func (s *consulImpl) WatchTreeEvents(dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeEventsContext(context.Background(), dir, stopCh, options)
+}
+
+func (s *consulImpl) WatchTreeEventsContext(ctx context.Context, dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    if options != nil && options.Revision != 0 {
+        return nil, common.ErrAPINotSupported
+    }
+    return s.watchTreeEvents(ctx, dir, stopCh, options, nil)
+}
+
+func (s *consulImpl) WatchTreeDeltas(dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeDeltasContext(context.Background(), dir, stopCh)
+}
+
+func (s *consulImpl) WatchTreeDeltasContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return s.watchTreeEvents(ctx, dir, stopCh, nil, func(pairs []*libkv.KVPair, index uint64) *libkv.WatchEvent {
+        return watch.SnapshotEvent(dir, pairs, index)
+    })
+}
+
+func (s *consulImpl) watchTreeEvents(ctx context.Context, dir string, stopCh <-chan struct{}, options *libkv.WatchOptions, snapshot func(pairs []*libkv.KVPair, index uint64) *libkv.WatchEvent) (<-chan *libkv.WatchEvent, error) {
+    ctx, cancel := s.watchContext(ctx, stopCh)
+    loop, err := s.watchEvents(ctx, func(ctx context.Context, index uint64) ([]*libkv.KVPair, uint64, error) {
+        return s.list(ctx, dir, index)
+    }, snapshot)
+    if err != nil {
+        cancel()
+        return nil, err
+    }
+    sink := watch.NewSink(ctx.Done(), options)
+    go func() {
+        defer sink.Close()
+        defer cancel()
+        loop(sink)
+    }()
+    return sink.C(), nil
+}
+
+// watchEvents reads the current values through the blocking query read, and
+// returns the loop sending them through snapshot when given, then the
+// differences between the next results. The failed reads are reported and
+// tried again.
+func (s *consulImpl) watchEvents(ctx context.Context, read func(ctx context.Context, index uint64) ([]*libkv.KVPair, uint64, error), snapshot func(pairs []*libkv.KVPair, index uint64) *libkv.WatchEvent) (func(sink *watch.Sink), error) {
+    pairs, next, err := read(ctx, 0)
+    if err != nil {
+        return nil, err
+    }
+    return func(sink *watch.Sink) {
+        var events []*libkv.WatchEvent
+        if snapshot != nil {
+            events = append(events, snapshot(pairs, next))
+        }
+        index := nextIndex(0, next)
+        last := watch.Snapshot(pairs)
+        for {
+            for _, event := range events {
+                if !sink.Send(event) {
+                    return
+                }
+            }
+            pairs, next, err := read(ctx, index)
+            if err != nil {
+                if ctx.Err() != nil || !sink.Retry(err) {
+                    return
+                }
+                events = nil
+                continue
+            }
+            events = watch.Diff(last, pairs, next)
+            last = watch.Snapshot(pairs)
+            index = nextIndex(index, next)
+        }
+    }, nil
+}
+
+func (s *consulImpl) NewLock(key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    return s.NewLockContext(context.Background(), key, options)
+}
+
+func (s *consulImpl) NewLockContext(ctx context.Context, key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return s.newLock(key, options), nil
+}
+
+func (s *consulImpl) List(dir string) ([]*libkv.KVPair, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.ListContext(ctx, dir)
+}
+
+func (s *consulImpl) ListContext(ctx context.Context, dir string) ([]*libkv.KVPair, error) {
+    kvs, _, err := s.list(ctx, dir, 0)
+    return kvs, err
+}
+
+func (s *consulImpl) DeleteTree(dir string) error {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.DeleteTreeContext(ctx, dir)
+}
+
+func (s *consulImpl) DeleteTreeContext(ctx context.Context, dir string) error {
+    _, err := s.client.call(ctx, http.MethodDelete, kvPath(dir), url.Values{"recurse": {""}}, nil)
+    return err
+}
+
+func (s *consulImpl) AtomicPut(key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.AtomicPutContext(ctx, key, value, previous, options)
+}
+
+func (s *consulImpl) AtomicPutContext(ctx context.Context, key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    // a cas on index 0 only creates the key
+    var cas uint64
+    if previous != nil {
+        cas = previous.LastIndex
+    }
+    index, err := s.putCAS(ctx, key, value, cas, options)
+    if err != nil {
+        return false, nil, err
+    }
+    if index == 0 {
+        if previous == nil {
+            return false, nil, common.ErrKeyExists
+        }
+        return false, nil, common.ErrKeyModified
+    }
+    return true, &libkv.KVPair{Key: key, Value: value, LastIndex: index}, nil
+}
+
+func (s *consulImpl) AtomicDelete(key string, previous *libkv.KVPair) (bool, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.AtomicDeleteContext(ctx, key, previous)
+}
+
+func (s *consulImpl) AtomicDeleteContext(ctx context.Context, key string, previous *libkv.KVPair) (bool, error) {
+    if previous == nil {
+        return false, common.ErrPreviousNotSpecified
+    }
+    // a cas delete of a missing key succeeds, so look it up first
+    entry, _, err := s.get(ctx, key, 0)
+    if err != nil {
+        return false, err
+    }
+    if entry.ModifyIndex != previous.LastIndex {
+        return false, common.ErrKeyModified
+    }
+    query := url.Values{"cas": {strconv.FormatUint(previous.LastIndex, 10)}}
+    resp, err := s.client.call(ctx, http.MethodDelete, kvPath(key), query, nil)
+    if err != nil {
+        return false, err
+    }
+    if !resp.succeeded() {
+        return false, common.ErrKeyModified
+    }
+    return true, nil
+}
+
+func (s *consulImpl) Close() {
+    s.closed.Do(func() {
+        close(s.done)
+    })
+}
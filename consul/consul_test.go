@@ -0,0 +1,628 @@
+package consul
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/stretchr/testify/assert"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeConsul serves the subset of the KV, txn and session endpoints used by
+// the backend, keeping everything in memory.
+type fakeConsul struct {
+    mu       sync.Mutex
+    index    uint64
+    entries  map[string]*kvEntry
+    removed  map[string]uint64 // tombstones, so blocking queries see deletes
+    sessions map[string]bool
+    changed  chan struct{}
+    written  func() // called with mu held after a successful KV write
+    failing  bool   // blocking queries fail
+}
+
+func newFakeConsul(t *testing.T) *httptest.Server {
+    _, srv := startFakeConsul(t)
+    return srv
+}
+
+func startFakeConsul(t *testing.T) (*fakeConsul, *httptest.Server) {
+    f := &fakeConsul{
+        index:    1,
+        entries:  map[string]*kvEntry{},
+        removed:  map[string]uint64{},
+        sessions: map[string]bool{},
+        changed:  make(chan struct{}),
+    }
+    srv := httptest.NewServer(f)
+    t.Cleanup(srv.Close)
+    return f, srv
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+        http.Error(w, "ACL not found", http.StatusForbidden)
+        return
+    }
+    switch {
+    case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+        f.serveKV(w, r, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+    case r.URL.Path == "/v1/txn":
+        f.serveTxn(w, r)
+    case r.URL.Path == "/v1/session/create":
+        f.mu.Lock()
+        id := fmt.Sprintf("session-%d", f.index)
+        f.sessions[id] = true
+        f.mu.Unlock()
+        _ = json.NewEncoder(w).Encode(map[string]string{"ID": id})
+    case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+        f.mu.Lock()
+        ok := f.sessions[strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")]
+        f.mu.Unlock()
+        if !ok {
+            http.NotFound(w, r)
+        }
+    case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+        f.destroy(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+        _, _ = w.Write([]byte("true"))
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+func (f *fakeConsul) serveKV(w http.ResponseWriter, r *http.Request, key string) {
+    query := r.URL.Query()
+    _, recurse := query["recurse"]
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    switch r.Method {
+    case http.MethodGet:
+        index, _ := strconv.ParseUint(query.Get("index"), 10, 64)
+        for index > 0 && f.lastIndex(key, recurse) <= index {
+            changed := f.changed
+            f.mu.Unlock()
+            select {
+            case <-changed:
+            case <-r.Context().Done():
+            }
+            f.mu.Lock()
+            if r.Context().Err() != nil {
+                return
+            }
+        }
+        if index > 0 && f.failing {
+            http.Error(w, "rpc error", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("X-Consul-Index", strconv.FormatUint(f.lastIndex(key, recurse), 10))
+        var entries []*kvEntry
+        for k, entry := range f.entries {
+            if k == key || (recurse && strings.HasPrefix(k, key)) {
+                entries = append(entries, entry)
+            }
+        }
+        if len(entries) == 0 {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        _ = json.NewEncoder(w).Encode(entries)
+    case http.MethodPut:
+        body, _ := ioutil.ReadAll(r.Body)
+        entry := f.entries[key]
+        ok := true
+        if cas, found := query["cas"]; found {
+            index, _ := strconv.ParseUint(cas[0], 10, 64)
+            ok = (entry == nil && index == 0) || (entry != nil && entry.ModifyIndex == index)
+        }
+        if session := query.Get("acquire"); ok && session != "" {
+            ok = f.sessions[session] && (entry == nil || entry.Session == "" || entry.Session == session)
+            if ok {
+                f.set(key, body).Session = session
+            }
+        } else if session := query.Get("release"); ok && session != "" {
+            ok = entry != nil && entry.Session == session
+            if ok {
+                f.set(key, body).Session = ""
+            }
+        } else if ok {
+            f.set(key, body)
+        }
+        if ok {
+            f.wrote()
+        }
+        _, _ = w.Write([]byte(strconv.FormatBool(ok)))
+    case http.MethodDelete:
+        ok := true
+        if cas, found := query["cas"]; found {
+            index, _ := strconv.ParseUint(cas[0], 10, 64)
+            ok = f.entries[key] == nil || f.entries[key].ModifyIndex == index
+        }
+        for k := range f.entries {
+            if ok && (k == key || (recurse && strings.HasPrefix(k, key))) {
+                f.remove(k)
+            }
+        }
+        _, _ = w.Write([]byte(strconv.FormatBool(ok)))
+    }
+}
+
+func (f *fakeConsul) serveTxn(w http.ResponseWriter, r *http.Request) {
+    var ops []txnOp
+    if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    for _, op := range ops {
+        entry := f.entries[op.KV.Key]
+        ok := true
+        switch op.KV.Verb {
+        case "check-not-exists":
+            ok = entry == nil
+        case "check-index":
+            ok = entry != nil && entry.ModifyIndex == op.KV.Index
+        case "lock":
+            ok = f.sessions[op.KV.Session] && (entry == nil || entry.Session == "" || entry.Session == op.KV.Session)
+        case "unlock":
+            ok = entry != nil && entry.Session == op.KV.Session
+        }
+        if !ok {
+            w.WriteHeader(http.StatusConflict)
+            _, _ = w.Write([]byte(`{"Errors":[{"What":"failed"}]}`))
+            return
+        }
+    }
+    var results []map[string]kvEntry
+    for _, op := range ops {
+        entry := f.entries[op.KV.Key]
+        switch op.KV.Verb {
+        case "set", "lock", "unlock":
+            entry = f.set(op.KV.Key, op.KV.Value)
+            entry.Session = op.KV.Session
+            if op.KV.Verb == "unlock" {
+                entry.Session = ""
+            }
+        }
+        if entry != nil {
+            results = append(results, map[string]kvEntry{"KV": *entry})
+        }
+    }
+    f.wrote()
+    _ = json.NewEncoder(w).Encode(map[string]interface{}{"Results": results})
+}
+
+func (f *fakeConsul) wrote() {
+    if written := f.written; written != nil {
+        f.written = nil
+        written()
+    }
+}
+
+func (f *fakeConsul) lastIndex(key string, recurse bool) uint64 {
+    last := uint64(1)
+    for k, entry := range f.entries {
+        if (k == key || (recurse && strings.HasPrefix(k, key))) && entry.ModifyIndex > last {
+            last = entry.ModifyIndex
+        }
+    }
+    for k, index := range f.removed {
+        if (k == key || (recurse && strings.HasPrefix(k, key))) && index > last {
+            last = index
+        }
+    }
+    return last
+}
+
+func (f *fakeConsul) bump() uint64 {
+    f.index++
+    close(f.changed)
+    f.changed = make(chan struct{})
+    return f.index
+}
+
+func (f *fakeConsul) set(key string, value []byte) *kvEntry {
+    index := f.bump()
+    entry := f.entries[key]
+    if entry == nil {
+        entry = &kvEntry{Key: key, CreateIndex: index}
+        f.entries[key] = entry
+    }
+    entry.Value = value
+    entry.ModifyIndex = index
+    return entry
+}
+
+func (f *fakeConsul) remove(key string) {
+    delete(f.entries, key)
+    f.removed[key] = f.bump()
+}
+
+func (f *fakeConsul) destroy(id string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    delete(f.sessions, id)
+    for k, entry := range f.entries {
+        if entry.Session == id {
+            f.remove(k)
+        }
+    }
+}
+
+func newTestStorage(t *testing.T) libkv.Storage {
+    _, kv := newTestFake(t)
+    return kv
+}
+
+func newTestFake(t *testing.T) (*fakeConsul, libkv.Storage) {
+    f, srv := startFakeConsul(t)
+    opt := libkv.DefaultConfig()
+    opt.Username = "user"
+    opt.Password = "pass"
+    kv, err := New([]string{strings.TrimPrefix(srv.URL, "http://")}, opt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return f, kv
+}
+
+func TestNew(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+
+    _, err := kv.Get("/test_dir/node1")
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+    assert.Nil(t, kv.Put("/test_dir2/node1", []byte("other"), nil))
+
+    pair, err := kv.Get("/test_dir/node1")
+    assert.Nil(t, err)
+    assert.Equal(t, "/test_dir/node1", pair.Key)
+    assert.Equal(t, "value1", string(pair.Value))
+    assert.NotZero(t, pair.LastIndex)
+
+    list, err := kv.List("/test_dir/")
+    assert.Nil(t, err)
+    assert.Len(t, list, 2)
+    for _, pair := range list {
+        assert.True(t, strings.HasPrefix(pair.Key, "/test_dir/"))
+    }
+
+    assert.Nil(t, kv.DeleteTree("/test_dir/"))
+    ok, err := kv.Exists("/test_dir/node2")
+    assert.Nil(t, err)
+    assert.False(t, ok)
+    ok, err = kv.Exists("/test_dir2/node1")
+    assert.Nil(t, err)
+    assert.True(t, ok)
+
+    // closing twice is harmless
+    kv.Close()
+    kv.Close()
+}
+
+func TestUnauthorized(t *testing.T) {
+    srv := newFakeConsul(t)
+    kv, err := New([]string{srv.URL}, nil)
+    assert.Nil(t, err)
+    defer kv.Close()
+    _, err = kv.Get("/test_dir/node1")
+    assert.NotNil(t, err)
+    assert.NotEqual(t, common.ErrKeyNotFound, err)
+}
+
+func TestAtomic(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/atomic/node"
+
+    ok, pair, err := kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    _, _, err = kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Equal(t, common.ErrKeyExists, err)
+
+    ok, next, err := kv.AtomicPut(key, []byte("v2"), pair, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    assert.True(t, next.LastIndex > pair.LastIndex)
+    _, _, err = kv.AtomicPut(key, []byte("v3"), pair, nil)
+    assert.Equal(t, common.ErrKeyModified, err)
+    _, err = kv.AtomicDelete(key, pair)
+    assert.Equal(t, common.ErrKeyModified, err)
+
+    ok, err = kv.AtomicDelete(key, next)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    _, err = kv.AtomicDelete(key, next)
+    assert.Equal(t, common.ErrKeyNotFound, err)
+}
+
+func TestAtomicConcurrentWrite(t *testing.T) {
+    f, kv := newTestFake(t)
+    defer kv.Close()
+    key := "/atomic/node"
+
+    // another writer changes the key right after the check-and-set
+    f.mu.Lock()
+    f.written = func() { f.set("atomic/node", []byte("other")) }
+    f.mu.Unlock()
+    ok, pair, err := kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    assert.Equal(t, "v1", string(pair.Value))
+    _, _, err = kv.AtomicPut(key, []byte("v2"), pair, nil)
+    assert.Equal(t, common.ErrKeyModified, err)
+
+    // and a key held by a ttl write is released along
+    keepAlive := make(chan struct{})
+    defer close(keepAlive)
+    ok, pair, err = kv.AtomicPut("/atomic/ttl", []byte("v1"), nil, &libkv.WriteOptions{TTL: time.Second, KeepAlive: keepAlive})
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    ok, pair, err = kv.AtomicPut("/atomic/ttl", []byte("v2"), pair, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    current, err := kv.Get("/atomic/ttl")
+    assert.Nil(t, err)
+    assert.Equal(t, pair, current)
+    f.mu.Lock()
+    assert.Empty(t, f.entries["atomic/ttl"].Session)
+    f.mu.Unlock()
+}
+
+func TestTTL(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/ttl/node"
+
+    keepAlive := make(chan struct{})
+    assert.Nil(t, kv.Put(key, []byte("v1"), &libkv.WriteOptions{TTL: time.Second, KeepAlive: keepAlive}))
+    // a later ttl write takes the key over
+    assert.Nil(t, kv.Put(key, []byte("v2"), &libkv.WriteOptions{TTL: time.Second}))
+    pair, err := kv.Get(key)
+    assert.Nil(t, err)
+    assert.Equal(t, "v2", string(pair.Value))
+
+    keepAlive2 := make(chan struct{})
+    assert.Nil(t, kv.Put("/ttl/other", []byte("v"), &libkv.WriteOptions{TTL: time.Second, KeepAlive: keepAlive2}))
+    close(keepAlive2)
+    assert.Eventually(t, func() bool {
+        ok, err := kv.Exists("/ttl/other")
+        return err == nil && !ok
+    }, time.Second, time.Millisecond*10)
+    close(keepAlive)
+
+    // a write without ttl frees the key from the session of the ttl write
+    keepAlive3 := make(chan struct{})
+    assert.Nil(t, kv.Put(key, []byte("v3"), &libkv.WriteOptions{TTL: time.Second, KeepAlive: keepAlive3}))
+    assert.Nil(t, kv.Put(key, []byte("v4"), nil))
+    close(keepAlive3)
+    time.Sleep(time.Millisecond * 100)
+    pair, err = kv.Get(key)
+    assert.Nil(t, err)
+    assert.Equal(t, "v4", string(pair.Value))
+}
+
+func TestWatch(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    ch, err := kv.Watch(key, stopCh)
+    assert.Nil(t, err)
+    treeCh, err := kv.WatchTree("/test_dir/", stopCh)
+    assert.Nil(t, err)
+
+    select {
+    case list := <-treeCh:
+        assert.Len(t, list, 1)
+    case <-time.After(time.Second):
+        t.Fatal("timeout waiting for tree watch")
+    }
+    for _, want := range []string{"value0", "value1", ""} {
+        switch want {
+        case "value1":
+            assert.Nil(t, kv.Put(key, []byte(want), nil))
+        case "":
+            assert.Nil(t, kv.Delete(key))
+        }
+        select {
+        case pair := <-ch:
+            assert.Equal(t, want, string(pair.Value))
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for watch")
+        }
+    }
+    select {
+    case list := <-treeCh:
+        assert.True(t, len(list) <= 1)
+    case <-time.After(time.Second):
+        t.Fatal("timeout waiting for tree watch")
+    }
+
+    close(stopCh)
+    for range ch {
+    }
+    for range treeCh {
+    }
+}
+
+func TestWatchRetry(t *testing.T) {
+    f, kv := newTestFake(t)
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.Watch(key, stopCh)
+    assert.Nil(t, err)
+    treeCh, err := kv.WatchTree("/test_dir/", stopCh)
+    assert.Nil(t, err)
+    <-ch
+    <-treeCh
+
+    // the blocking queries fail for a while, the watches keep going
+    f.mu.Lock()
+    f.failing = true
+    f.mu.Unlock()
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    time.Sleep(time.Millisecond * 100)
+    f.mu.Lock()
+    f.failing = false
+    f.mu.Unlock()
+    select {
+    case pair, ok := <-ch:
+        if assert.True(t, ok) {
+            assert.Equal(t, "value1", string(pair.Value))
+        }
+    case <-time.After(time.Second * 3):
+        t.Fatal("timeout waiting for watch")
+    }
+    select {
+    case list, ok := <-treeCh:
+        if assert.True(t, ok) && assert.Len(t, list, 1) {
+            assert.Equal(t, "value1", string(list[0].Value))
+        }
+    case <-time.After(time.Second * 3):
+        t.Fatal("timeout waiting for tree watch")
+    }
+}
+
+func TestWatchEvents(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.(libkv.EventWatcher).WatchEvents(stopCh, nil, key)
+    assert.Nil(t, err)
+    treeCh, err := kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, nil)
+    assert.Nil(t, err)
+    next := func(ch <-chan *libkv.WatchEvent) string {
+        select {
+        case event := <-ch:
+            s := event.Op.String() + " " + event.Key
+            if event.Pair != nil {
+                s += " " + string(event.Pair.Value)
+            }
+            if event.Previous != nil {
+                s += " (" + string(event.Previous.Value) + ")"
+            }
+            return s
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for events")
+        }
+        return ""
+    }
+
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    assert.Equal(t, "put /test_dir/node1 value1 (value0)", next(ch))
+    assert.Equal(t, "put /test_dir/node1 value1 (value0)", next(treeCh))
+    assert.Nil(t, kv.Delete(key))
+    assert.Equal(t, "delete /test_dir/node1 (value1)", next(ch))
+    assert.Equal(t, "delete /test_dir/node1 (value1)", next(treeCh))
+}
+
+func TestWatchTreeDeltas(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.(libkv.EventWatcher).WatchTreeDeltas("/test_dir/", stopCh)
+    assert.Nil(t, err)
+    tree := libkv.NewTree()
+    next := func() {
+        select {
+        case event := <-ch:
+            tree.Apply(event)
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for events")
+        }
+    }
+    next()
+    assert.Len(t, tree.List(), 1)
+
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+    next()
+    assert.Nil(t, kv.Delete("/test_dir/node1"))
+    next()
+    list, err := kv.List("/test_dir/")
+    assert.Nil(t, err)
+    assert.Equal(t, list, tree.List())
+}
+
+func TestLock(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/lock/node"
+
+    l1, err := kv.NewLock(key, &libkv.LockOptions{Value: []byte("holder1")})
+    assert.Nil(t, err)
+    assert.Equal(t, common.ErrLockNotHeld, l1.Unlock())
+    lost1, err := l1.Lock(nil)
+    assert.Nil(t, err)
+    assert.NotNil(t, lost1)
+    pair, err := kv.Get(key)
+    assert.Nil(t, err)
+    assert.Equal(t, "holder1", string(pair.Value))
+
+    // locking again releases the lock held so far
+    relockStop := make(chan struct{})
+    time.AfterFunc(time.Second, func() { close(relockStop) })
+    relocked, err := l1.Lock(relockStop)
+    assert.Nil(t, err)
+    if assert.NotNil(t, relocked) {
+        select {
+        case <-lost1:
+        case <-time.After(time.Second):
+            t.Fatal("first hold not released")
+        }
+        lost1 = relocked
+    }
+
+    l2, err := kv.NewLock(key, nil)
+    assert.Nil(t, err)
+    stopCh := make(chan struct{})
+    time.AfterFunc(time.Millisecond*50, func() { close(stopCh) })
+    lost2, err := l2.Lock(stopCh)
+    assert.Nil(t, err)
+    assert.Nil(t, lost2)
+
+    acquired := make(chan struct{})
+    go func() {
+        defer close(acquired)
+        lost, err := l2.Lock(nil)
+        assert.Nil(t, err)
+        assert.NotNil(t, lost)
+    }()
+    time.Sleep(time.Millisecond * 50)
+    assert.Nil(t, l1.Unlock())
+    select {
+    case <-lost1:
+    case <-time.After(time.Second):
+        t.Fatal("lock channel not closed on unlock")
+    }
+    select {
+    case <-acquired:
+    case <-time.After(time.Second):
+        t.Fatal("timeout waiting for lock")
+    }
+    assert.Nil(t, l2.Unlock())
+}
@@ -0,0 +1,166 @@
+package consul
+
+import (
+    "context"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+)
+
+const defaultLockTTL = 20 * time.Second
+
+// consulLock holds key through the acquire flag of a session, the key is
+// deleted when the session is destroyed or expires.
+type consulLock struct {
+    s       *consulImpl
+    key     string
+    value   []byte
+    ttl     time.Duration
+    renewCh chan struct{}
+
+    mu      sync.Mutex
+    session string
+    done    chan struct{}
+}
+
+func (s *consulImpl) newLock(key string, options *libkv.LockOptions) *consulLock {
+    l := &consulLock{
+        s:   s,
+        key: key,
+        ttl: defaultLockTTL,
+    }
+    if options != nil {
+        l.value = options.Value
+        l.renewCh = options.RenewLock
+        if options.TTL > 0 {
+            l.ttl = options.TTL
+        }
+    }
+    if l.ttl < minSessionTTL {
+        l.ttl = minSessionTTL
+    }
+    return l
+}
+
+// The lock is lost once its session can no longer be renewed.
+func (l *consulLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.done != nil {
+        // locking again destroys the session held so far, and the lock with it
+        l.release()
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go func() {
+        select {
+        case <-stopChan:
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+
+    session, err := l.s.createSession(ctx, l.key, l.ttl)
+    if err != nil {
+        if ctx.Err() != nil {
+            return nil, nil
+        }
+        return nil, err
+    }
+    if err = l.acquire(ctx, session); err != nil {
+        l.s.destroySession(session)
+        if ctx.Err() != nil {
+            return nil, nil
+        }
+        return nil, err
+    }
+
+    l.session = session
+    l.done = make(chan struct{})
+    lostCh := make(chan struct{})
+    go l.holdLock(session, l.done, lostCh)
+    return lostCh, nil
+}
+
+// acquire waits for the key to be free through blocking queries, until
+// session gets it.
+func (l *consulLock) acquire(ctx context.Context, session string) error {
+    var index uint64
+    for {
+        resp, err := l.s.client.call(ctx, http.MethodPut, kvPath(l.key), url.Values{"acquire": {session}}, l.value)
+        if err != nil {
+            return err
+        }
+        if resp.succeeded() {
+            return nil
+        }
+        for {
+            entry, next, err := l.s.get(ctx, l.key, index)
+            if err != nil && err != common.ErrKeyNotFound {
+                return err
+            }
+            index = nextIndex(index, next)
+            if entry == nil || entry.Session == "" {
+                break
+            }
+        }
+    }
+}
+
+// holdLock renews the session until RenewLock is closed, and closes lostCh
+// when a renewal fails or the session expires.
+func (l *consulLock) holdLock(session string, done, lostCh chan struct{}) {
+    defer close(lostCh)
+    ticker := time.NewTicker(l.ttl / 2)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-done:
+            return
+        case <-l.renewCh:
+            select {
+            case <-time.After(l.ttl):
+            case <-done:
+            }
+            return
+        case <-ticker.C:
+            ctx, cancel := l.s.withTimeout()
+            err := l.s.renewSession(ctx, session)
+            cancel()
+            if err != nil {
+                return
+            }
+        }
+    }
+}
+
+func (l *consulLock) Unlock() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.done == nil {
+        return common.ErrLockNotHeld
+    }
+
+    ctx, cancel := l.s.withTimeout()
+    defer cancel()
+    entry, _, err := l.s.get(ctx, l.key, 0)
+    session := l.session
+    l.release()
+    if err == common.ErrKeyNotFound || (err == nil && entry.Session != session) {
+        return common.ErrLockLost
+    }
+    return err
+}
+
+// release stops renewing the session held and destroys it. The caller holds
+// l.mu.
+func (l *consulLock) release() {
+    close(l.done)
+    l.done = nil
+    l.s.destroySession(l.session)
+    l.session = ""
+}
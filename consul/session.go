@@ -0,0 +1,93 @@
+package consul
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "github.com/DGHeroin/libkv/common"
+    "net/http"
+    "time"
+)
+
+const (
+    minSessionTTL = 10 * time.Second
+    maxSessionTTL = 24 * time.Hour
+)
+
+// createSession returns a session whose keys are deleted once it expires or
+// is destroyed. Consul only accepts ttls between 10s and 24h.
+func (s *consulImpl) createSession(ctx context.Context, name string, ttl time.Duration) (string, error) {
+    if ttl < minSessionTTL {
+        ttl = minSessionTTL
+    }
+    if ttl > maxSessionTTL {
+        ttl = maxSessionTTL
+    }
+    body, err := json.Marshal(map[string]string{
+        "Name":      name,
+        "TTL":       fmt.Sprintf("%ds", (ttl+time.Second-1)/time.Second),
+        "Behavior":  "delete",
+        "LockDelay": "0s",
+    })
+    if err != nil {
+        return "", err
+    }
+    resp, err := s.client.call(ctx, http.MethodPut, "/v1/session/create", nil, body)
+    if err != nil {
+        return "", err
+    }
+    var session struct{ ID string }
+    if err = resp.decode(&session); err != nil {
+        return "", err
+    }
+    return session.ID, nil
+}
+
+// renewSession returns common.ErrLockLost once the session is gone.
+func (s *consulImpl) renewSession(ctx context.Context, id string) error {
+    resp, err := s.client.call(ctx, http.MethodPut, "/v1/session/renew/"+id, nil, nil)
+    if err != nil {
+        return err
+    }
+    if resp.status == http.StatusNotFound {
+        return common.ErrLockLost
+    }
+    return nil
+}
+
+func (s *consulImpl) destroySession(id string) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    _, _ = s.client.call(ctx, http.MethodPut, "/v1/session/destroy/"+id, nil, nil)
+}
+
+// keepAlive renews the session of a ttl write until keepAlive is closed,
+// then destroys it so that the key is removed right away.
+func (s *consulImpl) keepAlive(id string, ttl time.Duration, keepAlive chan struct{}) {
+    if keepAlive == nil {
+        return
+    }
+    if ttl < minSessionTTL {
+        ttl = minSessionTTL
+    }
+    go func() {
+        ticker := time.NewTicker(ttl / 2)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-keepAlive:
+                s.destroySession(id)
+                return
+            case <-s.done:
+                return
+            case <-ticker.C:
+                ctx, cancel := s.withTimeout()
+                err := s.renewSession(ctx, id)
+                cancel()
+                if err == common.ErrLockLost {
+                    return
+                }
+            }
+        }
+    }()
+}
@@ -0,0 +1,117 @@
+package libkv
+
+import "context"
+
+// WithContext returns s as a StorageContext. Backends implementing it natively
+// are returned as is, any other Storage is wrapped: the context is checked
+// before each call and stops watches once it is done.
+func WithContext(s Storage) StorageContext {
+    if sc, ok := s.(StorageContext); ok {
+        return sc
+    }
+    return &contextAdapter{Storage: s}
+}
+
+type contextAdapter struct {
+    Storage
+}
+
+func (a *contextAdapter) PutContext(ctx context.Context, key string, value []byte, options *WriteOptions) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return a.Put(key, value, options)
+}
+
+func (a *contextAdapter) GetContext(ctx context.Context, key string) (*KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return a.Get(key)
+}
+
+func (a *contextAdapter) DeleteContext(ctx context.Context, key string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return a.Delete(key)
+}
+
+func (a *contextAdapter) ExistsContext(ctx context.Context, key string) (bool, error) {
+    if err := ctx.Err(); err != nil {
+        return false, err
+    }
+    return a.Exists(key)
+}
+
+func (a *contextAdapter) WatchContext(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return a.Watch(key, mergeStop(ctx, stopCh))
+}
+
+func (a *contextAdapter) WatchMultiContext(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return a.WatchMulti(mergeStop(ctx, stopCh), keys...)
+}
+
+func (a *contextAdapter) WatchTreeContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan []*KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return a.WatchTree(dir, mergeStop(ctx, stopCh))
+}
+
+func (a *contextAdapter) NewLockContext(ctx context.Context, key string, options *LockOptions) (Locker, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return a.NewLock(key, options)
+}
+
+func (a *contextAdapter) ListContext(ctx context.Context, dir string) ([]*KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return a.List(dir)
+}
+
+func (a *contextAdapter) DeleteTreeContext(ctx context.Context, dir string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return a.DeleteTree(dir)
+}
+
+func (a *contextAdapter) AtomicPutContext(ctx context.Context, key string, value []byte, previous *KVPair, options *WriteOptions) (bool, *KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return false, nil, err
+    }
+    return a.AtomicPut(key, value, previous, options)
+}
+
+func (a *contextAdapter) AtomicDeleteContext(ctx context.Context, key string, previous *KVPair) (bool, error) {
+    if err := ctx.Err(); err != nil {
+        return false, err
+    }
+    return a.AtomicDelete(key, previous)
+}
+
+// mergeStop returns a channel closed as soon as stopCh is closed or ctx is done.
+func mergeStop(ctx context.Context, stopCh <-chan struct{}) <-chan struct{} {
+    if ctx.Done() == nil {
+        return stopCh
+    }
+    ch := make(chan struct{})
+    go func() {
+        defer close(ch)
+        select {
+        case <-stopCh:
+        case <-ctx.Done():
+        }
+    }()
+    return ch
+}
@@ -2,9 +2,17 @@ package etcdv3
 
 import (
     "context"
+    "errors"
+    "fmt"
     "github.com/DGHeroin/libkv"
     "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
     v3 "go.etcd.io/etcd/clientv3"
+    "go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+    "go.etcd.io/etcd/mvcc/mvccpb"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "sync"
     "time"
 )
 
@@ -19,6 +27,7 @@ func New(addrs []string, opt *libkv.Config) (libkv.Storage, error) {
         addrs:   addrs,
         opt:     opt,
         timeout: opt.ConnectionTimeout,
+        done:    make(chan struct{}),
     }
     client, err := v3.New(v3.Config{
         Endpoints:   addrs,
@@ -27,168 +36,523 @@ func New(addrs []string, opt *libkv.Config) (libkv.Storage, error) {
         Password:    opt.Password,
         TLS:         opt.TLS,
     })
+    if errors.Is(err, context.DeadlineExceeded) {
+        return nil, fmt.Errorf("%w: %v", common.ErrUnreachable, err)
+    }
     if err != nil {
-        return nil, err
+        return nil, convertError(err)
     }
     v.client = client
     return v, nil
 }
 
+var _ libkv.StorageContext = (*etcdv3Impl)(nil)
+var _ libkv.EventWatcher = (*etcdv3Impl)(nil)
+
 type etcdv3Impl struct {
     addrs   []string
     opt     *libkv.Config
     client  *v3.Client
     timeout time.Duration
     done    chan struct{}
+    closed  sync.Once
+}
+
+func (s *etcdv3Impl) withTimeout() (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.Background(), s.timeout)
 }
 
 func (s *etcdv3Impl) Put(key string, value []byte, options *libkv.WriteOptions) error {
-    ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+    ctx, cancel := s.withTimeout()
     defer cancel()
-    _, err := s.client.Put(ctx, key, string(value))
+    return s.PutContext(ctx, key, value, options)
+}
 
-    return err
+func (s *etcdv3Impl) PutContext(ctx context.Context, key string, value []byte, options *libkv.WriteOptions) error {
+    lease, err := s.grant(ctx, options)
+    if err != nil {
+        return err
+    }
+    _, err = s.client.Put(ctx, key, string(value), leaseOptions(lease)...)
+    if err != nil {
+        s.revoke(lease)
+        return convertError(err)
+    }
+    s.keepAlive(lease, options)
+    return nil
 }
 
 func (s *etcdv3Impl) Get(key string) (*libkv.KVPair, error) {
-    ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+    ctx, cancel := s.withTimeout()
     defer cancel()
+    return s.GetContext(ctx, key)
+}
+
+func (s *etcdv3Impl) GetContext(ctx context.Context, key string) (*libkv.KVPair, error) {
     resp, err := s.client.Get(ctx, key)
     if err != nil {
-        return nil, err
-    }
-    r := &libkv.KVPair{
-        Key: key,
+        return nil, convertError(err)
     }
-    for _, ev := range resp.Kvs {
-        r.Value = ev.Value
-        break
+    if len(resp.Kvs) == 0 {
+        return nil, common.ErrKeyNotFound
     }
-    return r, nil
+    return &libkv.KVPair{
+        Key:       key,
+        Value:     resp.Kvs[0].Value,
+        LastIndex: uint64(resp.Kvs[0].ModRevision),
+    }, nil
 }
 
 func (s *etcdv3Impl) Delete(key string) error {
-    ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+    ctx, cancel := s.withTimeout()
     defer cancel()
+    return s.DeleteContext(ctx, key)
+}
+
+func (s *etcdv3Impl) DeleteContext(ctx context.Context, key string) error {
     _, err := s.client.Delete(ctx, key)
-    return err
+    return convertError(err)
 }
 
 func (s *etcdv3Impl) Exists(key string) (bool, error) {
-    r, err := s.Get(key)
-    if err != nil {
-        return false, err
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.ExistsContext(ctx, key)
+}
+
+func (s *etcdv3Impl) ExistsContext(ctx context.Context, key string) (bool, error) {
+    _, err := s.GetContext(ctx, key)
+    if err == common.ErrKeyNotFound {
+        return false, nil
     }
-    return r.Value != nil, nil
+    return err == nil, err
 }
 
 func (s *etcdv3Impl) Watch(key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
-    return s.WatchMulti(stopCh, key)
+    return s.WatchContext(context.Background(), key, stopCh)
 }
+
+func (s *etcdv3Impl) WatchContext(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(ctx, stopCh, key)
+}
+
 func (s *etcdv3Impl) WatchMulti(stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(context.Background(), stopCh, keys...)
+}
+
+func (s *etcdv3Impl) WatchMultiContext(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    var (
+        initial []*libkv.KVPair
+        rev     int64
+    )
+    // the initial reads are bound by the timeout, ctx bounding the watch
+    readCtx, cancelRead := context.WithTimeout(ctx, s.timeout)
+    defer cancelRead()
+    for _, key := range keys {
+        resp, err := s.client.Get(readCtx, key)
+        if err != nil {
+            return nil, convertError(err)
+        }
+        // the keys read later may be sent twice, none is missed
+        if rev == 0 {
+            rev = resp.Header.Revision
+        }
+        initial = append(initial, pairs(resp.Kvs)...)
+    }
+    ctx, cancel := s.watchContext(ctx, stopCh)
     watchCh := make(chan *libkv.KVPair)
+    send := func(pair *libkv.KVPair) bool {
+        select {
+        case watchCh <- pair:
+            return true
+        case <-ctx.Done():
+            return false
+        }
+    }
     go func() {
         defer close(watchCh)
-        for _, key := range keys {
-            pair, err := s.Get(key)
-            if err != nil {
-                continue
+        defer cancel()
+        for _, pair := range initial {
+            if !send(pair) {
+                return
             }
-            watchCh <- pair
         }
-
-        watchKey := func(key string) {
-            rch := s.client.Watch(context.Background(), key)
-            for {
-                select {
-                case <-stopCh:
-                    return
-                case <-s.done:
-                    return
-                case wresp := <-rch:
-                    for _, event := range wresp.Events {
-                        watchCh <- &libkv.KVPair{
-                            Key:       string(event.Kv.Key),
-                            Value:     event.Kv.Value,
-                            LastIndex: uint64(event.Kv.Version),
+        var wg sync.WaitGroup
+        for _, key := range keys {
+            wg.Add(1)
+            go func(key string) {
+                defer wg.Done()
+                err := s.follow(ctx, key, rev+1, wait(ctx), func(events []*v3.Event) bool {
+                    for _, ev := range events {
+                        if !send(&libkv.KVPair{Key: string(ev.Kv.Key), Value: ev.Kv.Value, LastIndex: uint64(ev.Kv.ModRevision)}) {
+                            return false
                         }
                     }
+                    return true
+                })
+                if err != nil {
+                    cancel()
                 }
-            }
-        }
-        for _, key := range keys {
-            go watchKey(key)
+            }(key)
         }
+        wg.Wait()
     }()
     return watchCh, nil
 }
 
 func (s *etcdv3Impl) WatchTree(dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    return s.WatchTreeContext(context.Background(), dir, stopCh)
+}
+
+func (s *etcdv3Impl) WatchTreeContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    list, rev, err := s.listWithin(ctx, dir)
+    if err != nil {
+        return nil, err
+    }
+    ctx, cancel := s.watchContext(ctx, stopCh)
     watchCh := make(chan []*libkv.KVPair)
+    send := func(list []*libkv.KVPair) bool {
+        select {
+        case watchCh <- list:
+            return true
+        case <-ctx.Done():
+            return false
+        }
+    }
     go func() {
         defer close(watchCh)
+        defer cancel()
+        if !send(list) {
+            return
+        }
+        retry := wait(ctx)
+        _ = s.follow(ctx, dir, rev+1, retry, func([]*v3.Event) bool {
+            // one listing for all the events of a response
+            for {
+                list, _, err := s.listWithin(ctx, dir)
+                if err == nil {
+                    return send(list)
+                }
+                if !retry(err) {
+                    return false
+                }
+            }
+        }, v3.WithPrefix())
+    }()
+    return watchCh, nil
+}
 
-        list, err := s.List(dir)
-        if err != nil {
+func (s *etcdv3Impl) WatchEvents(stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchEventsContext(context.Background(), stopCh, options, keys...)
+}
+
+func (s *etcdv3Impl) WatchEventsContext(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    rev, err := s.since(ctx, options)
+    if err != nil {
+        return nil, err
+    }
+    return s.watchEvents(ctx, stopCh, options, nil, rev+1, keys), nil
+}
+
+func (s *etcdv3Impl) WatchTreeEvents(dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeEventsContext(context.Background(), dir, stopCh, options)
+}
+
+func (s *etcdv3Impl) WatchTreeEventsContext(ctx context.Context, dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    rev, err := s.since(ctx, options)
+    if err != nil {
+        return nil, err
+    }
+    return s.watchEvents(ctx, stopCh, options, nil, rev+1, []string{dir}, v3.WithPrefix()), nil
+}
+
+func (s *etcdv3Impl) WatchTreeDeltas(dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeDeltasContext(context.Background(), dir, stopCh)
+}
+
+func (s *etcdv3Impl) WatchTreeDeltasContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    list, rev, err := s.listWithin(ctx, dir)
+    if err != nil {
+        return nil, err
+    }
+    snapshot := watch.SnapshotEvent(dir, list, uint64(rev))
+    return s.watchEvents(ctx, stopCh, nil, snapshot, rev+1, []string{dir}, v3.WithPrefix()), nil
+}
+
+// since returns the revision a watch with options starts after, the current
+// one when not resuming.
+func (s *etcdv3Impl) since(ctx context.Context, options *libkv.WatchOptions) (int64, error) {
+    ctx, cancel := context.WithTimeout(ctx, s.timeout)
+    defer cancel()
+    // any key returns the revision of the store
+    resp, err := s.client.Get(ctx, "\x00", v3.WithCountOnly())
+    if err != nil {
+        return 0, convertError(err)
+    }
+    if options == nil || options.Revision == 0 {
+        return resp.Header.Revision, nil
+    }
+    rev := int64(options.Revision)
+    if rev < resp.Header.Revision {
+        // reading the first revision to send fails once compacted
+        if _, err = s.client.Get(ctx, "\x00", v3.WithCountOnly(), v3.WithRev(rev+1)); err != nil {
+            return 0, convertError(err)
+        }
+    }
+    return rev, nil
+}
+
+// watchEvents sends snapshot when given, then the events of keys from
+// revision rev through a sink set up by options, until stopCh is closed,
+// ctx or the storage is done, or the history is compacted.
+func (s *etcdv3Impl) watchEvents(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, snapshot *libkv.WatchEvent, rev int64, keys []string, opts ...v3.OpOption) <-chan *libkv.WatchEvent {
+    ctx, cancel := s.watchContext(ctx, stopCh)
+    sink := watch.NewSink(ctx.Done(), options)
+    opts = append(opts, v3.WithPrevKV())
+    go func() {
+        defer sink.Close()
+        defer cancel()
+        if snapshot != nil && !sink.Send(snapshot) {
             return
         }
-        watchCh <- list
-        rch := s.client.Watch(context.Background(), dir, v3.WithPrefix())
-        for {
-            select {
-            case <-s.done:
-                return
-            case <-rch:
-                list, err := s.List(dir)
+        var wg sync.WaitGroup
+        for _, key := range keys {
+            wg.Add(1)
+            go func(key string) {
+                defer wg.Done()
+                err := s.follow(ctx, key, rev, sink.Retry, func(events []*v3.Event) bool {
+                    for _, ev := range events {
+                        if !sink.Send(newEvent(ev)) {
+                            return false
+                        }
+                    }
+                    return true
+                }, opts...)
                 if err != nil {
-                    return
+                    sink.Error(err)
+                    cancel()
                 }
-                watchCh <- list
+            }(key)
+        }
+        wg.Wait()
+    }()
+    return sink.C()
+}
+
+// follow passes the events of key from revision rev to fn, a response at a
+// time, until ctx is done or fn returns false. A failed etcd watch is opened
+// again after retry, from the revision following the last event, it fails
+// with ErrCompacted once that revision is no longer retained.
+func (s *etcdv3Impl) follow(ctx context.Context, key string, rev int64, retry func(err error) bool, fn func(events []*v3.Event) bool, opts ...v3.OpOption) error {
+    for {
+        err := errors.New("etcd watch closed")
+        for wresp := range s.client.Watch(ctx, key, append(opts, v3.WithRev(rev))...) {
+            if wresp.CompactRevision != 0 {
+                return common.ErrCompacted
+            }
+            if wresp.Err() != nil {
+                err = convertError(wresp.Err())
+                break
             }
+            if len(wresp.Events) == 0 {
+                continue
+            }
+            rev = wresp.Events[len(wresp.Events)-1].Kv.ModRevision + 1
+            if !fn(wresp.Events) {
+                return nil
+            }
+        }
+        if ctx.Err() != nil || !retry(err) {
+            return nil
+        }
+    }
+}
+
+// watchContext returns ctx cancelled once stopCh is closed or the storage is.
+func (s *etcdv3Impl) watchContext(ctx context.Context, stopCh <-chan struct{}) (context.Context, context.CancelFunc) {
+    ctx, cancel := context.WithCancel(ctx)
+    go func() {
+        select {
+        case <-stopCh:
+        case <-s.done:
+        case <-ctx.Done():
         }
+        cancel()
     }()
-    return watchCh, nil
+    return ctx, cancel
+}
+
+// wait is the retry of the watches without a side channel.
+func wait(ctx context.Context) func(err error) bool {
+    return func(error) bool {
+        return watch.Wait(ctx.Done())
+    }
+}
+
+func newEvent(ev *v3.Event) *libkv.WatchEvent {
+    event := &libkv.WatchEvent{
+        Op:       libkv.WatchPut,
+        Key:      string(ev.Kv.Key),
+        Revision: uint64(ev.Kv.ModRevision),
+    }
+    if ev.Type == v3.EventTypeDelete {
+        event.Op = libkv.WatchDelete
+    } else {
+        event.Pair = &libkv.KVPair{Key: event.Key, Value: ev.Kv.Value, LastIndex: event.Revision}
+    }
+    if ev.PrevKv != nil {
+        event.Previous = &libkv.KVPair{Key: event.Key, Value: ev.PrevKv.Value, LastIndex: uint64(ev.PrevKv.ModRevision)}
+    }
+    return event
 }
 
 func (s *etcdv3Impl) NewLock(key string, options *libkv.LockOptions) (libkv.Locker, error) {
-    return nil, common.ErrAPINotSupported
+    return s.NewLockContext(context.Background(), key, options)
+}
+
+func (s *etcdv3Impl) NewLockContext(ctx context.Context, key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return s.newLock(key, options), nil
 }
 
 func (s *etcdv3Impl) List(dir string) ([]*libkv.KVPair, error) {
-    ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+    ctx, cancel := s.withTimeout()
     defer cancel()
+    return s.ListContext(ctx, dir)
+}
+
+func (s *etcdv3Impl) ListContext(ctx context.Context, dir string) ([]*libkv.KVPair, error) {
+    kvs, _, err := s.list(ctx, dir)
+    return kvs, err
+}
+
+// list returns the pairs under dir along with the revision of the store.
+func (s *etcdv3Impl) list(ctx context.Context, dir string) ([]*libkv.KVPair, int64, error) {
     resp, err := s.client.Get(ctx, dir, v3.WithPrefix())
     if err != nil {
-        return nil, err
+        return nil, 0, convertError(err)
     }
+    return pairs(resp.Kvs), resp.Header.Revision, nil
+}
+
+// listWithin lists dir for a watch, bounded by the timeout where ctx bounds
+// the watch itself.
+func (s *etcdv3Impl) listWithin(ctx context.Context, dir string) ([]*libkv.KVPair, int64, error) {
+    ctx, cancel := context.WithTimeout(ctx, s.timeout)
+    defer cancel()
+    return s.list(ctx, dir)
+}
 
-    kvs := make([]*libkv.KVPair, 0, len(resp.Kvs))
-    for _, kv := range resp.Kvs {
-        kvs = append(kvs, &libkv.KVPair{
+func pairs(kvs []*mvccpb.KeyValue) []*libkv.KVPair {
+    result := make([]*libkv.KVPair, 0, len(kvs))
+    for _, kv := range kvs {
+        result = append(result, &libkv.KVPair{
             Key:       string(kv.Key),
             Value:     kv.Value,
-            LastIndex: uint64(kv.Version),
+            LastIndex: uint64(kv.ModRevision),
         })
     }
-    return kvs, nil
+    return result
 }
 
 func (s *etcdv3Impl) DeleteTree(dir string) error {
-    ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+    ctx, cancel := s.withTimeout()
     defer cancel()
+    return s.DeleteTreeContext(ctx, dir)
+}
+
+func (s *etcdv3Impl) DeleteTreeContext(ctx context.Context, dir string) error {
     _, err := s.client.Delete(ctx, dir, v3.WithPrefix())
-    return err
+    return convertError(err)
 }
 
 func (s *etcdv3Impl) AtomicPut(key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
-    panic("implement me")
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.AtomicPutContext(ctx, key, value, previous, options)
+}
+
+func (s *etcdv3Impl) AtomicPutContext(ctx context.Context, key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    lease, err := s.grant(ctx, options)
+    if err != nil {
+        return false, nil, err
+    }
+    var cmp v3.Cmp
+    if previous == nil {
+        // create only, the key must not exist yet
+        cmp = v3.Compare(v3.CreateRevision(key), "=", 0)
+    } else {
+        cmp = v3.Compare(v3.ModRevision(key), "=", int64(previous.LastIndex))
+    }
+    resp, err := s.client.Txn(ctx).
+        If(cmp).
+        Then(v3.OpPut(key, string(value), leaseOptions(lease)...)).
+        Commit()
+    if err != nil {
+        s.revoke(lease)
+        return false, nil, convertError(err)
+    }
+    if !resp.Succeeded {
+        s.revoke(lease)
+        if previous == nil {
+            return false, nil, common.ErrKeyExists
+        }
+        return false, nil, common.ErrKeyModified
+    }
+    s.keepAlive(lease, options)
+    return true, &libkv.KVPair{
+        Key:       key,
+        Value:     value,
+        LastIndex: uint64(resp.Header.Revision),
+    }, nil
 }
 
 func (s *etcdv3Impl) AtomicDelete(key string, previous *libkv.KVPair) (bool, error) {
-    panic("implement me")
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.AtomicDeleteContext(ctx, key, previous)
+}
+
+func (s *etcdv3Impl) AtomicDeleteContext(ctx context.Context, key string, previous *libkv.KVPair) (bool, error) {
+    if previous == nil {
+        return false, common.ErrPreviousNotSpecified
+    }
+    resp, err := s.client.Txn(ctx).
+        If(v3.Compare(v3.ModRevision(key), "=", int64(previous.LastIndex))).
+        Then(v3.OpDelete(key)).
+        Else(v3.OpGet(key)).
+        Commit()
+    if err != nil {
+        return false, convertError(err)
+    }
+    if !resp.Succeeded {
+        if len(resp.Responses) > 0 && len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+            return false, common.ErrKeyNotFound
+        }
+        return false, common.ErrKeyModified
+    }
+    return true, nil
 }
 
 func (s *etcdv3Impl) Close() {
-    s.client.Close()
-    close(s.done)
+    s.closed.Do(func() {
+        s.client.Close()
+        close(s.done)
+    })
+}
+
+// convertError maps etcd client errors onto the common errors.
+func convertError(err error) error {
+    if err == nil {
+        return nil
+    }
+    if status.Code(err) == codes.Unavailable {
+        return fmt.Errorf("%w: %v", common.ErrUnreachable, err)
+    }
+    if err == rpctypes.ErrCompacted {
+        return common.ErrCompacted
+    }
+    return err
 }
@@ -0,0 +1,359 @@
+package etcdv3
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/stretchr/testify/assert"
+    v3 "go.etcd.io/etcd/clientv3"
+    "go.etcd.io/etcd/embed"
+    "go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+    "go.etcd.io/etcd/mvcc/mvccpb"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "net"
+    "net/url"
+    "testing"
+    "time"
+)
+
+func freeURL(t *testing.T) url.URL {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// newTestStorage starts an embedded etcd server, stopped along with the test.
+// startServer runs an embedded etcd server on free ports until the test
+// ends, returning its client endpoint.
+func startServer(t *testing.T) (*embed.Etcd, string) {
+    cfg := embed.NewConfig()
+    cfg.Dir = t.TempDir()
+    cfg.Logger = "zap"
+    cfg.LogLevel = "error"
+    client, peer := freeURL(t), freeURL(t)
+    cfg.LCUrls, cfg.ACUrls = []url.URL{client}, []url.URL{client}
+    cfg.LPUrls, cfg.APUrls = []url.URL{peer}, []url.URL{peer}
+    cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+    e, err := embed.StartEtcd(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(e.Close)
+    select {
+    case <-e.Server.ReadyNotify():
+    case <-time.After(10 * time.Second):
+        t.Fatal("etcd server not ready")
+    }
+    return e, client.Host
+}
+
+func newTestStorage(t *testing.T) *etcdv3Impl {
+    _, endpoint := startServer(t)
+    kv, err := New([]string{endpoint}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(kv.Close)
+    return kv.(*etcdv3Impl)
+}
+
+func receiveEvents(t *testing.T, ch <-chan *libkv.WatchEvent, n int) []string {
+    var events []string
+    for i := 0; i < n; i++ {
+        select {
+        case event := <-ch:
+            s := event.Op.String() + " " + event.Key
+            if event.Pair != nil {
+                s += " " + string(event.Pair.Value)
+            }
+            if event.Previous != nil {
+                s += " (" + string(event.Previous.Value) + ")"
+            }
+            events = append(events, s)
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for events")
+        }
+    }
+    return events
+}
+
+func TestConvertError(t *testing.T) {
+    other := errors.New("other")
+    for _, tc := range []struct {
+        err  error
+        want error
+    }{
+        {nil, nil},
+        {status.Error(codes.Unavailable, "connection refused"), common.ErrUnreachable},
+        {rpctypes.ErrCompacted, common.ErrCompacted},
+        {other, other},
+    } {
+        got := convertError(tc.err)
+        if tc.want == nil {
+            assert.Nil(t, got)
+            continue
+        }
+        assert.True(t, errors.Is(got, tc.want), "%v: got %v", tc.err, got)
+    }
+}
+
+func TestNewEvent(t *testing.T) {
+    kv := &mvccpb.KeyValue{Key: []byte("/k"), Value: []byte("v2"), ModRevision: 5}
+    prev := &mvccpb.KeyValue{Key: []byte("/k"), Value: []byte("v1"), ModRevision: 3}
+    for _, tc := range []struct {
+        ev   *v3.Event
+        want *libkv.WatchEvent
+    }{
+        {
+            &v3.Event{Type: v3.EventTypePut, Kv: kv},
+            &libkv.WatchEvent{Op: libkv.WatchPut, Key: "/k", Revision: 5,
+                Pair: &libkv.KVPair{Key: "/k", Value: []byte("v2"), LastIndex: 5}},
+        },
+        {
+            &v3.Event{Type: v3.EventTypePut, Kv: kv, PrevKv: prev},
+            &libkv.WatchEvent{Op: libkv.WatchPut, Key: "/k", Revision: 5,
+                Pair:     &libkv.KVPair{Key: "/k", Value: []byte("v2"), LastIndex: 5},
+                Previous: &libkv.KVPair{Key: "/k", Value: []byte("v1"), LastIndex: 3}},
+        },
+        {
+            &v3.Event{Type: v3.EventTypeDelete, Kv: &mvccpb.KeyValue{Key: []byte("/k"), ModRevision: 6}, PrevKv: prev},
+            &libkv.WatchEvent{Op: libkv.WatchDelete, Key: "/k", Revision: 6,
+                Previous: &libkv.KVPair{Key: "/k", Value: []byte("v1"), LastIndex: 3}},
+        },
+    } {
+        assert.Equal(t, tc.want, newEvent(tc.ev))
+    }
+}
+
+func TestNew(t *testing.T) {
+    kv := newTestStorage(t)
+    _, err := kv.Get("/test_dir/node1")
+    assert.Equal(t, common.ErrKeyNotFound, err)
+
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+    list, err := kv.List("/test_dir/")
+    assert.Nil(t, err)
+    assert.Len(t, list, 2)
+    assert.True(t, list[1].LastIndex > list[0].LastIndex)
+
+    ok, _, err := kv.AtomicPut("/test_dir/node1", []byte("value3"), list[1], nil)
+    assert.False(t, ok)
+    assert.Equal(t, common.ErrKeyModified, err)
+    ok, pair, err := kv.AtomicPut("/test_dir/node1", []byte("value3"), list[0], nil)
+    assert.True(t, ok)
+    assert.Nil(t, err)
+    ok, err = kv.AtomicDelete("/test_dir/node1", pair)
+    assert.True(t, ok)
+    assert.Nil(t, err)
+
+    assert.Nil(t, kv.DeleteTree("/test_dir/"))
+    exists, err := kv.Exists("/test_dir/node2")
+    assert.Nil(t, err)
+    assert.False(t, exists)
+
+    // closing twice is harmless
+    kv.Close()
+    kv.Close()
+}
+
+func TestWatchUnreachable(t *testing.T) {
+    e, endpoint := startServer(t)
+    opt := libkv.DefaultConfig()
+    opt.ConnectionTimeout = time.Millisecond * 500
+    kv, err := New([]string{endpoint}, opt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer kv.Close()
+    e.Close()
+
+    // the initial reads give up after the timeout
+    watches := map[string]func() error{
+        "Watch": func() error {
+            _, err := kv.Watch("/test_dir/node1", nil)
+            return err
+        },
+        "WatchMulti": func() error {
+            _, err := kv.WatchMulti(nil, "/test_dir/node1", "/test_dir/node2")
+            return err
+        },
+        "WatchTree": func() error {
+            _, err := kv.WatchTree("/test_dir/", nil)
+            return err
+        },
+    }
+    for name, watch := range watches {
+        errCh := make(chan error, 1)
+        go func() { errCh <- watch() }()
+        select {
+        case err := <-errCh:
+            assert.NotNil(t, err, name)
+        case <-time.After(time.Second * 5):
+            t.Fatalf("%s hangs on an unreachable cluster", name)
+        }
+    }
+}
+
+func TestTTL(t *testing.T) {
+    kv := newTestStorage(t)
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), &libkv.WriteOptions{TTL: time.Second}))
+    keepAlive := make(chan struct{})
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), &libkv.WriteOptions{TTL: time.Second, KeepAlive: keepAlive}))
+
+    time.Sleep(3 * time.Second)
+    _, err := kv.Get("/test_dir/node1")
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    _, err = kv.Get("/test_dir/node2")
+    assert.Nil(t, err)
+
+    // the lease is revoked once the keep alive stops
+    close(keepAlive)
+    deadline := time.Now().Add(time.Second)
+    for {
+        if _, err = kv.Get("/test_dir/node2"); err == common.ErrKeyNotFound || time.Now().After(deadline) {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    assert.Equal(t, common.ErrKeyNotFound, err)
+}
+
+func TestWatchTreeDeltas(t *testing.T) {
+    kv := newTestStorage(t)
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.WatchTreeDeltas("/test_dir/", stopCh)
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node3", []byte("value3"), nil))
+    assert.Nil(t, kv.Delete("/test_dir/node1"))
+
+    tree := libkv.NewTree()
+    tree.Apply(<-ch)
+    assert.Len(t, tree.List(), 2)
+    assert.Equal(t, []string{
+        "put /test_dir/node3 value3",
+        "delete /test_dir/node1 (value1)",
+    }, receiveEvents(t, ch, 2))
+}
+
+func TestWatchResume(t *testing.T) {
+    kv := newTestStorage(t)
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    pair, err := kv.Get("/test_dir/node1")
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+    assert.Nil(t, kv.Delete("/test_dir/node1"))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    options := &libkv.WatchOptions{Revision: pair.LastIndex}
+    ch, err := kv.WatchTreeEvents("/test_dir/", stopCh, options)
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node3", []byte("value3"), nil))
+    assert.Equal(t, []string{
+        "put /test_dir/node2 value2",
+        "delete /test_dir/node1 (value1)",
+        "put /test_dir/node3 value3",
+    }, receiveEvents(t, ch, 3))
+
+    last, err := kv.Get("/test_dir/node3")
+    assert.Nil(t, err)
+    _, err = kv.client.Compact(context.Background(), int64(last.LastIndex))
+    assert.Nil(t, err)
+    _, err = kv.WatchTreeEvents("/test_dir/", stopCh, options)
+    assert.Equal(t, common.ErrCompacted, err)
+}
+
+func TestWatchOverflow(t *testing.T) {
+    kv := newTestStorage(t)
+    key := "/test_dir/node1"
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    errCh := make(chan error, 1)
+    ch, err := kv.WatchEvents(stopCh, &libkv.WatchOptions{Buffer: 1, Overflow: libkv.WatchDrop, Errors: errCh}, key)
+    assert.Nil(t, err)
+    for i := 1; i <= 3; i++ {
+        assert.Nil(t, kv.Put(key, []byte(fmt.Sprintf("value%d", i)), nil))
+    }
+    select {
+    case err = <-errCh:
+        assert.Equal(t, common.ErrWatchOverflow, err)
+    case <-time.After(time.Second):
+        t.Fatal("timeout waiting for overflow")
+    }
+    assert.Equal(t, []string{"put /test_dir/node1 value1"}, receiveEvents(t, ch, 1))
+}
+
+func TestTxn(t *testing.T) {
+    kv := newTestStorage(t)
+    blob, version := "/test_dir/blob", "/test_dir/version"
+    assert.Nil(t, kv.Put(blob, []byte("value1"), nil))
+    pair, err := kv.Get(blob)
+    assert.Nil(t, err)
+
+    txn := &libkv.Txn{
+        Compare: []libkv.Compare{libkv.RevisionEquals(blob, pair.LastIndex), libkv.KeyExists(version, false)},
+        Then:    []libkv.TxnOp{libkv.OpPut(version, []byte("2"), nil), libkv.OpGet(blob)},
+        Else:    []libkv.TxnOp{libkv.OpGet(version)},
+    }
+    result, err := kv.Txn(txn)
+    assert.Nil(t, err)
+    assert.True(t, result.Succeeded)
+    assert.Len(t, result.Pairs, 2)
+    assert.Equal(t, "value1", string(result.Pairs[1].Value))
+
+    result, err = kv.Txn(txn)
+    assert.Nil(t, err)
+    assert.False(t, result.Succeeded)
+    assert.Equal(t, "2", string(result.Pairs[0].Value))
+}
+
+func TestLock(t *testing.T) {
+    kv := newTestStorage(t)
+    l1, err := kv.NewLock("/test_lock", &libkv.LockOptions{Value: []byte("owner")})
+    assert.Nil(t, err)
+    l2, err := kv.NewLock("/test_lock", nil)
+    assert.Nil(t, err)
+
+    lost, err := l1.Lock(nil)
+    assert.Nil(t, err)
+    // locking again replaces the earlier session
+    again, err := l1.Lock(nil)
+    assert.Nil(t, err)
+    select {
+    case <-lost:
+    case <-time.After(time.Second):
+        t.Fatal("earlier session not closed")
+    }
+
+    stopCh := make(chan struct{})
+    go func() {
+        time.Sleep(100 * time.Millisecond)
+        close(stopCh)
+    }()
+    ch, err := l2.Lock(stopCh)
+    assert.Nil(t, err)
+    assert.Nil(t, ch)
+
+    assert.Nil(t, l1.Unlock())
+    select {
+    case <-again:
+    case <-time.After(time.Second):
+        t.Fatal("lock channel not closed on unlock")
+    }
+    assert.Equal(t, common.ErrLockNotHeld, l1.Unlock())
+    ch, err = l2.Lock(nil)
+    assert.Nil(t, err)
+    assert.NotNil(t, ch)
+    assert.Nil(t, l2.Unlock())
+}
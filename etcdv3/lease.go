@@ -0,0 +1,65 @@
+package etcdv3
+
+import (
+    "context"
+    "github.com/DGHeroin/libkv"
+    v3 "go.etcd.io/etcd/clientv3"
+    "time"
+)
+
+// grant returns a lease for the TTL of options, or v3.NoLease without TTL.
+func (s *etcdv3Impl) grant(ctx context.Context, options *libkv.WriteOptions) (v3.LeaseID, error) {
+    if options == nil || options.TTL <= 0 {
+        return v3.NoLease, nil
+    }
+    ttl := int64((options.TTL + time.Second - 1) / time.Second)
+    resp, err := s.client.Grant(ctx, ttl)
+    if err != nil {
+        return v3.NoLease, convertError(err)
+    }
+    return resp.ID, nil
+}
+
+func (s *etcdv3Impl) revoke(lease v3.LeaseID) {
+    if lease == v3.NoLease {
+        return
+    }
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    _, _ = s.client.Revoke(ctx, lease)
+}
+
+// keepAlive renews lease until options.KeepAlive is closed, then revokes it
+// so that the keys attached to it are removed right away.
+func (s *etcdv3Impl) keepAlive(lease v3.LeaseID, options *libkv.WriteOptions) {
+    if lease == v3.NoLease || options.KeepAlive == nil {
+        return
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    ch, err := s.client.KeepAlive(ctx, lease)
+    if err != nil {
+        cancel()
+        return
+    }
+    go func() {
+        defer cancel()
+        for {
+            select {
+            case _, ok := <-ch:
+                if !ok {
+                    return
+                }
+            case <-options.KeepAlive:
+                s.revoke(lease)
+                return
+            }
+        }
+    }()
+}
+
+func leaseOptions(lease v3.LeaseID) []v3.OpOption {
+    if lease == v3.NoLease {
+        return nil
+    }
+    return []v3.OpOption{v3.WithLease(lease)}
+}
@@ -0,0 +1,145 @@
+package etcdv3
+
+import (
+    "context"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    v3 "go.etcd.io/etcd/clientv3"
+    "go.etcd.io/etcd/clientv3/concurrency"
+    "sync"
+    "time"
+)
+
+const defaultLockTTL = 20 * time.Second
+
+type etcdLock struct {
+    client  *v3.Client
+    key     string
+    value   []byte
+    ttl     time.Duration
+    renewCh chan struct{}
+    timeout time.Duration
+
+    mu      sync.Mutex
+    session *concurrency.Session
+    mutex   *concurrency.Mutex
+    done    chan struct{}
+}
+
+func (s *etcdv3Impl) newLock(key string, options *libkv.LockOptions) *etcdLock {
+    l := &etcdLock{
+        client:  s.client,
+        key:     key,
+        ttl:     defaultLockTTL,
+        timeout: s.timeout,
+    }
+    if options != nil {
+        l.value = options.Value
+        l.renewCh = options.RenewLock
+        if options.TTL > 0 {
+            l.ttl = options.TTL
+        }
+    }
+    return l
+}
+
+func (l *etcdLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.session != nil {
+        // locking again drops the session held so far, and the lock with
+        // its lease
+        l.release()
+    }
+
+    ttl := int(l.ttl / time.Second)
+    if ttl < 1 {
+        ttl = 1
+    }
+    session, err := concurrency.NewSession(l.client, concurrency.WithTTL(ttl))
+    if err != nil {
+        return nil, convertError(err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    go func() {
+        select {
+        case <-stopChan:
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+    mutex := concurrency.NewMutex(session, l.key)
+    err = mutex.Lock(ctx)
+    aborted := ctx.Err() != nil
+    cancel()
+    if err != nil {
+        _ = session.Close()
+        if aborted {
+            return nil, nil
+        }
+        return nil, convertError(err)
+    }
+
+    if len(l.value) > 0 {
+        ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+        resp, err := l.client.Txn(ctx).
+            If(mutex.IsOwner()).
+            Then(v3.OpPut(mutex.Key(), string(l.value), v3.WithLease(session.Lease()))).
+            Commit()
+        cancel()
+        if err == nil && !resp.Succeeded {
+            err = common.ErrLockLost
+        }
+        if err != nil {
+            _ = session.Close()
+            return nil, convertError(err)
+        }
+    }
+
+    l.session = session
+    l.mutex = mutex
+    l.done = make(chan struct{})
+    lostCh := make(chan struct{})
+    go l.holdLock(session, l.done, lostCh)
+    return lostCh, nil
+}
+
+// holdLock closes lostCh once the session lease is gone. Closing RenewLock
+// stops the keep alive, the lock then lasts until its ttl runs out.
+func (l *etcdLock) holdLock(session *concurrency.Session, done, lostCh chan struct{}) {
+    defer close(lostCh)
+    select {
+    case <-session.Done():
+        return
+    case <-done:
+        return
+    case <-l.renewCh:
+    }
+    session.Orphan()
+    select {
+    case <-time.After(l.ttl):
+    case <-done:
+    }
+}
+
+func (l *etcdLock) Unlock() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.mutex == nil {
+        return common.ErrLockNotHeld
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+    defer cancel()
+    err := l.mutex.Unlock(ctx)
+    l.release()
+    return convertError(err)
+}
+
+// release closes the session held. The caller holds l.mu.
+func (l *etcdLock) release() {
+    _ = l.session.Close()
+    close(l.done)
+    l.session = nil
+    l.mutex = nil
+}
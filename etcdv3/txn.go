@@ -0,0 +1,112 @@
+package etcdv3
+
+import (
+    "context"
+    "github.com/DGHeroin/libkv"
+    v3 "go.etcd.io/etcd/clientv3"
+)
+
+var _ libkv.Transactor = (*etcdv3Impl)(nil)
+
+func (s *etcdv3Impl) Txn(txn *libkv.Txn) (*libkv.TxnResult, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.TxnContext(ctx, txn)
+}
+
+// TxnContext maps txn onto an etcd transaction, which refuses to put the
+// same key twice. The leases of the puts are granted beforehand, the ones
+// of the branch left out are revoked.
+func (s *etcdv3Impl) TxnContext(ctx context.Context, txn *libkv.Txn) (*libkv.TxnResult, error) {
+    var cmps []v3.Cmp
+    for _, c := range txn.Compare {
+        switch c.Target {
+        case libkv.CompareValue:
+            cmps = append(cmps, v3.Compare(v3.Value(c.Key), "=", string(c.Value)))
+        case libkv.CompareRevision:
+            cmps = append(cmps,
+                v3.Compare(v3.CreateRevision(c.Key), ">", 0),
+                v3.Compare(v3.ModRevision(c.Key), "=", int64(c.Revision)))
+        case libkv.CompareExists:
+            if c.Exists {
+                cmps = append(cmps, v3.Compare(v3.CreateRevision(c.Key), ">", 0))
+            } else {
+                cmps = append(cmps, v3.Compare(v3.CreateRevision(c.Key), "=", 0))
+            }
+        }
+    }
+    thenOps, thenLeases, err := s.txnOps(ctx, txn.Then)
+    if err != nil {
+        return nil, err
+    }
+    elseOps, elseLeases, err := s.txnOps(ctx, txn.Else)
+    if err != nil {
+        s.revokeAll(thenLeases)
+        return nil, err
+    }
+    resp, err := s.client.Txn(ctx).If(cmps...).Then(thenOps...).Else(elseOps...).Commit()
+    if err != nil {
+        s.revokeAll(thenLeases)
+        s.revokeAll(elseLeases)
+        return nil, convertError(err)
+    }
+    ops, leases := txn.Then, thenLeases
+    if resp.Succeeded {
+        s.revokeAll(elseLeases)
+    } else {
+        s.revokeAll(thenLeases)
+        ops, leases = txn.Else, elseLeases
+    }
+    result := &libkv.TxnResult{Succeeded: resp.Succeeded}
+    for i, op := range ops {
+        switch op.Type {
+        case libkv.TxnPut:
+            s.keepAlive(leases[i], op.Options)
+            result.Pairs = append(result.Pairs, &libkv.KVPair{
+                Key:       op.Key,
+                Value:     op.Value,
+                LastIndex: uint64(resp.Header.Revision),
+            })
+        case libkv.TxnDelete:
+            result.Pairs = append(result.Pairs, nil)
+        default:
+            var pair *libkv.KVPair
+            if kvs := resp.Responses[i].GetResponseRange().Kvs; len(kvs) > 0 {
+                pair = pairs(kvs)[0]
+            }
+            result.Pairs = append(result.Pairs, pair)
+        }
+    }
+    return result, nil
+}
+
+// txnOps returns the etcd operations of ops, with the lease of each put.
+func (s *etcdv3Impl) txnOps(ctx context.Context, ops []libkv.TxnOp) ([]v3.Op, []v3.LeaseID, error) {
+    var (
+        result = make([]v3.Op, 0, len(ops))
+        leases = make([]v3.LeaseID, len(ops))
+    )
+    for i, op := range ops {
+        switch op.Type {
+        case libkv.TxnPut:
+            lease, err := s.grant(ctx, op.Options)
+            if err != nil {
+                s.revokeAll(leases)
+                return nil, nil, err
+            }
+            leases[i] = lease
+            result = append(result, v3.OpPut(op.Key, string(op.Value), leaseOptions(lease)...))
+        case libkv.TxnDelete:
+            result = append(result, v3.OpDelete(op.Key))
+        default:
+            result = append(result, v3.OpGet(op.Key))
+        }
+    }
+    return result, leases, nil
+}
+
+func (s *etcdv3Impl) revokeAll(leases []v3.LeaseID) {
+    for _, lease := range leases {
+        s.revoke(lease)
+    }
+}
@@ -0,0 +1,379 @@
+package file
+
+import (
+    "context"
+    "errors"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// tmpPrefix starts the names of the files being written, they are never
+// taken for keys.
+const tmpPrefix = ".libkv-tmp-"
+
+func init() {
+    libkv.AddStorage("file", New)
+}
+func New(endpoints []string, opt *libkv.Config) (libkv.Storage, error) {
+    if len(endpoints) == 0 {
+        return nil, errors.New("file root directory unspecified")
+    }
+    root, err := filepath.Abs(endpoints[0])
+    if err != nil {
+        return nil, err
+    }
+    if err = os.MkdirAll(root, 0755); err != nil {
+        return nil, err
+    }
+    return &fileImpl{
+        root: root,
+        done: make(chan struct{}),
+    }, nil
+}
+
+var _ libkv.StorageContext = (*fileImpl)(nil)
+var _ libkv.EventWatcher = (*fileImpl)(nil)
+
+// Each key is a file below root, "/a/b" being root/a/b. The LastIndex of a
+// key is the modification time of its file in nanoseconds, which writes
+// keep increasing.
+type fileImpl struct {
+    root   string
+    mu     sync.Mutex // serializes writes, so atomic operations hold
+    done   chan struct{}
+    closed sync.Once
+}
+
+// filename returns the file of key, which can't escape root.
+func (s *fileImpl) filename(key string) string {
+    return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func modified(fi os.FileInfo) uint64 {
+    return uint64(fi.ModTime().UnixNano())
+}
+
+// stat returns the file info of key, nil when the key is missing.
+func (s *fileImpl) stat(key string) (os.FileInfo, error) {
+    fi, err := os.Stat(s.filename(key))
+    if os.IsNotExist(err) || (err == nil && fi.IsDir()) {
+        return nil, nil
+    }
+    return fi, err
+}
+
+// write replaces the file of key through a temporary file renamed over it,
+// so readers see the old or the new value. The caller holds s.mu.
+func (s *fileImpl) write(key string, value []byte, options *libkv.WriteOptions) (*libkv.KVPair, error) {
+    if options != nil && options.TTL > 0 {
+        return nil, common.ErrTTLUnsupported
+    }
+    name := s.filename(key)
+    if name == s.root {
+        return nil, errors.New("file key unspecified")
+    }
+    prev, err := s.stat(key)
+    if err != nil {
+        return nil, err
+    }
+    dir := filepath.Dir(name)
+    if err = os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    tmp, err := ioutil.TempFile(dir, tmpPrefix)
+    if err != nil {
+        return nil, err
+    }
+    defer os.Remove(tmp.Name())
+    _, err = tmp.Write(value)
+    if err == nil {
+        err = tmp.Sync()
+    }
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err = os.Chmod(tmp.Name(), 0644); err != nil {
+        return nil, err
+    }
+    fi, err := os.Stat(tmp.Name())
+    if err != nil {
+        return nil, err
+    }
+    if prev != nil && !fi.ModTime().After(prev.ModTime()) {
+        // keep the index increasing on coarse clocks
+        mtime := prev.ModTime().Add(time.Nanosecond)
+        if err = os.Chtimes(tmp.Name(), mtime, mtime); err != nil {
+            return nil, err
+        }
+        if fi, err = os.Stat(tmp.Name()); err != nil {
+            return nil, err
+        }
+    }
+    if err = os.Rename(tmp.Name(), name); err != nil {
+        return nil, err
+    }
+    return &libkv.KVPair{Key: key, Value: value, LastIndex: modified(fi)}, nil
+}
+
+func (s *fileImpl) Put(key string, value []byte, options *libkv.WriteOptions) error {
+    return s.PutContext(context.Background(), key, value, options)
+}
+
+func (s *fileImpl) PutContext(ctx context.Context, key string, value []byte, options *libkv.WriteOptions) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    _, err := s.write(key, value, options)
+    return err
+}
+
+func (s *fileImpl) Get(key string) (*libkv.KVPair, error) {
+    return s.GetContext(context.Background(), key)
+}
+
+func (s *fileImpl) GetContext(ctx context.Context, key string) (*libkv.KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return s.read(key, s.filename(key))
+}
+
+// read reads the file name of key, the value and its index coming from the
+// same file even when it is replaced meanwhile.
+func (s *fileImpl) read(key, name string) (*libkv.KVPair, error) {
+    f, err := os.Open(name)
+    if os.IsNotExist(err) {
+        return nil, common.ErrKeyNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    if fi.IsDir() {
+        return nil, common.ErrKeyNotFound
+    }
+    value, err := ioutil.ReadAll(f)
+    if err != nil {
+        return nil, err
+    }
+    return &libkv.KVPair{Key: key, Value: value, LastIndex: modified(fi)}, nil
+}
+
+func (s *fileImpl) Delete(key string) error {
+    return s.DeleteContext(context.Background(), key)
+}
+
+func (s *fileImpl) DeleteContext(ctx context.Context, key string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    fi, err := s.stat(key)
+    if err != nil || fi == nil {
+        return err
+    }
+    return os.Remove(s.filename(key))
+}
+
+func (s *fileImpl) Exists(key string) (bool, error) {
+    return s.ExistsContext(context.Background(), key)
+}
+
+func (s *fileImpl) ExistsContext(ctx context.Context, key string) (bool, error) {
+    if err := ctx.Err(); err != nil {
+        return false, err
+    }
+    fi, err := s.stat(key)
+    return fi != nil, err
+}
+
+func (s *fileImpl) Watch(key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchContext(context.Background(), key, stopCh)
+}
+
+func (s *fileImpl) WatchContext(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(ctx, stopCh, key)
+}
+
+func (s *fileImpl) WatchMulti(stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(context.Background(), stopCh, keys...)
+}
+
+func (s *fileImpl) WatchTree(dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    return s.WatchTreeContext(context.Background(), dir, stopCh)
+}
+
+func (s *fileImpl) WatchEvents(stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchEventsContext(context.Background(), stopCh, options, keys...)
+}
+
+func (s *fileImpl) WatchTreeEvents(dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeEventsContext(context.Background(), dir, stopCh, options)
+}
+
+func (s *fileImpl) WatchTreeDeltas(dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeDeltasContext(context.Background(), dir, stopCh)
+}
+
+func (s *fileImpl) NewLock(key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    return s.NewLockContext(context.Background(), key, options)
+}
+
+func (s *fileImpl) NewLockContext(ctx context.Context, key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    return nil, common.ErrAPINotSupported
+}
+
+func (s *fileImpl) List(dir string) ([]*libkv.KVPair, error) {
+    return s.ListContext(context.Background(), dir)
+}
+
+// ListContext walks the directory of dir, the keys returned being spelled
+// after dir.
+func (s *fileImpl) ListContext(ctx context.Context, dir string) ([]*libkv.KVPair, error) {
+    var (
+        top  = s.filename(dir)
+        lead = strings.TrimSuffix(dir, "/")
+        kvs  = make([]*libkv.KVPair, 0)
+    )
+    err := filepath.Walk(top, func(name string, fi os.FileInfo, err error) error {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if err = ctx.Err(); err != nil {
+            return err
+        }
+        if fi.IsDir() || strings.HasPrefix(fi.Name(), tmpPrefix) {
+            return nil
+        }
+        rel, err := filepath.Rel(top, name)
+        if err != nil {
+            return err
+        }
+        key := dir
+        if rel != "." {
+            key = lead + "/" + filepath.ToSlash(rel)
+            if lead == "" && !strings.HasPrefix(dir, "/") {
+                key = filepath.ToSlash(rel)
+            }
+        }
+        pair, err := s.read(key, name)
+        if err == common.ErrKeyNotFound {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        kvs = append(kvs, pair)
+        return nil
+    })
+    return kvs, err
+}
+
+func (s *fileImpl) DeleteTree(dir string) error {
+    return s.DeleteTreeContext(context.Background(), dir)
+}
+
+func (s *fileImpl) DeleteTreeContext(ctx context.Context, dir string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    top := s.filename(dir)
+    if top != s.root {
+        return os.RemoveAll(top)
+    }
+    names, err := ioutil.ReadDir(top)
+    if err != nil {
+        return err
+    }
+    for _, fi := range names {
+        if err = os.RemoveAll(filepath.Join(top, fi.Name())); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *fileImpl) AtomicPut(key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    return s.AtomicPutContext(context.Background(), key, value, previous, options)
+}
+
+func (s *fileImpl) AtomicPutContext(ctx context.Context, key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return false, nil, err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    fi, err := s.stat(key)
+    switch {
+    case err != nil:
+        return false, nil, err
+    case fi == nil && previous != nil:
+        return false, nil, common.ErrKeyModified
+    case fi != nil && previous == nil:
+        return false, nil, common.ErrKeyExists
+    case fi != nil && modified(fi) != previous.LastIndex:
+        return false, nil, common.ErrKeyModified
+    }
+    pair, err := s.write(key, value, options)
+    if err != nil {
+        return false, nil, err
+    }
+    return true, pair, nil
+}
+
+func (s *fileImpl) AtomicDelete(key string, previous *libkv.KVPair) (bool, error) {
+    return s.AtomicDeleteContext(context.Background(), key, previous)
+}
+
+func (s *fileImpl) AtomicDeleteContext(ctx context.Context, key string, previous *libkv.KVPair) (bool, error) {
+    if err := ctx.Err(); err != nil {
+        return false, err
+    }
+    if previous == nil {
+        return false, common.ErrPreviousNotSpecified
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    fi, err := s.stat(key)
+    if err != nil {
+        return false, err
+    }
+    if fi == nil {
+        return false, common.ErrKeyNotFound
+    }
+    if modified(fi) != previous.LastIndex {
+        return false, common.ErrKeyModified
+    }
+    if err = os.Remove(s.filename(key)); err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+func (s *fileImpl) Close() {
+    s.closed.Do(func() {
+        close(s.done)
+    })
+}
@@ -0,0 +1,178 @@
+package file
+
+import (
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/stretchr/testify/assert"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func newTestStorage(t *testing.T) (libkv.Storage, string) {
+    root := t.TempDir()
+    kv, err := New([]string{root}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return kv, root
+}
+
+func TestNew(t *testing.T) {
+    kv, root := newTestStorage(t)
+    defer kv.Close()
+
+    _, err := kv.Get("/test_dir/node1")
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    assert.Equal(t, common.ErrTTLUnsupported, kv.Put("/test_dir/node1", []byte("v"), &libkv.WriteOptions{TTL: time.Second}))
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/sub/node2", []byte("value2"), nil))
+    assert.Nil(t, kv.Put("/test_dir2/node1", []byte("other"), nil))
+
+    data, err := ioutil.ReadFile(filepath.Join(root, "test_dir", "node1"))
+    assert.Nil(t, err)
+    assert.Equal(t, "value1", string(data))
+    pair, err := kv.Get("/../test_dir/node1")
+    assert.Nil(t, err)
+    assert.Equal(t, "value1", string(pair.Value))
+
+    list, err := kv.List("/test_dir/")
+    assert.Nil(t, err)
+    assert.Len(t, list, 2)
+    assert.Equal(t, "/test_dir/node1", list[0].Key)
+    assert.Equal(t, "/test_dir/sub/node2", list[1].Key)
+
+    assert.Nil(t, kv.DeleteTree("/test_dir/"))
+    ok, err := kv.Exists("/test_dir/node1")
+    assert.Nil(t, err)
+    assert.False(t, ok)
+    assert.Nil(t, kv.Delete("/test_dir2/node1"))
+    assert.Nil(t, kv.Delete("/test_dir2/node1"))
+    names, err := ioutil.ReadDir(filepath.Join(root, "test_dir2"))
+    assert.Nil(t, err)
+    assert.Len(t, names, 0)
+
+    // closing again stops nothing more
+    kv.Close()
+    kv.Close()
+}
+
+func TestAtomic(t *testing.T) {
+    kv, _ := newTestStorage(t)
+    defer kv.Close()
+    key := "/atomic/node"
+
+    ok, pair, err := kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    _, _, err = kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Equal(t, common.ErrKeyExists, err)
+
+    ok, next, err := kv.AtomicPut(key, []byte("v2"), pair, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    assert.True(t, next.LastIndex > pair.LastIndex)
+    _, _, err = kv.AtomicPut(key, []byte("v3"), pair, nil)
+    assert.Equal(t, common.ErrKeyModified, err)
+    _, err = kv.AtomicDelete(key, pair)
+    assert.Equal(t, common.ErrKeyModified, err)
+
+    ok, err = kv.AtomicDelete(key, next)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    _, err = kv.AtomicDelete(key, next)
+    assert.Equal(t, common.ErrKeyNotFound, err)
+}
+
+func TestWatch(t *testing.T) {
+    kv, root := newTestStorage(t)
+    defer kv.Close()
+    key := "/test_dir/node1"
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.Watch(key, stopCh)
+    assert.Nil(t, err)
+    treeCh, err := kv.WatchTree("/test_dir/", stopCh)
+    assert.Nil(t, err)
+    select {
+    case list := <-treeCh:
+        assert.Len(t, list, 0)
+    case <-time.After(time.Second):
+        t.Fatal("timeout waiting for tree watch")
+    }
+
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    // a file written in place may be seen truncated first
+    waitFor := func(want string) {
+        deadline := time.After(time.Second * 3)
+        for {
+            select {
+            case pair := <-ch:
+                if string(pair.Value) == want {
+                    return
+                }
+            case <-deadline:
+                t.Fatalf("timeout waiting for %q", want)
+            }
+        }
+    }
+    waitFor("value1")
+    assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "test_dir", "node1"), []byte("value2"), 0644))
+    waitFor("value2")
+    assert.Nil(t, os.Remove(filepath.Join(root, "test_dir", "node1")))
+    waitFor("")
+
+    deadline := time.After(time.Second * 3)
+    for {
+        select {
+        case list := <-treeCh:
+            if len(list) == 0 {
+                return
+            }
+        case <-deadline:
+            t.Fatal("timeout waiting for tree watch")
+        }
+    }
+}
+
+func TestWatchEvents(t *testing.T) {
+    kv, _ := newTestStorage(t)
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.(libkv.EventWatcher).WatchEvents(stopCh, nil, key)
+    assert.Nil(t, err)
+    treeCh, err := kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, nil)
+    assert.Nil(t, err)
+    next := func(ch <-chan *libkv.WatchEvent) *libkv.WatchEvent {
+        select {
+        case event := <-ch:
+            return event
+        case <-time.After(time.Second * 3):
+            t.Fatal("timeout waiting for events")
+        }
+        return nil
+    }
+
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    for _, ch := range []<-chan *libkv.WatchEvent{ch, treeCh} {
+        event := next(ch)
+        assert.Equal(t, libkv.WatchPut, event.Op)
+        assert.Equal(t, "value1", string(event.Pair.Value))
+        assert.Equal(t, "value0", string(event.Previous.Value))
+    }
+    assert.Nil(t, kv.Delete(key))
+    for _, ch := range []<-chan *libkv.WatchEvent{ch, treeCh} {
+        event := next(ch)
+        assert.Equal(t, libkv.WatchDelete, event.Op)
+        assert.Equal(t, key, event.Key)
+        assert.Nil(t, event.Pair)
+        assert.Equal(t, "value1", string(event.Previous.Value))
+    }
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package file
+
+import (
+    "os"
+    "syscall"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_DELETE_SELF | syscall.IN_MODIFY |
+    syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// notifier signals events when the directories added change, through
+// inotify.
+type notifier struct {
+    fd     int
+    f      *os.File
+    events chan struct{}
+}
+
+func newNotifier() (*notifier, error) {
+    fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+    if err != nil {
+        return nil, err
+    }
+    n := &notifier{
+        fd:     fd,
+        f:      os.NewFile(uintptr(fd), "inotify"),
+        events: make(chan struct{}, 1),
+    }
+    go n.read()
+    return n, nil
+}
+
+// add watches dirs, adding a directory twice is harmless.
+func (n *notifier) add(dirs []string) {
+    for _, dir := range dirs {
+        _, _ = syscall.InotifyAddWatch(n.fd, dir, watchMask)
+    }
+}
+
+// read coalesces the inotify events into events, as the watchers read the
+// state again anyway. The file being non blocking, close ends the read.
+func (n *notifier) read() {
+    buf := make([]byte, 4096)
+    for {
+        if _, err := n.f.Read(buf); err != nil {
+            return
+        }
+        select {
+        case n.events <- struct{}{}:
+        default:
+        }
+    }
+}
+
+func (n *notifier) close() {
+    _ = n.f.Close()
+}
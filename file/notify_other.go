@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package file
+
+import (
+    "errors"
+    "runtime"
+)
+
+// notifier is unavailable, the watchers poll.
+type notifier struct {
+    events chan struct{}
+}
+
+func newNotifier() (*notifier, error) {
+    return nil, errors.New("file: no change notification on " + runtime.GOOS)
+}
+
+func (n *notifier) add(dirs []string) {}
+
+func (n *notifier) close() {}
@@ -0,0 +1,276 @@
+package file
+
+import (
+    "context"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const (
+    pollInterval   = time.Second      // without change notifications
+    rescanInterval = 10 * time.Second // with them, in case some are missed
+)
+
+func (s *fileImpl) WatchMultiContext(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    stop := s.stopped(ctx, stopCh)
+    wake := s.notify(stop, s.keyDirs(keys))
+    watchCh := make(chan *libkv.KVPair)
+    go func() {
+        defer close(watchCh)
+        last := make(map[string]uint64)
+        for {
+            for _, key := range keys {
+                pair, err := s.GetContext(ctx, key)
+                switch {
+                case err == common.ErrKeyNotFound:
+                    if _, ok := last[key]; !ok {
+                        continue
+                    }
+                    delete(last, key)
+                    pair = &libkv.KVPair{Key: key}
+                case err != nil:
+                    continue
+                case last[key] == pair.LastIndex:
+                    continue
+                default:
+                    last[key] = pair.LastIndex
+                }
+                select {
+                case watchCh <- pair:
+                case <-stop:
+                    return
+                }
+            }
+            select {
+            case <-wake:
+            case <-stop:
+                return
+            }
+        }
+    }()
+    return watchCh, nil
+}
+
+func (s *fileImpl) WatchTreeContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    stop := s.stopped(ctx, stopCh)
+    wake := s.notify(stop, s.treeDirs(dir))
+    watchCh := make(chan []*libkv.KVPair)
+    go func() {
+        defer close(watchCh)
+        var last map[string]uint64
+        for {
+            list, err := s.ListContext(ctx, dir)
+            if err == nil && !sameList(last, list) {
+                last = make(map[string]uint64, len(list))
+                for _, pair := range list {
+                    last[pair.Key] = pair.LastIndex
+                }
+                select {
+                case watchCh <- list:
+                case <-stop:
+                    return
+                }
+            }
+            select {
+            case <-wake:
+            case <-stop:
+                return
+            }
+        }
+    }()
+    return watchCh, nil
+}
+
+func (s *fileImpl) WatchEventsContext(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    if options != nil && options.Revision != 0 {
+        return nil, common.ErrAPINotSupported
+    }
+    return s.watchEvents(ctx, stopCh, options, s.keyDirs(keys), func(ctx context.Context) ([]*libkv.KVPair, error) {
+        var pairs []*libkv.KVPair
+        for _, key := range keys {
+            pair, err := s.GetContext(ctx, key)
+            if err == common.ErrKeyNotFound {
+                continue
+            }
+            if err != nil {
+                return nil, err
+            }
+            pairs = append(pairs, pair)
+        }
+        return pairs, nil
+    }, nil)
+}
+
+func (s *fileImpl) WatchTreeEventsContext(ctx context.Context, dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    if options != nil && options.Revision != 0 {
+        return nil, common.ErrAPINotSupported
+    }
+    return s.watchEvents(ctx, stopCh, options, s.treeDirs(dir), func(ctx context.Context) ([]*libkv.KVPair, error) {
+        return s.ListContext(ctx, dir)
+    }, nil)
+}
+
+func (s *fileImpl) WatchTreeDeltasContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return s.watchEvents(ctx, stopCh, nil, s.treeDirs(dir), func(ctx context.Context) ([]*libkv.KVPair, error) {
+        return s.ListContext(ctx, dir)
+    }, func(pairs []*libkv.KVPair) *libkv.WatchEvent {
+        return watch.SnapshotEvent(dir, pairs, 0)
+    })
+}
+
+// watchEvents sends the differences between the successive results of read,
+// starting from the current one, itself sent first through snapshot when
+// given. The events go through a sink set up by options, the failed reads
+// are reported and tried again at the next change.
+func (s *fileImpl) watchEvents(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, dirs func() []string, read func(ctx context.Context) ([]*libkv.KVPair, error), snapshot func(pairs []*libkv.KVPair) *libkv.WatchEvent) (<-chan *libkv.WatchEvent, error) {
+    ctx, cancel := context.WithCancel(ctx)
+    stop := s.stopped(ctx, stopCh)
+    wake := s.notify(stop, dirs)
+    pairs, err := read(ctx)
+    if err != nil {
+        cancel()
+        return nil, err
+    }
+    sink := watch.NewSink(stop, options)
+    go func() {
+        defer sink.Close()
+        defer cancel()
+        var events []*libkv.WatchEvent
+        if snapshot != nil {
+            events = append(events, snapshot(pairs))
+        }
+        last := watch.Snapshot(pairs)
+        for {
+            for _, event := range events {
+                if !sink.Send(event) {
+                    return
+                }
+            }
+            select {
+            case <-wake:
+            case <-stop:
+                return
+            }
+            pairs, err := read(ctx)
+            if err != nil {
+                sink.Error(err)
+                events = nil
+                continue
+            }
+            events = watch.Diff(last, pairs, 0)
+            last = watch.Snapshot(pairs)
+        }
+    }()
+    return sink.C(), nil
+}
+
+func sameList(last map[string]uint64, list []*libkv.KVPair) bool {
+    if last == nil || len(last) != len(list) {
+        return false
+    }
+    for _, pair := range list {
+        if index, ok := last[pair.Key]; !ok || index != pair.LastIndex {
+            return false
+        }
+    }
+    return true
+}
+
+// stopped returns a channel closed once the watch is stopped by stopCh, ctx
+// or Close.
+func (s *fileImpl) stopped(ctx context.Context, stopCh <-chan struct{}) <-chan struct{} {
+    stop := make(chan struct{})
+    go func() {
+        defer close(stop)
+        select {
+        case <-stopCh:
+        case <-ctx.Done():
+        case <-s.done:
+        }
+    }()
+    return stop
+}
+
+// notify returns a channel signalled when the directories returned by dirs
+// may have changed. They are watched again after every change, so the new
+// directories are followed, and before the watcher reads them.
+func (s *fileImpl) notify(stop <-chan struct{}, dirs func() []string) <-chan struct{} {
+    wake := make(chan struct{}, 1)
+    interval := pollInterval
+    n, err := newNotifier()
+    var events <-chan struct{}
+    if err == nil {
+        n.add(dirs())
+        events = n.events
+        interval = rescanInterval
+    }
+    go func() {
+        if n != nil {
+            defer n.close()
+        }
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-events:
+                n.add(dirs())
+            case <-ticker.C:
+                if n != nil {
+                    n.add(dirs())
+                }
+            case <-stop:
+                return
+            }
+            select {
+            case wake <- struct{}{}:
+            default:
+            }
+        }
+    }()
+    return wake
+}
+
+// keyDirs returns the directories to watch for keys.
+func (s *fileImpl) keyDirs(keys []string) func() []string {
+    return func() []string {
+        var dirs []string
+        for _, key := range keys {
+            dirs = append(dirs, s.existingDir(filepath.Dir(s.filename(key))))
+        }
+        return dirs
+    }
+}
+
+// treeDirs returns the directories to watch for the tree under dir.
+func (s *fileImpl) treeDirs(dir string) func() []string {
+    return func() []string {
+        top := s.filename(dir)
+        dirs := []string{s.existingDir(top)}
+        _ = filepath.Walk(top, func(name string, fi os.FileInfo, err error) error {
+            if err == nil && fi.IsDir() {
+                dirs = append(dirs, name)
+            }
+            return nil
+        })
+        return dirs
+    }
+}
+
+// existingDir returns dir or its closest existing parent below root.
+func (s *fileImpl) existingDir(dir string) string {
+    for dir != s.root {
+        if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+            return dir
+        }
+        parent := filepath.Dir(dir)
+        if parent == dir {
+            break
+        }
+        dir = parent
+    }
+    return s.root
+}
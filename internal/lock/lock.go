@@ -0,0 +1,26 @@
+// Package lock holds the helpers of the backends implementing their locks
+// on plain keys.
+package lock
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    mrand "math/rand"
+    "time"
+)
+
+// Token returns a random token identifying a lock holder, so that only the
+// holder releases or renews the lock.
+func Token() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// RetryDelay returns delay plus a random part up to delay, so the contenders
+// of a lock do not retry in step.
+func RetryDelay(delay time.Duration) time.Duration {
+    return delay + time.Duration(mrand.Int63n(int64(delay)))
+}
@@ -0,0 +1,52 @@
+package watch
+
+import (
+    "github.com/DGHeroin/libkv"
+    "sort"
+)
+
+// Snapshot indexes pairs by key, for Diff.
+func Snapshot(pairs []*libkv.KVPair) map[string]*libkv.KVPair {
+    m := make(map[string]*libkv.KVPair, len(pairs))
+    for _, pair := range pairs {
+        m[pair.Key] = pair
+    }
+    return m
+}
+
+// Diff returns the events turning last into pairs ordered by key, for the
+// backends only reading snapshots. Pairs are compared by LastIndex, rev is
+// the revision of the removals, 0 when unknown.
+func Diff(last map[string]*libkv.KVPair, pairs []*libkv.KVPair, rev uint64) []*libkv.WatchEvent {
+    var events []*libkv.WatchEvent
+    seen := make(map[string]struct{}, len(pairs))
+    for _, pair := range pairs {
+        seen[pair.Key] = struct{}{}
+        prev := last[pair.Key]
+        if prev != nil && prev.LastIndex == pair.LastIndex {
+            continue
+        }
+        events = append(events, &libkv.WatchEvent{
+            Op:       libkv.WatchPut,
+            Key:      pair.Key,
+            Pair:     pair,
+            Previous: prev,
+            Revision: pair.LastIndex,
+        })
+    }
+    for key, prev := range last {
+        if _, ok := seen[key]; !ok {
+            events = append(events, &libkv.WatchEvent{Op: libkv.WatchDelete, Key: key, Previous: prev, Revision: rev})
+        }
+    }
+    sort.Slice(events, func(i, j int) bool {
+        return events[i].Key < events[j].Key
+    })
+    return events
+}
+
+// SnapshotEvent returns the event starting a delta watch of the tree dir,
+// holding pairs at revision rev.
+func SnapshotEvent(dir string, pairs []*libkv.KVPair, rev uint64) *libkv.WatchEvent {
+    return &libkv.WatchEvent{Op: libkv.WatchSnapshot, Key: dir, Snapshot: pairs, Revision: rev}
+}
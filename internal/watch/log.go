@@ -0,0 +1,118 @@
+package watch
+
+import (
+    "encoding/binary"
+    "errors"
+    "github.com/DGHeroin/libkv"
+)
+
+// HistorySize is the number of revisions the stores keep in their log at
+// least, for the watches resuming from a past revision.
+const HistorySize = 1024
+
+// Log returns the changes logged after rev, in order, or common.ErrCompacted
+// when some of them are no longer retained.
+type Log func(rev uint64) ([]*libkv.WatchEvent, error)
+
+// Retained returns the revision the log of a store at current holds every
+// change after, the log having been started at start.
+func Retained(start, current uint64) uint64 {
+    if current > start+HistorySize {
+        return current - HistorySize
+    }
+    return start
+}
+
+var errBadLog = errors.New("corrupted change log")
+
+const (
+    hasPair = 1 << iota
+    hasPrevious
+)
+
+// EncodeEvents returns the log entry of events, the changes of a revision:
+//
+//     (op | key | flags | [value] | [previous value | previous revision])...
+//
+// where the keys and values are prefixed by their length.
+func EncodeEvents(events []*libkv.WatchEvent) []byte {
+    var b []byte
+    for _, event := range events {
+        flags := byte(0)
+        if event.Pair != nil {
+            flags |= hasPair
+        }
+        if event.Previous != nil {
+            flags |= hasPrevious
+        }
+        b = append(b, byte(event.Op))
+        b = appendBytes(b, []byte(event.Key))
+        b = append(b, flags)
+        if event.Pair != nil {
+            b = appendBytes(b, event.Pair.Value)
+        }
+        if event.Previous != nil {
+            b = appendBytes(b, event.Previous.Value)
+            b = appendUvarint(b, event.Previous.LastIndex)
+        }
+    }
+    return b
+}
+
+// DecodeEvents reads the log entry b of revision rev.
+func DecodeEvents(rev uint64, b []byte) ([]*libkv.WatchEvent, error) {
+    var events []*libkv.WatchEvent
+    for len(b) > 0 {
+        event := &libkv.WatchEvent{Op: libkv.WatchOp(b[0]), Revision: rev}
+        var (
+            key []byte
+            ok  bool
+        )
+        if key, b, ok = readBytes(b[1:]); !ok || len(b) == 0 {
+            return nil, errBadLog
+        }
+        event.Key = string(key)
+        flags := b[0]
+        b = b[1:]
+        if flags&hasPair != 0 {
+            var value []byte
+            if value, b, ok = readBytes(b); !ok {
+                return nil, errBadLog
+            }
+            event.Pair = &libkv.KVPair{Key: event.Key, Value: value, LastIndex: rev}
+        }
+        if flags&hasPrevious != 0 {
+            var value []byte
+            if value, b, ok = readBytes(b); !ok {
+                return nil, errBadLog
+            }
+            previous, n := binary.Uvarint(b)
+            if n <= 0 {
+                return nil, errBadLog
+            }
+            b = b[n:]
+            event.Previous = &libkv.KVPair{Key: event.Key, Value: value, LastIndex: previous}
+        }
+        events = append(events, event)
+    }
+    return events, nil
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+    var buf [binary.MaxVarintLen64]byte
+    return append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+func appendBytes(b, data []byte) []byte {
+    b = appendUvarint(b, uint64(len(data)))
+    return append(b, data...)
+}
+
+func readBytes(b []byte) ([]byte, []byte, bool) {
+    size, n := binary.Uvarint(b)
+    if n <= 0 || uint64(len(b)-n) < size {
+        return nil, nil, false
+    }
+    b = b[n:]
+    return append([]byte(nil), b[:size]...), b[size:], true
+}
@@ -0,0 +1,66 @@
+package watch
+
+import "github.com/DGHeroin/libkv"
+
+// queue holds the events waiting for a consumer, indexed by key so the
+// pending event of a key can be replaced.
+type queue struct {
+    events []*libkv.WatchEvent // nil where an event was merged away
+    index  map[string]int      // position of the last event of each key
+    merged int
+}
+
+// len returns the number of events pending.
+func (q *queue) len() int {
+    return len(q.events) - q.merged
+}
+
+func (q *queue) add(event *libkv.WatchEvent) {
+    if q.index == nil {
+        q.index = make(map[string]int)
+    }
+    if event.Op != libkv.WatchSnapshot {
+        q.index[event.Key] = len(q.events)
+    }
+    q.events = append(q.events, event)
+}
+
+// merge queues event in place of the pending event of its key. A merged
+// event moves to the end of the queue, so the revisions stay in order, and
+// keeps the previous value known to the consumer.
+func (q *queue) merge(event *libkv.WatchEvent) {
+    if i, ok := q.index[event.Key]; ok && event.Op != libkv.WatchSnapshot {
+        merged := *event
+        merged.Previous = q.events[i].Previous
+        if i == len(q.events)-1 {
+            q.events[i] = &merged
+            return
+        }
+        event = &merged
+        q.events[i] = nil
+        q.merged++
+    }
+    q.add(event)
+    if q.merged > len(q.events)/2 {
+        q.compact()
+    }
+}
+
+func (q *queue) compact() {
+    events := q.take()
+    for _, event := range events {
+        q.add(event)
+    }
+}
+
+// take empties the queue, returning the pending events in order.
+func (q *queue) take() []*libkv.WatchEvent {
+    events := q.events[:0:0]
+    for _, event := range q.events {
+        if event != nil {
+            events = append(events, event)
+        }
+    }
+    q.events, q.index, q.merged = nil, nil, 0
+    return events
+}
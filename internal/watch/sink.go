@@ -0,0 +1,169 @@
+package watch
+
+import (
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "sync"
+    "time"
+)
+
+// RetryInterval is the delay before a watch reads again after an error.
+var RetryInterval = time.Second
+
+// Sink delivers the events of a watch to its consumer as its options ask,
+// and reports its errors on their side channel. The producer calls Send
+// and Error until stop is closed, then Close.
+type Sink struct {
+    ch       chan *libkv.WatchEvent
+    stop     <-chan struct{}
+    overflow libkv.WatchOverflow
+    errors   chan<- error
+
+    // pending events, when coalescing
+    mu      sync.Mutex
+    queue   queue
+    signal  chan struct{}
+    closing chan struct{}
+    closed  chan struct{}
+}
+
+func NewSink(stop <-chan struct{}, options *libkv.WatchOptions) *Sink {
+    if options == nil {
+        options = &libkv.WatchOptions{}
+    }
+    s := &Sink{
+        stop:     stop,
+        overflow: options.Overflow,
+        errors:   options.Errors,
+    }
+    if s.overflow != libkv.WatchCoalesce {
+        s.ch = make(chan *libkv.WatchEvent, options.Buffer)
+        return s
+    }
+    s.ch = make(chan *libkv.WatchEvent)
+    s.signal = make(chan struct{}, 1)
+    s.closing = make(chan struct{})
+    s.closed = make(chan struct{})
+    go s.forward()
+    return s
+}
+
+// C returns the channel of the consumer, closed along with the sink.
+func (s *Sink) C() <-chan *libkv.WatchEvent {
+    return s.ch
+}
+
+// Send delivers event, it returns false once stop is closed.
+func (s *Sink) Send(event *libkv.WatchEvent) bool {
+    switch s.overflow {
+    case libkv.WatchDrop:
+        select {
+        case s.ch <- event:
+        case <-s.stop:
+            return false
+        default:
+            s.Error(common.ErrWatchOverflow)
+        }
+    case libkv.WatchCoalesce:
+        s.push(event)
+    default:
+        select {
+        case s.ch <- event:
+        case <-s.stop:
+            return false
+        }
+    }
+    select {
+    case <-s.stop:
+        return false
+    default:
+        return true
+    }
+}
+
+// Error reports err on the side channel, dropped when it is full.
+func (s *Sink) Error(err error) {
+    if s.errors == nil {
+        return
+    }
+    select {
+    case s.errors <- err:
+    default:
+    }
+}
+
+// Retry reports err, then waits RetryInterval before the watch reads again.
+// It returns false once stop is closed.
+func (s *Sink) Retry(err error) bool {
+    s.Error(err)
+    return Wait(s.stop)
+}
+
+// Wait is the retry of the watches without a side channel, it waits
+// RetryInterval and returns false once stop is closed.
+func Wait(stop <-chan struct{}) bool {
+    t := time.NewTimer(RetryInterval)
+    defer t.Stop()
+    select {
+    case <-t.C:
+        return true
+    case <-stop:
+        return false
+    }
+}
+
+// Close closes the channel of the consumer, once the pending events are
+// delivered or stop is closed.
+func (s *Sink) Close() {
+    if s.overflow != libkv.WatchCoalesce {
+        close(s.ch)
+        return
+    }
+    close(s.closing)
+    <-s.closed
+}
+
+// push queues event, replacing the pending event of its key.
+func (s *Sink) push(event *libkv.WatchEvent) {
+    s.mu.Lock()
+    s.queue.merge(event)
+    s.mu.Unlock()
+    select {
+    case s.signal <- struct{}{}:
+    default:
+    }
+}
+
+func (s *Sink) take() []*libkv.WatchEvent {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.queue.take()
+}
+
+func (s *Sink) forward() {
+    defer close(s.closed)
+    defer close(s.ch)
+    send := func(events []*libkv.WatchEvent) bool {
+        for _, event := range events {
+            select {
+            case s.ch <- event:
+            case <-s.stop:
+                return false
+            }
+        }
+        return true
+    }
+    for {
+        select {
+        case <-s.signal:
+            if !send(s.take()) {
+                return
+            }
+        case <-s.closing:
+            send(s.take())
+            return
+        case <-s.stop:
+            return
+        }
+    }
+}
@@ -0,0 +1,465 @@
+// Package watch publishes changes to in-process watchers, for the backends
+// whose writes all go through the current process.
+package watch
+
+import (
+    "context"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "strings"
+    "sync"
+)
+
+// Watcher queues the changes of some keys, or of a tree, without ever
+// blocking the writer. Once Buffer changes are queued, the Overflow of its
+// options applies: the new changes are dropped or merged, or left out until
+// the consumer catches up, reading them from the log of the store.
+type Watcher struct {
+    hub      *Hub
+    keys     map[string]struct{} // watched keys, nil when watching a tree
+    prefix   string
+    limit    int
+    overflow libkv.WatchOverflow
+
+    mu      sync.Mutex
+    queue   queue
+    last    uint64 // revision of the last changes queued
+    behind  bool   // changes after last were left out
+    dropped bool
+    signal  chan struct{}
+}
+
+func (w *Watcher) match(key string) bool {
+    if w.keys == nil {
+        return strings.HasPrefix(key, w.prefix)
+    }
+    _, ok := w.keys[key]
+    return ok
+}
+
+// push queues events, the changes of one revision.
+func (w *Watcher) push(events ...*libkv.WatchEvent) {
+    w.mu.Lock()
+    if w.behind || events[0].Revision <= w.last {
+        // read from the log already, or to be once caught up
+        w.mu.Unlock()
+        return
+    }
+    if w.overflow == libkv.WatchBlock && w.queue.len() > 0 && w.queue.len()+len(events) > w.limit {
+        // the revision is read from the log as a whole once caught up
+        w.behind = true
+        w.mu.Unlock()
+        return
+    }
+    w.last = events[0].Revision
+    for _, event := range events {
+        switch {
+        case w.queue.len() < w.limit || w.overflow == libkv.WatchBlock:
+            w.queue.add(event)
+        case w.overflow == libkv.WatchCoalesce:
+            w.queue.merge(event)
+        default:
+            w.dropped = true
+        }
+    }
+    w.mu.Unlock()
+    select {
+    case w.signal <- struct{}{}:
+    default:
+    }
+}
+
+// take returns the queued changes, then the ones left out once the queue is
+// drained. It reports ErrWatchOverflow along with the changes once some were
+// dropped, and the error stopping the watch otherwise.
+func (w *Watcher) take() ([]*libkv.WatchEvent, error) {
+    w.mu.Lock()
+    events, behind, dropped := w.queue.take(), w.behind, w.dropped
+    w.dropped = false
+    w.mu.Unlock()
+    if dropped {
+        return events, common.ErrWatchOverflow
+    }
+    if len(events) > 0 || !behind {
+        return events, nil
+    }
+    return w.hub.catchUp(w)
+}
+
+// drain empties the queue, for the watches relisting on any change.
+func (w *Watcher) drain() {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    w.queue.take()
+    w.behind, w.dropped = false, false
+}
+
+// Close unregisters the watcher.
+func (w *Watcher) Close() {
+    w.hub.mu.Lock()
+    defer w.hub.mu.Unlock()
+    delete(w.hub.watchers, w)
+}
+
+// Pairs sends initial, then every queued change, until stopCh is closed,
+// ctx or done is done. Removals are sent as pairs without value. The watcher
+// is closed along with the returned channel.
+func (w *Watcher) Pairs(ctx context.Context, stopCh, done <-chan struct{}, initial []*libkv.KVPair) <-chan *libkv.KVPair {
+    watchCh := make(chan *libkv.KVPair)
+    go func() {
+        defer close(watchCh)
+        defer w.Close()
+        send := func(pairs []*libkv.KVPair) bool {
+            for _, pair := range pairs {
+                select {
+                case watchCh <- pair:
+                case <-stopCh:
+                    return false
+                case <-ctx.Done():
+                    return false
+                case <-done:
+                    return false
+                }
+            }
+            return true
+        }
+        if !send(initial) {
+            return
+        }
+        for {
+            select {
+            case <-stopCh:
+                return
+            case <-ctx.Done():
+                return
+            case <-done:
+                return
+            case <-w.signal:
+                for {
+                    events, err := w.take()
+                    if err != nil && err != common.ErrWatchOverflow {
+                        return
+                    }
+                    if len(events) == 0 {
+                        break
+                    }
+                    if !send(pairs(events)) {
+                        return
+                    }
+                }
+            }
+        }
+    }()
+    return watchCh
+}
+
+func pairs(events []*libkv.WatchEvent) []*libkv.KVPair {
+    pairs := make([]*libkv.KVPair, 0, len(events))
+    for _, event := range events {
+        pairs = append(pairs, Pair(event))
+    }
+    return pairs
+}
+
+// Pair returns event as sent by the pair watches: the value written, or a
+// pair without value once removed.
+func Pair(event *libkv.WatchEvent) *libkv.KVPair {
+    if event.Pair != nil {
+        return event.Pair
+    }
+    return &libkv.KVPair{Key: event.Key, LastIndex: event.Revision}
+}
+
+// Events sends initial, then every queued change through a sink set up by
+// options, until stopCh is closed, ctx or done is done. The watcher is
+// closed along with the returned channel.
+func (w *Watcher) Events(ctx context.Context, stopCh, done <-chan struct{}, options *libkv.WatchOptions, initial ...*libkv.WatchEvent) <-chan *libkv.WatchEvent {
+    stop, release := Stop(ctx, stopCh, done)
+    sink := NewSink(stop, options)
+    go func() {
+        defer release()
+        defer sink.Close()
+        defer w.Close()
+        for _, event := range initial {
+            if !sink.Send(event) {
+                return
+            }
+        }
+        for {
+            select {
+            case <-stop:
+                return
+            case <-w.signal:
+                for {
+                    events, err := w.take()
+                    if err != nil {
+                        sink.Error(err)
+                        if err != common.ErrWatchOverflow {
+                            return
+                        }
+                    }
+                    if len(events) == 0 {
+                        break
+                    }
+                    for _, event := range events {
+                        if !sink.Send(event) {
+                            return
+                        }
+                    }
+                }
+            }
+        }
+    }()
+    return sink.C()
+}
+
+// Lists sends initial, then the result of list after each change. Changes
+// queued while the previous listing is consumed are coalesced into one.
+func (w *Watcher) Lists(ctx context.Context, stopCh, done <-chan struct{}, initial []*libkv.KVPair, list func(ctx context.Context) ([]*libkv.KVPair, error)) <-chan []*libkv.KVPair {
+    watchCh := make(chan []*libkv.KVPair)
+    go func() {
+        defer close(watchCh)
+        defer w.Close()
+        pairs := initial
+        for {
+            select {
+            case watchCh <- pairs:
+            case <-stopCh:
+                return
+            case <-ctx.Done():
+                return
+            case <-done:
+                return
+            }
+            select {
+            case <-stopCh:
+                return
+            case <-ctx.Done():
+                return
+            case <-done:
+                return
+            case <-w.signal:
+                w.drain()
+            }
+            var err error
+            if pairs, err = list(ctx); err != nil {
+                return
+            }
+        }
+    }()
+    return watchCh
+}
+
+// Stop returns a channel closed once stopCh is closed, ctx or done is done,
+// or release is called.
+func Stop(ctx context.Context, stopCh, done <-chan struct{}) (<-chan struct{}, func()) {
+    ctx, cancel := context.WithCancel(ctx)
+    go func() {
+        select {
+        case <-stopCh:
+        case <-done:
+        case <-ctx.Done():
+        }
+        cancel()
+    }()
+    return ctx.Done(), cancel
+}
+
+// Hub dispatches the changes to the registered watchers.
+type Hub struct {
+    mu       sync.Mutex
+    writers  sync.Locker // held by the writers of the store until notified
+    log      Log         // reads the changes the watchers missed
+    rev      uint64      // revision of the last changes notified
+    watchers map[*Watcher]struct{}
+}
+
+// Init sets the log of the store, at revision rev, and the lock its writers
+// hold from their write to its notification, before any watch.
+func (h *Hub) Init(log Log, rev uint64, writers sync.Locker) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.log = log
+    h.rev = rev
+    h.writers = writers
+}
+
+// Hold runs fn, passing it the revision of the store, while the writers are
+// held. The store is read and the watchers are registered at once, so no
+// write slips between.
+func (h *Hub) Hold(fn func(rev uint64) error) error {
+    h.writers.Lock()
+    defer h.writers.Unlock()
+    h.mu.Lock()
+    rev := h.rev
+    h.mu.Unlock()
+    return fn(rev)
+}
+
+// since returns the revision a watch with options starts after, current
+// when not resuming.
+func since(options *libkv.WatchOptions, current uint64) uint64 {
+    if options == nil || options.Revision == 0 {
+        return current
+    }
+    return options.Revision
+}
+
+// Watch registers a watcher of keys.
+func (h *Hub) Watch(keys ...string) *Watcher {
+    w := newWatcher(h, nil)
+    w.keys = make(map[string]struct{}, len(keys))
+    for _, key := range keys {
+        w.keys[key] = struct{}{}
+    }
+    return h.add(w)
+}
+
+// WatchTree registers a watcher of the keys under prefix.
+func (h *Hub) WatchTree(prefix string) *Watcher {
+    w := newWatcher(h, nil)
+    w.prefix = prefix
+    return h.add(w)
+}
+
+// WatchFrom registers a watcher of keys set up by options, queuing first
+// the changes logged after the revision it resumes from.
+func (h *Hub) WatchFrom(options *libkv.WatchOptions, keys ...string) (*Watcher, error) {
+    w := newWatcher(h, options)
+    w.keys = make(map[string]struct{}, len(keys))
+    for _, key := range keys {
+        w.keys[key] = struct{}{}
+    }
+    return h.addFrom(w, options)
+}
+
+// WatchTreeFrom registers a watcher of the keys under prefix set up by
+// options, queuing first the changes logged after the revision it resumes
+// from.
+func (h *Hub) WatchTreeFrom(options *libkv.WatchOptions, prefix string) (*Watcher, error) {
+    w := newWatcher(h, options)
+    w.prefix = prefix
+    return h.addFrom(w, options)
+}
+
+func newWatcher(h *Hub, options *libkv.WatchOptions) *Watcher {
+    if options == nil {
+        options = &libkv.WatchOptions{}
+    }
+    w := &Watcher{
+        hub:      h,
+        limit:    options.Buffer,
+        overflow: options.Overflow,
+        signal:   make(chan struct{}, 1),
+    }
+    if w.limit < 1 {
+        w.limit = 1
+    }
+    return w
+}
+
+func (h *Hub) add(w *Watcher) *Watcher {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    w.last = h.rev
+    h.register(w)
+    return w
+}
+
+func (h *Hub) addFrom(w *Watcher, options *libkv.WatchOptions) (*Watcher, error) {
+    err := h.Hold(func(current uint64) error {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        if rev := since(options, current); rev < current {
+            if h.log == nil {
+                return common.ErrCompacted
+            }
+            events, err := h.log(rev)
+            if err != nil {
+                return err
+            }
+            w.last = rev
+            for _, changes := range byRevision(events) {
+                if changes = w.filter(changes); len(changes) > 0 {
+                    w.push(changes...)
+                }
+            }
+        }
+        if !w.behind {
+            w.last = current
+        }
+        h.register(w)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return w, nil
+}
+
+// register adds w. The caller holds h.mu.
+func (h *Hub) register(w *Watcher) {
+    if h.watchers == nil {
+        h.watchers = make(map[*Watcher]struct{})
+    }
+    h.watchers[w] = struct{}{}
+}
+
+// catchUp returns the changes w left out, read from the log. Holding h.mu,
+// none is notified meanwhile; the ones read already are skipped once they
+// are.
+func (h *Hub) catchUp(w *Watcher) ([]*libkv.WatchEvent, error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if h.log == nil {
+        return nil, common.ErrCompacted
+    }
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    events, err := h.log(w.last)
+    if err != nil {
+        return nil, err
+    }
+    w.behind = false
+    if n := len(events); n > 0 {
+        w.last = events[n-1].Revision
+    }
+    return w.filter(events), nil
+}
+
+// Notify queues events, the changes of revision rev, to the watchers they
+// match. Writers call it in the order of their writes, holding the lock
+// given to Init.
+func (h *Hub) Notify(rev uint64, events ...*libkv.WatchEvent) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.rev = rev
+    for w := range h.watchers {
+        if matched := w.filter(events); len(matched) > 0 {
+            w.push(matched...)
+        }
+    }
+}
+
+// filter returns the events w watches.
+func (w *Watcher) filter(events []*libkv.WatchEvent) []*libkv.WatchEvent {
+    var matched []*libkv.WatchEvent
+    for _, event := range events {
+        if w.match(event.Key) {
+            matched = append(matched, event)
+        }
+    }
+    return matched
+}
+
+// byRevision splits events in the changes of each revision.
+func byRevision(events []*libkv.WatchEvent) [][]*libkv.WatchEvent {
+    var split [][]*libkv.WatchEvent
+    for i, event := range events {
+        if i == 0 || event.Revision != events[i-1].Revision {
+            split = append(split, nil)
+        }
+        split[len(split)-1] = append(split[len(split)-1], event)
+    }
+    return split
+}
@@ -0,0 +1,130 @@
+package watch
+
+import (
+    "context"
+    "fmt"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/stretchr/testify/assert"
+    "sync"
+    "testing"
+    "time"
+)
+
+// testStore logs its changes like the embedded stores, trimming the log
+// after HistorySize revisions.
+type testStore struct {
+    hub     Hub
+    writers sync.Mutex
+    mu      sync.Mutex
+    log     []*libkv.WatchEvent
+    rev     uint64
+}
+
+func newTestStore() *testStore {
+    s := &testStore{}
+    s.hub.Init(s.changes, 0, &s.writers)
+    return s
+}
+
+func (s *testStore) put(key, value string) {
+    s.writers.Lock()
+    defer s.writers.Unlock()
+    s.mu.Lock()
+    s.rev++
+    event := &libkv.WatchEvent{
+        Op:       libkv.WatchPut,
+        Key:      key,
+        Pair:     &libkv.KVPair{Key: key, Value: []byte(value), LastIndex: s.rev},
+        Revision: s.rev,
+    }
+    s.log = append(s.log, event)
+    if len(s.log) > HistorySize {
+        s.log = s.log[1:]
+    }
+    s.mu.Unlock()
+    s.hub.Notify(event.Revision, event)
+}
+
+func (s *testStore) changes(rev uint64) ([]*libkv.WatchEvent, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if rev < Retained(0, s.rev) {
+        return nil, common.ErrCompacted
+    }
+    var events []*libkv.WatchEvent
+    for _, event := range s.log {
+        if event.Revision > rev {
+            events = append(events, event)
+        }
+    }
+    return events, nil
+}
+
+func (w *Watcher) pending() int {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    return len(w.queue.events)
+}
+
+func TestStalledReader(t *testing.T) {
+    for _, overflow := range []libkv.WatchOverflow{libkv.WatchBlock, libkv.WatchDrop, libkv.WatchCoalesce} {
+        s := newTestStore()
+        errCh := make(chan error, 1)
+        options := &libkv.WatchOptions{Buffer: 4, Overflow: overflow, Errors: errCh}
+        w, err := s.hub.WatchTreeFrom(options, "/test_dir/")
+        assert.Nil(t, err)
+        stopCh := make(chan struct{})
+        ch := w.Events(context.Background(), stopCh, nil, options)
+
+        for i := 1; i <= HistorySize/2; i++ {
+            s.put("/test_dir/node1", fmt.Sprintf("value%d", i))
+            assert.True(t, w.pending() <= options.Buffer, "overflow %d, %d pending", overflow, w.pending())
+        }
+
+        if overflow == libkv.WatchDrop {
+            assert.Equal(t, common.ErrWatchOverflow, <-errCh)
+            close(stopCh)
+            continue
+        }
+        // the last change gets through, after every other one when blocking
+        last := fmt.Sprintf("value%d", HistorySize/2)
+        received := 0
+        for value := ""; value != last; received++ {
+            select {
+            case event := <-ch:
+                value = string(event.Pair.Value)
+            case <-time.After(time.Second):
+                t.Fatalf("overflow %d: timeout waiting for %s", overflow, last)
+            }
+        }
+        if overflow == libkv.WatchBlock {
+            assert.Equal(t, HistorySize/2, received)
+        }
+        close(stopCh)
+    }
+}
+
+func TestStalledReaderCompacted(t *testing.T) {
+    s := newTestStore()
+    errCh := make(chan error, 1)
+    options := &libkv.WatchOptions{Errors: errCh}
+    w, err := s.hub.WatchTreeFrom(options, "/test_dir/")
+    assert.Nil(t, err)
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch := w.Events(context.Background(), stopCh, nil, options)
+
+    // the changes left out are no longer logged once the reader is back
+    for i := 0; i < HistorySize*2; i++ {
+        s.put("/test_dir/node1", "value")
+    }
+    for range ch {
+    }
+    select {
+    case err = <-errCh:
+        assert.Equal(t, common.ErrCompacted, err)
+    case <-time.After(time.Second):
+        t.Fatal("timeout waiting for compaction")
+    }
+}
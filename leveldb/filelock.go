@@ -0,0 +1,86 @@
+package leveldb
+
+import (
+    "bytes"
+    "encoding/hex"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+)
+
+// fileLocks is a lockTable shared with the other processes using the same
+// directory. Each record is a file named after the hex encoded key:
+//
+//     token \n expire \n value
+//
+// Updates hold an exclusive file lock on the guard file of the directory.
+type fileLocks struct {
+    dir string
+}
+
+func newFileLocks(dir string) (*fileLocks, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    return &fileLocks{dir: dir}, nil
+}
+
+func (f *fileLocks) update(key string, fn func(cur *lockRecord) *lockRecord) error {
+    guard, err := os.OpenFile(filepath.Join(f.dir, "guard"), os.O_CREATE|os.O_RDWR, 0644)
+    if err != nil {
+        return err
+    }
+    defer guard.Close()
+    if err = lockFile(guard); err != nil {
+        return err
+    }
+    defer unlockFile(guard)
+
+    name := filepath.Join(f.dir, hex.EncodeToString([]byte(key)))
+    cur, err := readLockRecord(name)
+    if err != nil {
+        return err
+    }
+    r := fn(cur)
+    if r == nil {
+        if cur == nil {
+            return nil
+        }
+        return os.Remove(name)
+    }
+    if r == cur {
+        return nil
+    }
+    data := []byte(r.token + "\n" + strconv.FormatInt(r.expire, 10) + "\n")
+    tmp := name + ".tmp"
+    if err = ioutil.WriteFile(tmp, append(data, r.value...), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, name)
+}
+
+// readLockRecord reads the record in file name, a missing or damaged file
+// being a free lock.
+func readLockRecord(name string) (*lockRecord, error) {
+    data, err := ioutil.ReadFile(name)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    parts := bytes.SplitN(data, []byte("\n"), 3)
+    if len(parts) != 3 {
+        return nil, nil
+    }
+    expire, err := strconv.ParseInt(string(parts[1]), 10, 64)
+    if err != nil {
+        return nil, nil
+    }
+    return &lockRecord{
+        token:  string(parts[0]),
+        expire: expire,
+        value:  parts[2],
+    }, nil
+}
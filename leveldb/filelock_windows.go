@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+package leveldb
+
+import (
+    "os"
+    "syscall"
+    "unsafe"
+)
+
+var (
+    modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+    procLockFileEx   = modkernel32.NewProc("LockFileEx")
+    procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const lockfileExclusiveLock = 0x2
+
+func lockFile(f *os.File) error {
+    var ol syscall.Overlapped
+    r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+    if r == 0 {
+        return err
+    }
+    return nil
+}
+
+func unlockFile(f *os.File) error {
+    var ol syscall.Overlapped
+    r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+    if r == 0 {
+        return err
+    }
+    return nil
+}
@@ -1,11 +1,16 @@
 package leveldb
 
 import (
+    "context"
     "errors"
     "github.com/DGHeroin/libkv"
     "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
     ldb "github.com/syndtr/goleveldb/leveldb"
+    "github.com/syndtr/goleveldb/leveldb/storage"
     "github.com/syndtr/goleveldb/leveldb/util"
+    "sync"
+    "time"
 )
 
 func init() {
@@ -18,95 +23,435 @@ func New(addrs []string, opt *libkv.Config) (libkv.Storage, error) {
     if len(addrs) == 0 {
         return nil, errors.New("leveldb path unspecified")
     }
+    db, err := ldb.OpenFile(addrs[0], nil)
+    if err != nil {
+        return nil, err
+    }
+    return newStorage(addrs[0], db, opt)
+}
+
+// NewMemory returns a storage kept in memory, which is lost once closed.
+func NewMemory(opt *libkv.Config) (libkv.Storage, error) {
+    if opt == nil {
+        opt = libkv.DefaultConfig()
+    }
+    db, err := ldb.Open(storage.NewMemStorage(), nil)
+    if err != nil {
+        return nil, err
+    }
+    return newStorage("", db, opt)
+}
+
+func newStorage(path string, db *ldb.DB, opt *libkv.Config) (*leveldbImpl, error) {
     v := &leveldbImpl{
-        path: addrs[0],
+        path:  path,
+        db:    db,
+        locks: &memLocks{},
+        done:  make(chan struct{}),
+    }
+    err := v.loadRevision()
+    if err == nil && opt.SharedLocks && path != "" {
+        v.locks, err = newFileLocks(lockDir(path))
     }
-    db, err := ldb.OpenFile(v.path, nil)
     if err != nil {
+        _ = db.Close()
         return nil, err
     }
-    v.db = db
+    v.wg.Add(1)
+    go v.sweep()
     return v, nil
 }
 
+var _ libkv.StorageContext = (*leveldbImpl)(nil)
+var _ libkv.EventWatcher = (*leveldbImpl)(nil)
+
 type leveldbImpl struct {
-    path string
-    db   *ldb.DB
+    path   string
+    db     *ldb.DB
+    mu     sync.Mutex // serializes writes with the expiry sweeper and watchers
+    rev    uint64     // last committed revision
+    hub    watch.Hub
+    locks  lockTable
+    done   chan struct{}
+    closed sync.Once
+    wg     sync.WaitGroup
 }
 
 func (s *leveldbImpl) Put(key string, value []byte, options *libkv.WriteOptions) error {
-    return s.db.Put([]byte(key), value, nil)
+    return s.PutContext(context.Background(), key, value, options)
+}
+
+func (s *leveldbImpl) PutContext(ctx context.Context, key string, value []byte, options *libkv.WriteOptions) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    ttl := time.Duration(0)
+    if options != nil {
+        ttl = options.TTL
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    _, err := s.put(key, value, ttl)
+    return err
+}
+
+// put writes value at the next revision. The caller holds s.mu.
+func (s *leveldbImpl) put(key string, value []byte, ttl time.Duration) (*libkv.KVPair, error) {
+    if isMetaKey([]byte(key)) {
+        return nil, errReservedKey
+    }
+    rev := s.rev + 1
+    batch := new(ldb.Batch)
+    batch.Put([]byte(key), newRecord(value, ttl, rev).encode())
+    event := &libkv.WatchEvent{
+        Op:       libkv.WatchPut,
+        Key:      key,
+        Pair:     &libkv.KVPair{Key: key, Value: append([]byte(nil), value...)},
+        Previous: s.previous(key),
+    }
+    if err := s.commit(batch, rev, event); err != nil {
+        return nil, err
+    }
+    return &libkv.KVPair{Key: key, Value: value, LastIndex: rev}, nil
+}
+
+// delete removes key at the next revision. The caller holds s.mu.
+func (s *leveldbImpl) delete(key string) error {
+    rev := s.rev + 1
+    batch := new(ldb.Batch)
+    batch.Delete([]byte(key))
+    return s.commit(batch, rev, &libkv.WatchEvent{Op: libkv.WatchDelete, Key: key, Previous: s.previous(key)})
+}
+
+// previous returns the pair a write replaces, nil when missing.
+func (s *leveldbImpl) previous(key string) *libkv.KVPair {
+    r, err := s.get(key)
+    if err != nil {
+        return nil
+    }
+    return &libkv.KVPair{Key: key, Value: r.value, LastIndex: r.revision}
 }
 
 func (s *leveldbImpl) Get(key string) (*libkv.KVPair, error) {
-    val, err := s.db.Get([]byte(key), nil)
+    return s.GetContext(context.Background(), key)
+}
+
+func (s *leveldbImpl) GetContext(ctx context.Context, key string) (*libkv.KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    r, err := s.get(key)
     if err != nil {
         return nil, err
     }
     return &libkv.KVPair{
         Key:       key,
-        Value:     val,
-        LastIndex: 0,
+        Value:     r.value,
+        LastIndex: r.revision,
     }, nil
 }
 
+// get reads the record of key, hiding it once expired.
+func (s *leveldbImpl) get(key string) (record, error) {
+    if isMetaKey([]byte(key)) {
+        return record{}, common.ErrKeyNotFound
+    }
+    val, err := s.db.Get([]byte(key), nil)
+    if err == ldb.ErrNotFound {
+        return record{}, common.ErrKeyNotFound
+    }
+    if err != nil {
+        return record{}, err
+    }
+    r := decodeRecord(val)
+    if r.expired(time.Now()) {
+        return record{}, common.ErrKeyNotFound
+    }
+    return r, nil
+}
+
 func (s *leveldbImpl) Delete(key string) error {
-    return s.db.Delete([]byte(key), nil)
+    return s.DeleteContext(context.Background(), key)
+}
+
+func (s *leveldbImpl) DeleteContext(ctx context.Context, key string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ok, err := s.db.Has([]byte(key), nil)
+    if err != nil || !ok || isMetaKey([]byte(key)) {
+        return err
+    }
+    return s.delete(key)
 }
 
 func (s *leveldbImpl) Exists(key string) (bool, error) {
-    return s.db.Has([]byte(key), nil)
+    return s.ExistsContext(context.Background(), key)
+}
+
+func (s *leveldbImpl) ExistsContext(ctx context.Context, key string) (bool, error) {
+    if err := ctx.Err(); err != nil {
+        return false, err
+    }
+    _, err := s.get(key)
+    if err == common.ErrKeyNotFound {
+        return false, nil
+    }
+    return err == nil, err
 }
 
 func (s *leveldbImpl) Watch(key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
-    return nil, common.ErrAPINotSupported
+    return s.WatchContext(context.Background(), key, stopCh)
+}
+
+func (s *leveldbImpl) WatchContext(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(ctx, stopCh, key)
 }
 
 func (s *leveldbImpl) WatchMulti(stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
-    return nil, common.ErrAPINotSupported
+    return s.WatchMultiContext(context.Background(), stopCh, keys...)
+}
+
+func (s *leveldbImpl) WatchMultiContext(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    var (
+        initial []*libkv.KVPair
+        w       *watch.Watcher
+    )
+    err := s.hub.Hold(func(uint64) error {
+        for _, key := range keys {
+            r, err := s.get(key)
+            if err == common.ErrKeyNotFound {
+                continue
+            }
+            if err != nil {
+                return err
+            }
+            initial = append(initial, &libkv.KVPair{Key: key, Value: r.value, LastIndex: r.revision})
+        }
+        w = s.hub.Watch(keys...)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return w.Pairs(ctx, stopCh, s.done, initial), nil
 }
 
 func (s *leveldbImpl) WatchTree(dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
-    return nil, common.ErrAPINotSupported
+    return s.WatchTreeContext(context.Background(), dir, stopCh)
+}
+
+func (s *leveldbImpl) WatchTreeContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    w := s.hub.WatchTree(dir)
+    list, err := s.ListContext(ctx, dir)
+    if err != nil {
+        w.Close()
+        return nil, err
+    }
+    return w.Lists(ctx, stopCh, s.done, list, func(ctx context.Context) ([]*libkv.KVPair, error) {
+        return s.ListContext(ctx, dir)
+    }), nil
+}
+
+func (s *leveldbImpl) WatchEvents(stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchEventsContext(context.Background(), stopCh, options, keys...)
+}
+
+func (s *leveldbImpl) WatchEventsContext(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    w, err := s.hub.WatchFrom(options, keys...)
+    if err != nil {
+        return nil, err
+    }
+    return w.Events(ctx, stopCh, s.done, options), nil
+}
+
+func (s *leveldbImpl) WatchTreeEvents(dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeEventsContext(context.Background(), dir, stopCh, options)
+}
+
+func (s *leveldbImpl) WatchTreeEventsContext(ctx context.Context, dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    w, err := s.hub.WatchTreeFrom(options, dir)
+    if err != nil {
+        return nil, err
+    }
+    return w.Events(ctx, stopCh, s.done, options), nil
+}
+
+func (s *leveldbImpl) WatchTreeDeltas(dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeDeltasContext(context.Background(), dir, stopCh)
+}
+
+func (s *leveldbImpl) WatchTreeDeltasContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    var (
+        snapshot *libkv.WatchEvent
+        w        *watch.Watcher
+    )
+    err := s.hub.Hold(func(rev uint64) error {
+        list, err := s.ListContext(ctx, dir)
+        if err != nil {
+            return err
+        }
+        snapshot = &libkv.WatchEvent{Op: libkv.WatchSnapshot, Key: dir, Snapshot: list, Revision: rev}
+        w = s.hub.WatchTree(dir)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return w.Events(ctx, stopCh, s.done, nil, snapshot), nil
 }
 
 func (s *leveldbImpl) NewLock(key string, options *libkv.LockOptions) (libkv.Locker, error) {
-    return nil, common.ErrAPINotSupported
+    return s.NewLockContext(context.Background(), key, options)
+}
+
+func (s *leveldbImpl) NewLockContext(ctx context.Context, key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return newLock(s.locks, key, options), nil
 }
 
 func (s *leveldbImpl) List(dir string) ([]*libkv.KVPair, error) {
+    return s.ListContext(context.Background(), dir)
+}
+
+func (s *leveldbImpl) ListContext(ctx context.Context, dir string) ([]*libkv.KVPair, error) {
     iter := s.db.NewIterator(util.BytesPrefix([]byte(dir)), nil)
-    var result = make([]*libkv.KVPair, 16)
+    defer iter.Release()
+    var (
+        result = make([]*libkv.KVPair, 0, 16)
+        now    = time.Now()
+    )
     for iter.Next() {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        if isMetaKey(iter.Key()) {
+            continue
+        }
+        r := decodeRecord(iter.Value())
+        if r.expired(now) {
+            continue
+        }
         result = append(result, &libkv.KVPair{
             Key:       string(iter.Key()),
-            Value:     iter.Value(),
-            LastIndex: 0,
+            Value:     append([]byte(nil), r.value...),
+            LastIndex: r.revision,
         })
     }
-    return result, nil
+    return result, iter.Error()
 }
 
 func (s *leveldbImpl) DeleteTree(dir string) error {
-    list, err := s.List(dir)
-    if err != nil {
+    return s.DeleteTreeContext(context.Background(), dir)
+}
+
+func (s *leveldbImpl) DeleteTreeContext(ctx context.Context, dir string) error {
+    if err := ctx.Err(); err != nil {
         return err
     }
-    batch := new(ldb.Batch)
-    for _, val := range list {
-        batch.Delete([]byte(val.Key))
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    iter := s.db.NewIterator(util.BytesPrefix([]byte(dir)), nil)
+    defer iter.Release()
+    var (
+        batch   = new(ldb.Batch)
+        deleted []*libkv.WatchEvent
+        now     = time.Now()
+    )
+    for iter.Next() {
+        if isMetaKey(iter.Key()) {
+            continue
+        }
+        batch.Delete(append([]byte(nil), iter.Key()...))
+        event := &libkv.WatchEvent{Op: libkv.WatchDelete, Key: string(iter.Key())}
+        if r := decodeRecord(iter.Value()); !r.expired(now) {
+            event.Previous = &libkv.KVPair{Key: event.Key, Value: append([]byte(nil), r.value...), LastIndex: r.revision}
+        }
+        deleted = append(deleted, event)
+    }
+    if err := iter.Error(); err != nil {
+        return err
+    }
+    if len(deleted) == 0 {
+        return nil
     }
-    return s.db.Write(batch, nil)
+    return s.commit(batch, s.rev+1, deleted...)
 }
 
 func (s *leveldbImpl) AtomicPut(key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
-    return false, nil, common.ErrAPINotSupported
+    return s.AtomicPutContext(context.Background(), key, value, previous, options)
+}
+
+func (s *leveldbImpl) AtomicPutContext(ctx context.Context, key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    if err := ctx.Err(); err != nil {
+        return false, nil, err
+    }
+    ttl := time.Duration(0)
+    if options != nil {
+        ttl = options.TTL
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    r, err := s.get(key)
+    switch {
+    case err == common.ErrKeyNotFound:
+        if previous != nil {
+            return false, nil, common.ErrKeyModified
+        }
+    case err != nil:
+        return false, nil, err
+    case previous == nil:
+        return false, nil, common.ErrKeyExists
+    case r.revision != previous.LastIndex:
+        return false, nil, common.ErrKeyModified
+    }
+    pair, err := s.put(key, value, ttl)
+    if err != nil {
+        return false, nil, err
+    }
+    return true, pair, nil
 }
 
 func (s *leveldbImpl) AtomicDelete(key string, previous *libkv.KVPair) (bool, error) {
-    return false, common.ErrAPINotSupported
+    return s.AtomicDeleteContext(context.Background(), key, previous)
+}
+
+func (s *leveldbImpl) AtomicDeleteContext(ctx context.Context, key string, previous *libkv.KVPair) (bool, error) {
+    if err := ctx.Err(); err != nil {
+        return false, err
+    }
+    if previous == nil {
+        return false, common.ErrPreviousNotSpecified
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    r, err := s.get(key)
+    if err != nil {
+        return false, err
+    }
+    if r.revision != previous.LastIndex {
+        return false, common.ErrKeyModified
+    }
+    if err = s.delete(key); err != nil {
+        return false, err
+    }
+    return true, nil
 }
 
 func (s *leveldbImpl) Close() {
-    _ = s.db.Close()
+    s.closed.Do(func() {
+        close(s.done)
+        s.wg.Wait()
+        _ = s.db.Close()
+    })
 }
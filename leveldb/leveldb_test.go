@@ -0,0 +1,538 @@
+package leveldb
+
+import (
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
+    "github.com/stretchr/testify/assert"
+    "testing"
+    "time"
+)
+
+func newTestStorage(t *testing.T) libkv.Storage {
+    kv, err := New([]string{t.TempDir()}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return kv
+}
+
+func TestErrors(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+
+    _, err := kv.Get("/missing")
+    assert.True(t, errors.Is(err, common.ErrKeyNotFound))
+
+    ok, err := kv.Exists("/missing")
+    assert.Nil(t, err)
+    assert.False(t, ok)
+
+    // the revision counter cannot be overwritten
+    assert.Nil(t, kv.Put("/key", []byte("value"), nil))
+    pair, err := kv.Get("/key")
+    assert.Nil(t, err)
+    assert.Equal(t, errReservedKey, kv.Put(string(revisionKey), []byte{0, 0, 0, 0, 0, 0, 0, 0}, nil))
+    _, _, err = kv.AtomicPut(string(revisionKey), nil, nil, nil)
+    assert.Equal(t, errReservedKey, err)
+    _, err = kv.(libkv.Transactor).Txn(&libkv.Txn{Then: []libkv.TxnOp{libkv.OpPut(string(revisionKey), nil, nil)}})
+    assert.Equal(t, errReservedKey, err)
+    assert.Nil(t, kv.Put("/key", []byte("value"), nil))
+    next, err := kv.Get("/key")
+    assert.Nil(t, err)
+    assert.Equal(t, pair.LastIndex+1, next.LastIndex)
+
+    // Close is idempotent
+    kv.Close()
+    kv.Close()
+}
+
+func TestTTL(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+
+    assert.Nil(t, kv.Put("/ttl/short", []byte("v"), &libkv.WriteOptions{TTL: time.Millisecond * 50}))
+    assert.Nil(t, kv.Put("/ttl/long", []byte("v"), &libkv.WriteOptions{TTL: time.Hour}))
+    assert.Nil(t, kv.Put("/ttl/none", []byte("v"), nil))
+
+    ok, err := kv.Exists("/ttl/short")
+    assert.Nil(t, err)
+    assert.True(t, ok)
+
+    time.Sleep(time.Millisecond * 100)
+    _, err = kv.Get("/ttl/short")
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    ok, err = kv.Exists("/ttl/short")
+    assert.Nil(t, err)
+    assert.False(t, ok)
+    list, err := kv.List("/ttl/")
+    assert.Nil(t, err)
+    assert.Len(t, list, 2)
+
+    s := kv.(*leveldbImpl)
+    assert.Nil(t, s.sweepExpired())
+    ok, err = s.db.Has([]byte("/ttl/short"), nil)
+    assert.Nil(t, err)
+    assert.False(t, ok)
+    ok, err = s.db.Has([]byte("/ttl/long"), nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+}
+
+func TestWatch(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    ch, err := kv.Watch(key, stopCh)
+    assert.Nil(t, err)
+
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("other"), nil))
+    assert.Nil(t, kv.Put(key, []byte("value2"), nil))
+    assert.Nil(t, kv.Delete(key))
+
+    for _, want := range []string{"value0", "value1", "value2", ""} {
+        select {
+        case pair := <-ch:
+            assert.Equal(t, key, pair.Key)
+            assert.Equal(t, want, string(pair.Value))
+        case <-time.After(time.Second):
+            t.Fatalf("timeout waiting for %q", want)
+        }
+    }
+
+    close(stopCh)
+    select {
+    case _, ok := <-ch:
+        assert.False(t, ok)
+    case <-time.After(time.Second):
+        t.Fatal("watch not stopped")
+    }
+}
+
+func TestWatchTree(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    dir := "/test_dir/services/"
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.WatchTree(dir, stopCh)
+    assert.Nil(t, err)
+
+    next := func() []*libkv.KVPair {
+        select {
+        case list := <-ch:
+            return list
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for tree")
+        }
+        return nil
+    }
+    assert.Len(t, next(), 0)
+    assert.Nil(t, kv.Put(dir+"1", []byte("value1"), nil))
+    assert.Len(t, next(), 1)
+    assert.Nil(t, kv.Put(dir+"2", []byte("value2"), nil))
+    assert.Len(t, next(), 2)
+    assert.Nil(t, kv.DeleteTree(dir))
+    assert.Len(t, next(), 0)
+}
+
+func TestAtomic(t *testing.T) {
+    dir := t.TempDir()
+    kv, err := New([]string{dir}, nil)
+    assert.Nil(t, err)
+    key := "/test_atomic"
+
+    ok, pair, err := kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    assert.NotZero(t, pair.LastIndex)
+    _, _, err = kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Equal(t, common.ErrKeyExists, err)
+
+    got, err := kv.Get(key)
+    assert.Nil(t, err)
+    assert.Equal(t, pair.LastIndex, got.LastIndex)
+
+    assert.Nil(t, kv.Put("/other", []byte("v"), nil))
+    ok, next, err := kv.AtomicPut(key, []byte("v2"), got, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    assert.Equal(t, got.LastIndex+2, next.LastIndex)
+    _, _, err = kv.AtomicPut(key, []byte("v3"), got, nil)
+    assert.Equal(t, common.ErrKeyModified, err)
+    _, err = kv.AtomicDelete(key, got)
+    assert.Equal(t, common.ErrKeyModified, err)
+
+    list, err := kv.List("")
+    assert.Nil(t, err)
+    assert.Len(t, list, 2)
+
+    // the revision survives a restart
+    kv.Close()
+    kv, err = New([]string{dir}, nil)
+    assert.Nil(t, err)
+    defer kv.Close()
+    assert.Nil(t, kv.Put("/other", []byte("v"), nil))
+    pair, err = kv.Get("/other")
+    assert.Nil(t, err)
+    assert.Equal(t, next.LastIndex+1, pair.LastIndex)
+
+    ok, err = kv.AtomicDelete(key, next)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    _, err = kv.AtomicDelete(key, next)
+    assert.Equal(t, common.ErrKeyNotFound, err)
+}
+
+func testLock(t *testing.T, l1, l2 libkv.Locker) {
+    lost, err := l1.Lock(nil)
+    assert.Nil(t, err)
+    assert.NotNil(t, lost)
+
+    // locking again releases the lock held so far
+    relockStop := make(chan struct{})
+    time.AfterFunc(time.Second, func() { close(relockStop) })
+    relocked, err := l1.Lock(relockStop)
+    assert.Nil(t, err)
+    if assert.NotNil(t, relocked) {
+        select {
+        case <-lost:
+        case <-time.After(time.Second):
+            t.Fatal("first hold not released")
+        }
+        lost = relocked
+    }
+
+    stopCh := make(chan struct{})
+    time.AfterFunc(time.Millisecond*200, func() { close(stopCh) })
+    ch, err := l2.Lock(stopCh)
+    assert.Nil(t, err)
+    assert.Nil(t, ch)
+
+    assert.Nil(t, l1.Unlock())
+    <-lost
+    assert.Equal(t, common.ErrLockNotHeld, l1.Unlock())
+
+    ch, err = l2.Lock(nil)
+    assert.Nil(t, err)
+    assert.NotNil(t, ch)
+    assert.Nil(t, l2.Unlock())
+}
+
+func TestLock(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+
+    l1, err := kv.NewLock("/test_lock", nil)
+    assert.Nil(t, err)
+    l2, err := kv.NewLock("/test_lock", nil)
+    assert.Nil(t, err)
+    testLock(t, l1, l2)
+
+    // without renewal the lock expires
+    renewCh := make(chan struct{})
+    close(renewCh)
+    l1, err = kv.NewLock("/test_lock", &libkv.LockOptions{TTL: time.Millisecond * 100, RenewLock: renewCh})
+    assert.Nil(t, err)
+    lost, err := l1.Lock(nil)
+    assert.Nil(t, err)
+    select {
+    case <-lost:
+    case <-time.After(time.Second):
+        t.Fatal("lock not lost after its ttl")
+    }
+    ch, err := l2.Lock(nil)
+    assert.Nil(t, err)
+    assert.NotNil(t, ch)
+    assert.Equal(t, common.ErrLockLost, l1.Unlock())
+    assert.Nil(t, l2.Unlock())
+}
+
+func TestSharedLock(t *testing.T) {
+    dir := t.TempDir()
+    opt := libkv.DefaultConfig()
+    opt.SharedLocks = true
+    kv, err := New([]string{dir}, opt)
+    assert.Nil(t, err)
+    defer kv.Close()
+
+    l1, err := kv.NewLock("/test_lock", &libkv.LockOptions{Value: []byte("owner")})
+    assert.Nil(t, err)
+    l2, err := NewSharedLock(dir, "/test_lock", nil)
+    assert.Nil(t, err)
+    testLock(t, l1, l2)
+}
+
+// receiveEvents reads n events from ch, formatted as "op key value (previous)".
+func receiveEvents(t *testing.T, ch <-chan *libkv.WatchEvent, n int) []string {
+    var events []string
+    for i := 0; i < n; i++ {
+        select {
+        case event := <-ch:
+            s := event.Op.String() + " " + event.Key
+            if event.Pair != nil {
+                s += " " + string(event.Pair.Value)
+            }
+            if event.Previous != nil {
+                s += " (" + string(event.Previous.Value) + ")"
+            }
+            events = append(events, s)
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for events")
+        }
+    }
+    return events
+}
+
+func TestWatchEvents(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.(libkv.EventWatcher).WatchEvents(stopCh, nil, key)
+    assert.Nil(t, err)
+    treeCh, err := kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, nil)
+    assert.Nil(t, err)
+
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    assert.Nil(t, kv.Delete(key))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("other"), &libkv.WriteOptions{TTL: time.Millisecond}))
+    time.Sleep(time.Millisecond * 10)
+    assert.Nil(t, kv.(*leveldbImpl).sweepExpired())
+
+    assert.Equal(t, []string{
+        "put /test_dir/node1 value1 (value0)",
+        "delete /test_dir/node1 (value1)",
+    }, receiveEvents(t, ch, 2))
+    assert.Equal(t, []string{
+        "put /test_dir/node1 value1 (value0)",
+        "delete /test_dir/node1 (value1)",
+        "put /test_dir/node2 other",
+        "expire /test_dir/node2 (other)",
+    }, receiveEvents(t, treeCh, 4))
+}
+
+func TestWatchTreeDeltas(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.(libkv.EventWatcher).WatchTreeDeltas("/test_dir/", stopCh)
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node3", []byte("value3"), nil))
+    assert.Nil(t, kv.Delete("/test_dir/node1"))
+
+    assert.Equal(t, []string{
+        "snapshot /test_dir/",
+        "put /test_dir/node3 value3",
+        "delete /test_dir/node1 (value1)",
+    }, receiveEvents(t, ch, 3))
+
+    tree := libkv.NewTree()
+    ch, err = kv.(libkv.EventWatcher).WatchTreeDeltas("/test_dir/", stopCh)
+    assert.Nil(t, err)
+    tree.Apply(<-ch)
+    assert.Len(t, tree.List(), 2)
+    assert.Equal(t, "value3", string(tree.Get("/test_dir/node3").Value))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value4"), nil))
+    tree.Apply(<-ch)
+    list, err := kv.List("/test_dir/")
+    assert.Nil(t, err)
+    assert.Equal(t, list, tree.List())
+    assert.Equal(t, list[0].LastIndex, tree.Revision())
+}
+
+func TestWatchResume(t *testing.T) {
+    dir := t.TempDir()
+    kv, err := New([]string{dir}, nil)
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    pair, err := kv.Get("/test_dir/node1")
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+    assert.Nil(t, kv.Delete("/test_dir/node1"))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    options := &libkv.WatchOptions{Revision: pair.LastIndex}
+    ch, err := kv.(libkv.EventWatcher).WatchEvents(stopCh, options, "/test_dir/node1")
+    assert.Nil(t, err)
+    assert.Equal(t, []string{"delete /test_dir/node1 (value1)"}, receiveEvents(t, ch, 1))
+    treeCh, err := kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, options)
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node3", []byte("value3"), nil))
+    assert.Equal(t, []string{
+        "put /test_dir/node2 value2",
+        "delete /test_dir/node1 (value1)",
+        "put /test_dir/node3 value3",
+    }, receiveEvents(t, treeCh, 3))
+
+    // the log survives a restart
+    kv.Close()
+    kv, err = New([]string{dir}, nil)
+    assert.Nil(t, err)
+    defer kv.Close()
+    treeCh, err = kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, options)
+    assert.Nil(t, err)
+    assert.Equal(t, []string{
+        "put /test_dir/node2 value2",
+        "delete /test_dir/node1 (value1)",
+        "put /test_dir/node3 value3",
+    }, receiveEvents(t, treeCh, 3))
+    pair, err = kv.Get("/test_dir/node3")
+    assert.Nil(t, err)
+    options = &libkv.WatchOptions{Revision: pair.LastIndex}
+    _, err = kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, options)
+    assert.Nil(t, err)
+
+    for i := 0; i < watch.HistorySize*2; i++ {
+        assert.Nil(t, kv.Put("/test_dir/node4", []byte("value4"), nil))
+    }
+    _, err = kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, options)
+    assert.Equal(t, common.ErrCompacted, err)
+}
+
+func TestWatchOverflow(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    errCh := make(chan error, 1)
+    ch, err := kv.(libkv.EventWatcher).WatchEvents(stopCh, &libkv.WatchOptions{Buffer: 1, Overflow: libkv.WatchDrop, Errors: errCh}, key)
+    assert.Nil(t, err)
+    for i := 1; i <= 3; i++ {
+        assert.Nil(t, kv.Put(key, []byte(fmt.Sprintf("value%d", i)), nil))
+    }
+    select {
+    case err = <-errCh:
+        assert.Equal(t, common.ErrWatchOverflow, err)
+    case <-time.After(time.Second):
+        t.Fatal("timeout waiting for overflow")
+    }
+    assert.Equal(t, []string{"put /test_dir/node1 value1 (value0)"}, receiveEvents(t, ch, 1))
+
+    // the pending changes of a key are merged, up to the last one
+    ch, err = kv.(libkv.EventWatcher).WatchEvents(stopCh, &libkv.WatchOptions{Overflow: libkv.WatchCoalesce}, key)
+    assert.Nil(t, err)
+    for i := 4; i <= 100; i++ {
+        assert.Nil(t, kv.Put(key, []byte(fmt.Sprintf("value%d", i)), nil))
+    }
+    previous, n := "value3", 0
+    for previous != "value100" {
+        select {
+        case event := <-ch:
+            assert.Equal(t, previous, string(event.Previous.Value))
+            previous = string(event.Pair.Value)
+            n++
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for events")
+        }
+    }
+    assert.True(t, n < 97)
+}
+
+func TestTxn(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    blob, version := "/test_dir/blob", "/test_dir/version"
+    assert.Nil(t, kv.Put(blob, []byte("value1"), nil))
+    pair, err := kv.Get(blob)
+    assert.Nil(t, err)
+
+    txn := &libkv.Txn{
+        Compare: []libkv.Compare{libkv.RevisionEquals(blob, pair.LastIndex), libkv.KeyExists(version, false)},
+        Then:    []libkv.TxnOp{libkv.OpPut(blob, []byte("value2"), nil), libkv.OpPut(version, []byte("2"), nil), libkv.OpGet(blob)},
+        Else:    []libkv.TxnOp{libkv.OpGet(blob)},
+    }
+    result, err := kv.(libkv.Transactor).Txn(txn)
+    assert.Nil(t, err)
+    assert.True(t, result.Succeeded)
+    assert.Len(t, result.Pairs, 3)
+    assert.Equal(t, "value2", string(result.Pairs[2].Value))
+    assert.Equal(t, result.Pairs[0].LastIndex, result.Pairs[2].LastIndex)
+    pair, err = kv.Get(version)
+    assert.Nil(t, err)
+    assert.Equal(t, "2", string(pair.Value))
+
+    result, err = kv.(libkv.Transactor).Txn(txn)
+    assert.Nil(t, err)
+    assert.False(t, result.Succeeded)
+    assert.Len(t, result.Pairs, 1)
+    assert.Equal(t, "value2", string(result.Pairs[0].Value))
+
+    result, err = kv.(libkv.Transactor).Txn(&libkv.Txn{
+        Compare: []libkv.Compare{libkv.ValueEquals(version, []byte("2"))},
+        Then:    []libkv.TxnOp{libkv.OpDelete(version), libkv.OpGet(version)},
+    })
+    assert.Nil(t, err)
+    assert.True(t, result.Succeeded)
+    assert.Equal(t, []*libkv.KVPair{nil, nil}, result.Pairs)
+    exists, err := kv.Exists(version)
+    assert.Nil(t, err)
+    assert.False(t, exists)
+}
+
+func TestWatchRevisionOfManyKeys(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    keys := []string{"/test_dir/node1", "/test_dir/node2", "/test_dir/node3"}
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    errCh := make(chan error, 1)
+    ch, err := kv.(libkv.EventWatcher).WatchEvents(stopCh, &libkv.WatchOptions{Errors: errCh}, keys...)
+    assert.Nil(t, err)
+    treeCh, err := kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, nil)
+    assert.Nil(t, err)
+    pairCh, err := kv.WatchMulti(stopCh, keys[:2]...)
+    assert.Nil(t, err)
+
+    // every change of a revision gets through the default buffer of one
+    txn := &libkv.Txn{}
+    for _, key := range keys {
+        txn.Then = append(txn.Then, libkv.OpPut(key, []byte("value"), nil))
+    }
+    _, err = kv.(libkv.Transactor).Txn(txn)
+    assert.Nil(t, err)
+    assert.Nil(t, kv.DeleteTree("/test_dir/"))
+
+    want := []string{
+        "put /test_dir/node1 value",
+        "put /test_dir/node2 value",
+        "put /test_dir/node3 value",
+        "delete /test_dir/node1 (value)",
+        "delete /test_dir/node2 (value)",
+        "delete /test_dir/node3 (value)",
+    }
+    assert.Equal(t, want, receiveEvents(t, ch, 6))
+    assert.Equal(t, want, receiveEvents(t, treeCh, 6))
+    for _, key := range []string{keys[0], keys[1], keys[0], keys[1]} {
+        select {
+        case pair := <-pairCh:
+            assert.Equal(t, key, pair.Key)
+        case <-time.After(time.Second):
+            t.Fatalf("timeout waiting for %s", key)
+        }
+    }
+    select {
+    case err = <-errCh:
+        t.Fatal(err)
+    default:
+    }
+}
@@ -0,0 +1,215 @@
+package leveldb
+
+import (
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/lock"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+const (
+    defaultLockTTL = 20 * time.Second
+    lockRetryDelay = 50 * time.Millisecond
+)
+
+// lockRecord is the state of a named lock, free once expired.
+type lockRecord struct {
+    token  string
+    expire int64
+    value  []byte
+}
+
+func (r *lockRecord) held(now time.Time) bool {
+    return r != nil && r.expire > now.UnixNano()
+}
+
+// lockTable keeps the lock records. update calls fn with the current record
+// of key, or nil, and stores the record it returns, deleting it on nil.
+type lockTable interface {
+    update(key string, fn func(cur *lockRecord) *lockRecord) error
+}
+
+// memLocks is a lockTable shared by the goroutines of this process.
+type memLocks struct {
+    mu      sync.Mutex
+    records map[string]*lockRecord
+}
+
+func (m *memLocks) update(key string, fn func(cur *lockRecord) *lockRecord) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    r := fn(m.records[key])
+    if r == nil {
+        delete(m.records, key)
+        return nil
+    }
+    if m.records == nil {
+        m.records = make(map[string]*lockRecord)
+    }
+    m.records[key] = r
+    return nil
+}
+
+type leveldbLock struct {
+    locks   lockTable
+    key     string
+    value   []byte
+    ttl     time.Duration
+    renewCh chan struct{}
+
+    mu    sync.Mutex
+    token string
+    done  chan struct{}
+}
+
+// NewSharedLock returns a lock on key shared with the storages opened on
+// path with Config.SharedLocks, for processes which do not open the storage.
+func NewSharedLock(path, key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    locks, err := newFileLocks(lockDir(path))
+    if err != nil {
+        return nil, err
+    }
+    return newLock(locks, key, options), nil
+}
+
+func lockDir(path string) string {
+    return filepath.Join(path, "locks")
+}
+
+func newLock(locks lockTable, key string, options *libkv.LockOptions) *leveldbLock {
+    l := &leveldbLock{
+        locks: locks,
+        key:   key,
+        ttl:   defaultLockTTL,
+    }
+    if options != nil {
+        l.value = options.Value
+        l.renewCh = options.RenewLock
+        if options.TTL > 0 {
+            l.ttl = options.TTL
+        }
+    }
+    return l
+}
+
+// The lock is lost once expired.
+func (l *leveldbLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.done != nil {
+        // locking again releases the lock held so far
+        if err := l.release(); err != nil && err != common.ErrLockLost {
+            return nil, err
+        }
+    }
+
+    token, err := lock.Token()
+    if err != nil {
+        return nil, err
+    }
+    for {
+        ok, err := l.set(token, true)
+        if err != nil {
+            return nil, err
+        }
+        if ok {
+            break
+        }
+        delay := lock.RetryDelay(lockRetryDelay)
+        select {
+        case <-stopChan:
+            return nil, nil
+        case <-time.After(delay):
+        }
+    }
+
+    l.token = token
+    l.done = make(chan struct{})
+    lostCh := make(chan struct{})
+    go l.holdLock(token, l.done, lostCh)
+    return lostCh, nil
+}
+
+// set takes or extends the lock for token, and reports whether it is held.
+func (l *leveldbLock) set(token string, acquire bool) (bool, error) {
+    ok := false
+    err := l.locks.update(l.key, func(cur *lockRecord) *lockRecord {
+        now := time.Now()
+        held := cur.held(now)
+        if held && cur.token != token {
+            return cur
+        }
+        if !held && !acquire {
+            // expired, drop the stale record instead of extending it
+            return nil
+        }
+        ok = true
+        return &lockRecord{
+            token:  token,
+            expire: now.Add(l.ttl).UnixNano(),
+            value:  l.value,
+        }
+    })
+    return ok, err
+}
+
+// holdLock extends the lock until RenewLock is closed, and closes lostCh
+// when an extension fails or the lock expires.
+func (l *leveldbLock) holdLock(token string, done, lostCh chan struct{}) {
+    defer close(lostCh)
+    deadline := time.Now().Add(l.ttl)
+    ticker := time.NewTicker(l.ttl / 3)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-done:
+            return
+        case <-l.renewCh:
+            select {
+            case <-time.After(time.Until(deadline)):
+            case <-done:
+            }
+            return
+        case <-ticker.C:
+            now := time.Now()
+            ok, err := l.set(token, false)
+            if err != nil || !ok {
+                return
+            }
+            deadline = now.Add(l.ttl)
+        }
+    }
+}
+
+func (l *leveldbLock) Unlock() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.done == nil {
+        return common.ErrLockNotHeld
+    }
+    return l.release()
+}
+
+// release stops renewing the lock and removes it, unless lost meanwhile.
+// The caller holds l.mu.
+func (l *leveldbLock) release() error {
+    close(l.done)
+    l.done = nil
+    held := false
+    err := l.locks.update(l.key, func(cur *lockRecord) *lockRecord {
+        if cur.held(time.Now()) && cur.token == l.token {
+            held = true
+            return nil
+        }
+        return cur
+    })
+    if err != nil {
+        return err
+    }
+    if !held {
+        return common.ErrLockLost
+    }
+    return nil
+}
@@ -0,0 +1,72 @@
+package leveldb
+
+import (
+    "bytes"
+    "encoding/binary"
+    "time"
+)
+
+// Values are stored behind a small header:
+//
+//     magic(2) | version(1) | expire(8) | revision(8) | value
+//
+// expire is in unix nanoseconds, 0 when the value never expires, and
+// revision the database revision the key was last modified at. Version 1
+// records have no revision, and values without the header come from older
+// versions and never expire.
+
+const (
+    recordVersion      = 2
+    recordHeaderSizeV1 = 11
+    recordHeaderSize   = 19
+)
+
+var recordMagic = []byte{0xfe, 0x6b}
+
+type record struct {
+    value    []byte
+    expire   int64
+    revision uint64
+}
+
+func newRecord(value []byte, ttl time.Duration, revision uint64) record {
+    r := record{value: value, revision: revision}
+    if ttl > 0 {
+        r.expire = time.Now().Add(ttl).UnixNano()
+    }
+    return r
+}
+
+func (r record) expired(now time.Time) bool {
+    return r.expire != 0 && r.expire <= now.UnixNano()
+}
+
+func (r record) encode() []byte {
+    b := make([]byte, recordHeaderSize+len(r.value))
+    copy(b, recordMagic)
+    b[2] = recordVersion
+    binary.BigEndian.PutUint64(b[3:], uint64(r.expire))
+    binary.BigEndian.PutUint64(b[11:], r.revision)
+    copy(b[recordHeaderSize:], r.value)
+    return b
+}
+
+func decodeRecord(b []byte) record {
+    if len(b) < recordHeaderSizeV1 || !bytes.HasPrefix(b, recordMagic) {
+        return record{value: b}
+    }
+    switch {
+    case b[2] == 1:
+        return record{
+            value:  b[recordHeaderSizeV1:],
+            expire: int64(binary.BigEndian.Uint64(b[3:])),
+        }
+    case b[2] == recordVersion && len(b) >= recordHeaderSize:
+        return record{
+            value:    b[recordHeaderSize:],
+            expire:   int64(binary.BigEndian.Uint64(b[3:])),
+            revision: binary.BigEndian.Uint64(b[11:]),
+        }
+    }
+    return record{value: b}
+}
@@ -0,0 +1,119 @@
+package leveldb
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
+    ldb "github.com/syndtr/goleveldb/leveldb"
+    "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The database revision is bumped by every write and persisted in the same
+// batch, under a reserved key past the keys clients use, along with the
+// changes of the revision, logged for the resuming watches. Reserved keys
+// are hidden from reads and listings, and refused by writes.
+var (
+    metaPrefix  = []byte("\xff\xfelibkv/")
+    revisionKey = []byte("\xff\xfelibkv/revision")
+    logStartKey = []byte("\xff\xfelibkv/logstart") // the revision the log was started at
+    logPrefix   = []byte("\xff\xfelibkv/log/")
+
+    errReservedKey = errors.New("leveldb keys prefixed by \\xff\\xfelibkv/ are reserved")
+)
+
+func isMetaKey(key []byte) bool {
+    return bytes.HasPrefix(key, metaPrefix)
+}
+
+func logKey(rev uint64) []byte {
+    return append(append([]byte(nil), logPrefix...), encodeUint(rev)...)
+}
+
+func encodeUint(v uint64) []byte {
+    var b [8]byte
+    binary.BigEndian.PutUint64(b[:], v)
+    return b[:]
+}
+
+// readUint reads the number under key, 0 when missing.
+func readUint(r ldb.Reader, key []byte) (uint64, error) {
+    val, err := r.Get(key, nil)
+    if err == ldb.ErrNotFound {
+        return 0, nil
+    }
+    if err != nil || len(val) != 8 {
+        return 0, err
+    }
+    return binary.BigEndian.Uint64(val), nil
+}
+
+// loadRevision reads the revision, starting the log there when the database
+// has none yet.
+func (s *leveldbImpl) loadRevision() error {
+    rev, err := readUint(s.db, revisionKey)
+    if err != nil {
+        return err
+    }
+    s.rev = rev
+    if _, err = s.db.Get(logStartKey, nil); err == ldb.ErrNotFound {
+        err = s.db.Put(logStartKey, encodeUint(rev), nil)
+    }
+    s.hub.Init(s.changes, rev, &s.mu)
+    return err
+}
+
+// changes reads the log after rev, from a snapshot.
+func (s *leveldbImpl) changes(rev uint64) ([]*libkv.WatchEvent, error) {
+    snap, err := s.db.GetSnapshot()
+    if err != nil {
+        return nil, err
+    }
+    defer snap.Release()
+    current, err := readUint(snap, revisionKey)
+    if err != nil {
+        return nil, err
+    }
+    start, err := readUint(snap, logStartKey)
+    if err != nil {
+        return nil, err
+    }
+    if rev < watch.Retained(start, current) {
+        return nil, common.ErrCompacted
+    }
+    it := snap.NewIterator(&util.Range{Start: logKey(rev + 1), Limit: util.BytesPrefix(logPrefix).Limit}, nil)
+    defer it.Release()
+    var events []*libkv.WatchEvent
+    for it.Next() {
+        logged, err := watch.DecodeEvents(binary.BigEndian.Uint64(it.Key()[len(logPrefix):]), it.Value())
+        if err != nil {
+            return nil, err
+        }
+        events = append(events, logged...)
+    }
+    return events, it.Error()
+}
+
+// commit writes batch at revision rev, which must be s.rev+1, and publishes
+// events tagged with it. The caller holds s.mu.
+func (s *leveldbImpl) commit(batch *ldb.Batch, rev uint64, events ...*libkv.WatchEvent) error {
+    for _, event := range events {
+        event.Revision = rev
+        if event.Pair != nil {
+            event.Pair.LastIndex = rev
+        }
+    }
+    batch.Put(revisionKey, encodeUint(rev))
+    batch.Put(logKey(rev), watch.EncodeEvents(events))
+    if rev > watch.HistorySize {
+        batch.Delete(logKey(rev - watch.HistorySize))
+    }
+    if err := s.db.Write(batch, nil); err != nil {
+        return err
+    }
+    s.rev = rev
+    s.hub.Notify(rev, events...)
+    return nil
+}
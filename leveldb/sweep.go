@@ -0,0 +1,111 @@
+package leveldb
+
+import (
+    "github.com/DGHeroin/libkv"
+    ldb "github.com/syndtr/goleveldb/leveldb"
+    "time"
+)
+
+const (
+    sweepInterval  = 10 * time.Second
+    sweepBatchSize = 256
+)
+
+// sweep periodically deletes expired records until the storage is closed.
+func (s *leveldbImpl) sweep() {
+    defer s.wg.Done()
+    ticker := time.NewTicker(sweepInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.done:
+            return
+        case <-ticker.C:
+            _ = s.sweepExpired()
+        }
+    }
+}
+
+func (s *leveldbImpl) sweepExpired() error {
+    var start []byte
+    for {
+        keys, next, err := s.expiredKeys(start)
+        if err != nil {
+            return err
+        }
+        if err = s.deleteExpired(keys); err != nil {
+            return err
+        }
+        if next == nil {
+            return nil
+        }
+        select {
+        case <-s.done:
+            return nil
+        default:
+        }
+        start = next
+    }
+}
+
+// expiredKeys scans from start for up to sweepBatchSize expired keys, and
+// returns where the next scan should resume, nil once done.
+func (s *leveldbImpl) expiredKeys(start []byte) ([][]byte, []byte, error) {
+    iter := s.db.NewIterator(nil, nil)
+    defer iter.Release()
+    var (
+        keys [][]byte
+        now  = time.Now()
+        ok   bool
+    )
+    if start == nil {
+        ok = iter.First()
+    } else {
+        ok = iter.Seek(start)
+    }
+    for ; ok; ok = iter.Next() {
+        if len(keys) == sweepBatchSize {
+            return keys, append([]byte(nil), iter.Key()...), nil
+        }
+        if !isMetaKey(iter.Key()) && decodeRecord(iter.Value()).expired(now) {
+            keys = append(keys, append([]byte(nil), iter.Key()...))
+        }
+    }
+    return keys, nil, iter.Error()
+}
+
+// deleteExpired deletes keys in one batch, skipping those rewritten since
+// they were found expired.
+func (s *leveldbImpl) deleteExpired(keys [][]byte) error {
+    if len(keys) == 0 {
+        return nil
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var (
+        batch   = new(ldb.Batch)
+        deleted []*libkv.WatchEvent
+        now     = time.Now()
+    )
+    for _, key := range keys {
+        val, err := s.db.Get(key, nil)
+        if err == ldb.ErrNotFound {
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        if r := decodeRecord(val); r.expired(now) {
+            batch.Delete(key)
+            deleted = append(deleted, &libkv.WatchEvent{
+                Op:       libkv.WatchExpire,
+                Key:      string(key),
+                Previous: &libkv.KVPair{Key: string(key), Value: r.value, LastIndex: r.revision},
+            })
+        }
+    }
+    if len(deleted) == 0 {
+        return nil
+    }
+    return s.commit(batch, s.rev+1, deleted...)
+}
@@ -0,0 +1,105 @@
+package leveldb
+
+import (
+    "context"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    ldb "github.com/syndtr/goleveldb/leveldb"
+    "time"
+)
+
+var _ libkv.Transactor = (*leveldbImpl)(nil)
+
+func (s *leveldbImpl) Txn(txn *libkv.Txn) (*libkv.TxnResult, error) {
+    return s.TxnContext(context.Background(), txn)
+}
+
+// TxnContext writes the operations of the branch in a single batch, at one
+// revision, holding s.mu from the compares on.
+func (s *leveldbImpl) TxnContext(ctx context.Context, txn *libkv.Txn) (*libkv.TxnResult, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    for _, ops := range [][]libkv.TxnOp{txn.Then, txn.Else} {
+        for _, op := range ops {
+            if op.Type == libkv.TxnPut && isMetaKey([]byte(op.Key)) {
+                return nil, errReservedKey
+            }
+        }
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    // the pairs written so far, nil once deleted, read before the database
+    pending := make(map[string]*libkv.KVPair)
+    read := func(key string) (*libkv.KVPair, error) {
+        if pair, ok := pending[key]; ok {
+            return pair, nil
+        }
+        r, err := s.get(key)
+        if err == common.ErrKeyNotFound {
+            return nil, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        return &libkv.KVPair{Key: key, Value: r.value, LastIndex: r.revision}, nil
+    }
+    result := &libkv.TxnResult{Succeeded: true}
+    for _, c := range txn.Compare {
+        pair, err := read(c.Key)
+        if err != nil {
+            return nil, err
+        }
+        if !c.Holds(pair) {
+            result.Succeeded = false
+            break
+        }
+    }
+    ops := txn.Then
+    if !result.Succeeded {
+        ops = txn.Else
+    }
+    var (
+        rev    = s.rev + 1
+        batch  = new(ldb.Batch)
+        events []*libkv.WatchEvent
+    )
+    for _, op := range ops {
+        previous, err := read(op.Key)
+        if err != nil {
+            return nil, err
+        }
+        switch op.Type {
+        case libkv.TxnPut:
+            ttl := time.Duration(0)
+            if op.Options != nil {
+                ttl = op.Options.TTL
+            }
+            pair := &libkv.KVPair{Key: op.Key, Value: append([]byte(nil), op.Value...), LastIndex: rev}
+            batch.Put([]byte(op.Key), newRecord(op.Value, ttl, rev).encode())
+            events = append(events, &libkv.WatchEvent{
+                Op:       libkv.WatchPut,
+                Key:      op.Key,
+                Pair:     &libkv.KVPair{Key: op.Key, Value: pair.Value},
+                Previous: previous,
+            })
+            pending[op.Key] = pair
+            result.Pairs = append(result.Pairs, pair)
+        case libkv.TxnDelete:
+            if previous != nil && !isMetaKey([]byte(op.Key)) {
+                batch.Delete([]byte(op.Key))
+                events = append(events, &libkv.WatchEvent{Op: libkv.WatchDelete, Key: op.Key, Previous: previous})
+            }
+            pending[op.Key] = nil
+            result.Pairs = append(result.Pairs, nil)
+        default:
+            result.Pairs = append(result.Pairs, previous)
+        }
+    }
+    if len(events) > 0 {
+        if err := s.commit(batch, rev, events...); err != nil {
+            return nil, err
+        }
+    }
+    return result, nil
+}
@@ -1,6 +1,9 @@
 package libkv
 
-import "testing"
+import (
+    "context"
+    "testing"
+)
 
 func TestNewStorage(t *testing.T) {
     AddStorage("testStorage", nil)
@@ -9,3 +12,57 @@ func TestNewStorage(t *testing.T) {
 func TestAddStorage(t *testing.T) {
 
 }
+
+type getOnlyStorage struct {
+    Storage
+    calls int
+}
+
+func (s *getOnlyStorage) Get(key string) (*KVPair, error) {
+    s.calls++
+    return &KVPair{Key: key}, nil
+}
+
+func TestWithContext(t *testing.T) {
+    s := &getOnlyStorage{}
+    sc := WithContext(s)
+    if WithContext(sc) != sc {
+        t.Fatal("StorageContext wrapped twice")
+    }
+    pair, err := sc.GetContext(context.Background(), "key")
+    if err != nil || pair.Key != "key" || s.calls != 1 {
+        t.Fatalf("unexpected result %v %v %d", pair, err, s.calls)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if _, err = sc.GetContext(ctx, "key"); err != context.Canceled {
+        t.Fatalf("expected context.Canceled, got %v", err)
+    }
+    if s.calls != 1 {
+        t.Fatal("storage called with a cancelled context")
+    }
+}
+
+func TestTree(t *testing.T) {
+    tree := NewTree()
+    tree.Apply(&WatchEvent{Op: WatchSnapshot, Revision: 3, Snapshot: []*KVPair{
+        {Key: "/d/b", Value: []byte("b"), LastIndex: 2},
+        {Key: "/d/a", Value: []byte("a"), LastIndex: 3},
+    }})
+    tree.Apply(&WatchEvent{Op: WatchPut, Key: "/d/c", Pair: &KVPair{Key: "/d/c", Value: []byte("c"), LastIndex: 4}, Revision: 4})
+    tree.Apply(&WatchEvent{Op: WatchDelete, Key: "/d/a", Revision: 5})
+    tree.Apply(&WatchEvent{Op: WatchPut, Key: "/d/b", Pair: &KVPair{Key: "/d/b", Value: []byte("b2"), LastIndex: 6}, Revision: 6})
+
+    var got string
+    for _, pair := range tree.List() {
+        got += pair.Key + "=" + string(pair.Value) + " "
+    }
+    if got != "/d/b=b2 /d/c=c " || tree.Revision() != 6 || tree.Get("/d/a") != nil {
+        t.Fatalf("unexpected tree %q at %d", got, tree.Revision())
+    }
+
+    tree.Apply(&WatchEvent{Op: WatchSnapshot, Revision: 7})
+    if tree.Len() != 0 || tree.Revision() != 7 {
+        t.Fatal("snapshot did not replace the tree")
+    }
+}
@@ -0,0 +1,17 @@
+package memory
+
+import (
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/leveldb"
+)
+
+func init() {
+    libkv.AddStorage("memory", New)
+}
+
+// New returns a storage kept in memory, endpoints are ignored. It is the
+// leveldb storage on top of an in-memory store, so it behaves the same for
+// TTL, watches, locks, atomic operations and revisions.
+func New(endpoints []string, opt *libkv.Config) (libkv.Storage, error) {
+    return leveldb.NewMemory(opt)
+}
@@ -0,0 +1,77 @@
+package memory
+
+import (
+    "fmt"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/stretchr/testify/assert"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestNew(t *testing.T) {
+    kv, err := libkv.NewStorage("memory", nil, nil)
+    assert.Nil(t, err)
+    defer kv.Close()
+
+    key := "/test_dir/node1"
+    ch, err := kv.Watch(key, nil)
+    assert.Nil(t, err)
+
+    ok, pair, err := kv.AtomicPut(key, []byte("value1"), nil, &libkv.WriteOptions{TTL: time.Millisecond * 50})
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    select {
+    case got := <-ch:
+        assert.Equal(t, pair.LastIndex, got.LastIndex)
+        assert.Equal(t, "value1", string(got.Value))
+    case <-time.After(time.Second):
+        t.Fatal("timeout waiting for watch")
+    }
+
+    time.Sleep(time.Millisecond * 100)
+    _, err = kv.Get(key)
+    assert.Equal(t, common.ErrKeyNotFound, err)
+
+    l, err := kv.NewLock(key, nil)
+    assert.Nil(t, err)
+    _, err = l.Lock(nil)
+    assert.Nil(t, err)
+    assert.Nil(t, l.Unlock())
+}
+
+func TestConcurrentAtomicPut(t *testing.T) {
+    kv, err := New(nil, nil)
+    assert.Nil(t, err)
+    defer kv.Close()
+
+    key := "/counter"
+    _, _, err = kv.AtomicPut(key, []byte("0"), nil, nil)
+    assert.Nil(t, err)
+
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for n := 0; n < 50; {
+                pair, err := kv.Get(key)
+                assert.Nil(t, err)
+                var v int
+                fmt.Sscan(string(pair.Value), &v)
+                _, _, err = kv.AtomicPut(key, []byte(fmt.Sprint(v+1)), pair, nil)
+                if err == common.ErrKeyModified {
+                    continue
+                }
+                assert.Nil(t, err)
+                n++
+            }
+        }()
+    }
+    wg.Wait()
+
+    pair, err := kv.Get(key)
+    assert.Nil(t, err)
+    assert.Equal(t, "400", string(pair.Value))
+}
@@ -0,0 +1,450 @@
+package redis
+
+import (
+    "context"
+    "fmt"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
+    rdb "github.com/go-redis/redis/v8"
+    "strings"
+    "sync"
+)
+
+// Keyspace notifications name the key in the channel and the command in the
+// payload, e.g. "hset" on "__keyspace@0__:/a". They cover every client, and
+// deletes and expirations too, but are only sent once enabled through
+// notify-keyspace-events. Expired events fire when redis removes the key,
+// which may lag behind its TTL.
+
+// keyspaceFlags are the notify-keyspace-events classes the watches need:
+// keyspace channels, generic commands, strings, hashes, expired and evicted.
+const keyspaceFlags = "Kg$hxe"
+
+// enableKeyspaceEvents adds the missing keyspaceFlags to notify-keyspace-events
+// on every master.
+func (r *redisImpl) enableKeyspaceEvents(ctx context.Context) error {
+    return r.forEachMaster(ctx, func(ctx context.Context, c rdb.UniversalClient) error {
+        res, err := c.ConfigGet(ctx, "notify-keyspace-events").Result()
+        if err != nil {
+            return fmt.Errorf("redis notify-keyspace-events unavailable: %w", convertError(err))
+        }
+        flags := ""
+        if len(res) == 2 {
+            flags, _ = res[1].(string)
+        }
+        missing := missingKeyspaceFlags(flags)
+        if missing == "" {
+            return nil
+        }
+        if err = c.ConfigSet(ctx, "notify-keyspace-events", flags+missing).Err(); err != nil {
+            return fmt.Errorf("redis notify-keyspace-events lacks %q: %w", missing, convertError(err))
+        }
+        return nil
+    })
+}
+
+func missingKeyspaceFlags(flags string) string {
+    missing := ""
+    for _, f := range keyspaceFlags {
+        // A is an alias of every class but the keyspace and keyevent ones
+        if strings.ContainsRune(flags, f) || (f != 'K' && strings.ContainsRune(flags, 'A')) {
+            continue
+        }
+        missing += string(f)
+    }
+    return missing
+}
+
+func (r *redisImpl) keyspaceChannel(key string) string {
+    return fmt.Sprintf("__keyspace@%d__:%s", r.db, key)
+}
+
+// deletedPrefix names the channels the deletes are published on, the writes
+// being published on the key itself.
+const deletedPrefix = "__libkv_deleted__:"
+
+// publishDeleted tells the watches not following keyspace notifications
+// that keys were deleted.
+func (r *redisImpl) publishDeleted(ctx context.Context, c rdb.Cmdable, keys ...string) error {
+    if len(keys) == 0 {
+        return nil
+    }
+    pipe := c.Pipeline()
+    for _, key := range keys {
+        pipe.Publish(ctx, deletedPrefix+key, "")
+    }
+    _, err := pipe.Exec(ctx)
+    return convertError(err)
+}
+
+// missed reports err to the event watches, for a change they were not
+// notified of.
+func (r *redisImpl) missed(err error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for sink := range r.sinks {
+        sink.Error(err)
+    }
+}
+
+func (r *redisImpl) addSink(sink *watch.Sink) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.sinks == nil {
+        r.sinks = make(map[*watch.Sink]struct{})
+    }
+    r.sinks[sink] = struct{}{}
+}
+
+func (r *redisImpl) removeSink(sink *watch.Sink) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    delete(r.sinks, sink)
+}
+
+func isDeleted(channel string) bool {
+    return strings.HasPrefix(channel, deletedPrefix)
+}
+
+// escapePattern escapes the glob characters of s in a redis pattern.
+func escapePattern(s string) string {
+    var b strings.Builder
+    for _, c := range s {
+        if strings.ContainsRune(`*?[]\`, c) {
+            b.WriteByte('\\')
+        }
+        b.WriteRune(c)
+    }
+    return b.String()
+}
+
+// errResubscribed is reported once a lost subscription is restored, the
+// changes made meanwhile are not notified.
+var errResubscribed = fmt.Errorf("%w: redis subscription restored, changes may have been missed", common.ErrUnreachable)
+
+// subscription merges the subscriptions of every master, where keyspace
+// notifications stay on the node holding the key. Published messages reach
+// the whole cluster, so they are followed on a single node. The client
+// subscribes again on its own after a lost connection, which is signalled
+// on restored; msgs is closed along with the client.
+type subscription struct {
+    mu       sync.Mutex
+    pubsubs  []*rdb.PubSub
+    msgs     chan *rdb.Message
+    restored chan struct{}
+    quit     chan struct{}
+    wg       sync.WaitGroup
+}
+
+// subscribe follows the keys matching patterns, through keyspace
+// notifications or the messages published by the writes and deletes.
+func (r *redisImpl) subscribe(ctx context.Context, patterns ...string) (*subscription, error) {
+    sub := &subscription{
+        msgs:     make(chan *rdb.Message),
+        restored: make(chan struct{}, 1),
+        quit:     make(chan struct{}),
+    }
+    forEach := func(ctx context.Context, fn func(ctx context.Context, c rdb.UniversalClient) error) error {
+        return fn(ctx, r.client)
+    }
+    if r.keyspace {
+        channels := make([]string, 0, len(patterns))
+        for _, pattern := range patterns {
+            channels = append(channels, r.keyspaceChannel(pattern))
+        }
+        patterns = channels
+        forEach = r.forEachMaster
+    } else {
+        channels := append([]string(nil), patterns...)
+        for _, pattern := range patterns {
+            channels = append(channels, deletedPrefix+pattern)
+        }
+        patterns = channels
+    }
+    err := forEach(ctx, func(ctx context.Context, c rdb.UniversalClient) error {
+        ps := c.PSubscribe(ctx, patterns...)
+        sub.mu.Lock()
+        sub.pubsubs = append(sub.pubsubs, ps)
+        sub.mu.Unlock()
+        // wait for the confirmations, so no change slips past the initial read
+        for range patterns {
+            if _, err := ps.Receive(ctx); err != nil {
+                return convertError(err)
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        sub.Close()
+        return nil, err
+    }
+    for _, ps := range sub.pubsubs {
+        sub.wg.Add(1)
+        go func(ch <-chan interface{}) {
+            defer sub.wg.Done()
+            for msg := range ch {
+                switch msg := msg.(type) {
+                case *rdb.Subscription:
+                    // the confirmations are read already, these follow a reconnection
+                    select {
+                    case sub.restored <- struct{}{}:
+                    default:
+                    }
+                case *rdb.Message:
+                    if isDeleted(msg.Channel) && !isDeleted(msg.Pattern) {
+                        // matched by the pattern of a key as well, as "*" does
+                        continue
+                    }
+                    select {
+                    case sub.msgs <- msg:
+                    case <-sub.quit:
+                        return
+                    }
+                }
+            }
+        }(ps.ChannelWithSubscriptions(ctx, 100))
+    }
+    go func() {
+        sub.wg.Wait()
+        close(sub.msgs)
+    }()
+    return sub, nil
+}
+
+func (sub *subscription) Close() {
+    close(sub.quit)
+    for _, ps := range sub.pubsubs {
+        _ = ps.Close()
+    }
+    sub.wg.Wait()
+}
+
+// event returns the change notified by msg, nil when nothing visible
+// changed. The previous values and the revisions of the removals are
+// unknown. A published write carries its value, the key is read for its
+// revision, unknown once written again or deleted since.
+func (r *redisImpl) event(ctx context.Context, msg *rdb.Message) (*libkv.WatchEvent, error) {
+    ctx, cancel := context.WithTimeout(ctx, r.timeout)
+    defer cancel()
+    if !r.keyspace {
+        if isDeleted(msg.Channel) {
+            return &libkv.WatchEvent{Op: libkv.WatchDelete, Key: strings.TrimPrefix(msg.Channel, deletedPrefix)}, nil
+        }
+        pair, err := r.read(ctx, msg.Channel)
+        switch {
+        case err == common.ErrKeyNotFound || (err == nil && string(pair.Value) != msg.Payload):
+            pair = &libkv.KVPair{Key: msg.Channel, Value: []byte(msg.Payload)}
+        case err != nil:
+            return nil, err
+        }
+        return &libkv.WatchEvent{Op: libkv.WatchPut, Key: pair.Key, Pair: pair, Revision: pair.LastIndex}, nil
+    }
+    event := &libkv.WatchEvent{
+        Op:  libkv.WatchPut,
+        Key: strings.TrimPrefix(msg.Channel, r.keyspaceChannel("")),
+    }
+    switch msg.Payload {
+    case "expire", "persist":
+        return nil, nil
+    case "expired":
+        event.Op = libkv.WatchExpire
+    case "del", "evicted", "rename_from":
+        event.Op = libkv.WatchDelete
+    }
+    pair, err := r.read(ctx, event.Key)
+    switch {
+    case err == common.ErrKeyNotFound:
+        // a write removing the key is followed by its own del event
+        if event.Op == libkv.WatchPut {
+            return nil, nil
+        }
+        return event, nil
+    case err != nil:
+        return nil, err
+    case event.Op != libkv.WatchPut:
+        // written again since, the write event follows
+        return nil, nil
+    }
+    event.Pair = pair
+    event.Revision = pair.LastIndex
+    return event, nil
+}
+
+func (r *redisImpl) watchKeyspace(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    patterns := make([]string, 0, len(keys))
+    for _, key := range keys {
+        patterns = append(patterns, escapePattern(key))
+    }
+    sub, err := r.subscribe(ctx, patterns...)
+    if err != nil {
+        return nil, err
+    }
+    watchCh := make(chan *libkv.KVPair)
+    go func() {
+        defer close(watchCh)
+        defer sub.Close()
+        send := func(pair *libkv.KVPair) bool {
+            select {
+            case watchCh <- pair:
+                return true
+            case <-stopCh:
+            case <-ctx.Done():
+            }
+            return false
+        }
+        for _, key := range keys {
+            readCtx, cancel := context.WithTimeout(ctx, r.timeout)
+            pair, err := r.read(readCtx, key)
+            cancel()
+            if err != nil {
+                continue
+            }
+            if !send(pair) {
+                return
+            }
+        }
+        for {
+            select {
+            case <-stopCh:
+                return
+            case <-ctx.Done():
+                return
+            case <-sub.restored:
+            case msg, ok := <-sub.msgs:
+                if !ok {
+                    return
+                }
+                if event, _ := r.event(ctx, msg); event != nil && !send(watch.Pair(event)) {
+                    return
+                }
+            }
+        }
+    }()
+    return watchCh, nil
+}
+
+func (r *redisImpl) watchTreeKeyspace(ctx context.Context, stopCh <-chan struct{}, dir string) (<-chan []*libkv.KVPair, error) {
+    sub, err := r.subscribe(ctx, escapePattern(dir)+"*")
+    if err != nil {
+        return nil, err
+    }
+    watchCh := make(chan []*libkv.KVPair)
+    go func() {
+        defer close(watchCh)
+        defer sub.Close()
+        send := func() bool {
+            listCtx, cancel := context.WithTimeout(ctx, r.timeout)
+            list, err := r.ListContext(listCtx, dir)
+            cancel()
+            if err != nil {
+                return true
+            }
+            select {
+            case watchCh <- list:
+                return true
+            case <-stopCh:
+            case <-ctx.Done():
+            }
+            return false
+        }
+        if !send() {
+            return
+        }
+        for {
+            select {
+            case <-stopCh:
+                return
+            case <-ctx.Done():
+                return
+            case <-sub.restored:
+                // the tree is listed again, in case changes were missed
+                if !send() {
+                    return
+                }
+            case msg, ok := <-sub.msgs:
+                if !ok {
+                    return
+                }
+                if event, _ := r.event(ctx, msg); event != nil && !send() {
+                    return
+                }
+            }
+        }
+    }()
+    return watchCh, nil
+}
+
+// watchEvents sends the result of snapshot when given, then the changes of
+// the keys matching patterns through a sink set up by options. The snapshot
+// is read once subscribed, the changes it already holds are sent again with
+// the same values. It is read again once a lost subscription is restored,
+// the other watches report errResubscribed. The reads made for the watch
+// are bound by the timeout, ctx bounding the watch itself.
+func (r *redisImpl) watchEvents(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, snapshot func(ctx context.Context) (*libkv.WatchEvent, error), patterns ...string) (<-chan *libkv.WatchEvent, error) {
+    sub, err := r.subscribe(ctx, patterns...)
+    if err != nil {
+        return nil, err
+    }
+    read := func() (*libkv.WatchEvent, error) {
+        ctx, cancel := context.WithTimeout(ctx, r.timeout)
+        defer cancel()
+        return snapshot(ctx)
+    }
+    var initial *libkv.WatchEvent
+    if snapshot != nil {
+        if initial, err = read(); err != nil {
+            sub.Close()
+            return nil, err
+        }
+    }
+    stop, cancel := watch.Stop(ctx, stopCh, nil)
+    sink := watch.NewSink(stop, options)
+    r.addSink(sink)
+    go func() {
+        defer sink.Close()
+        defer r.removeSink(sink)
+        defer cancel()
+        defer sub.Close()
+        if initial != nil && !sink.Send(initial) {
+            return
+        }
+        for {
+            select {
+            case <-stop:
+                return
+            case <-sub.restored:
+                sink.Error(errResubscribed)
+                if snapshot == nil {
+                    continue
+                }
+                for {
+                    event, err := read()
+                    if err == nil {
+                        if !sink.Send(event) {
+                            return
+                        }
+                        break
+                    }
+                    if !sink.Retry(err) {
+                        return
+                    }
+                }
+            case msg, ok := <-sub.msgs:
+                if !ok {
+                    sink.Error(common.ErrUnreachable)
+                    return
+                }
+                event, err := r.event(ctx, msg)
+                if err != nil {
+                    sink.Error(err)
+                    continue
+                }
+                if event != nil && !sink.Send(event) {
+                    return
+                }
+            }
+        }
+    }()
+    return sink.C(), nil
+}
@@ -0,0 +1,238 @@
+package redis
+
+import (
+    "context"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/lock"
+    rdb "github.com/go-redis/redis/v8"
+    "sync"
+    "time"
+)
+
+const (
+    defaultLockTTL   = 20 * time.Second
+    lockRetryDelay   = 100 * time.Millisecond
+    clockDriftFactor = 0.01
+)
+
+// A lock is a hash holding the token of its owner along with the value of
+// its options, read back by Get:
+//
+//     key => { value: <data>, token: <token> }
+var (
+    // ARGV: token, value, ttl in milliseconds
+    lockScript = rdb.NewScript(`
+if redis.call("exists", KEYS[1]) == 1 then
+    return 0
+end
+redis.call("hset", KEYS[1], "value", ARGV[2], "token", ARGV[1])
+redis.call("pexpire", KEYS[1], ARGV[3])
+return 1`)
+    unlockScript = rdb.NewScript(`
+if redis.call("type", KEYS[1])["ok"] == "hash" and redis.call("hget", KEYS[1], "token") == ARGV[1] then
+    return redis.call("del", KEYS[1])
+end
+return 0`)
+    renewScript = rdb.NewScript(`
+if redis.call("type", KEYS[1])["ok"] == "hash" and redis.call("hget", KEYS[1], "token") == ARGV[1] then
+    return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+// redisLock is a lock on a single instance, or a Redlock when it spans
+// several independent instances: it is held once a majority of them agree.
+type redisLock struct {
+    clients []rdb.UniversalClient
+    key     string
+    value   []byte
+    ttl     time.Duration
+    renewCh chan struct{}
+    timeout time.Duration
+
+    mu    sync.Mutex
+    token string
+    done  chan struct{}
+}
+
+func (r *redisImpl) newLock(key string, options *libkv.LockOptions) *redisLock {
+    l := &redisLock{
+        clients: r.lockClients,
+        key:     key,
+        ttl:     defaultLockTTL,
+        timeout: r.timeout,
+    }
+    if options != nil {
+        l.value = options.Value
+        l.renewCh = options.RenewLock
+        if options.TTL > 0 {
+            l.ttl = options.TTL
+        }
+    }
+    return l
+}
+
+// The lock is lost once it can no longer be renewed.
+func (l *redisLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.done != nil {
+        // locking again releases the lock held so far
+        if _, err := l.stop(); err != nil {
+            return nil, err
+        }
+    }
+
+    token, err := lock.Token()
+    if err != nil {
+        return nil, err
+    }
+    var deadline time.Time
+    for {
+        var ok bool
+        ok, deadline, err = l.acquire(token)
+        if err != nil {
+            return nil, err
+        }
+        if ok {
+            break
+        }
+        delay := lock.RetryDelay(lockRetryDelay)
+        select {
+        case <-stopChan:
+            return nil, nil
+        case <-time.After(delay):
+        }
+    }
+
+    l.token = token
+    l.done = make(chan struct{})
+    lostCh := make(chan struct{})
+    go l.holdLock(token, deadline, l.done, lostCh)
+    return lostCh, nil
+}
+
+// holdLock extends the lock until RenewLock is closed, and closes lostCh
+// when an extension fails or the lock expires.
+func (l *redisLock) holdLock(token string, deadline time.Time, done, lostCh chan struct{}) {
+    defer close(lostCh)
+    ticker := time.NewTicker(l.ttl / 3)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-done:
+            return
+        case <-l.renewCh:
+            select {
+            case <-time.After(time.Until(deadline)):
+            case <-done:
+            }
+            return
+        case <-ticker.C:
+            var ok bool
+            ok, deadline = l.extend(token)
+            if !ok {
+                return
+            }
+        }
+    }
+}
+
+// acquire tries to set the lock on every instance and reports whether a
+// majority accepted it in time, together with the lock validity deadline.
+func (l *redisLock) acquire(token string) (bool, time.Time, error) {
+    start := time.Now()
+    var (
+        n       int
+        failed  int
+        lastErr error
+    )
+    for _, c := range l.clients {
+        ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+        v, err := lockScript.Run(ctx, c, []string{l.key}, token, l.value, l.ttl.Milliseconds()).Int()
+        cancel()
+        if err != nil {
+            failed++
+            lastErr = err
+            continue
+        }
+        n += v
+    }
+    deadline := l.deadline(start)
+    if n >= l.quorum() && time.Now().Before(deadline) {
+        return true, deadline, nil
+    }
+    l.release(token)
+    if failed > len(l.clients)-l.quorum() {
+        return false, deadline, convertError(lastErr)
+    }
+    return false, deadline, nil
+}
+
+func (l *redisLock) extend(token string) (bool, time.Time) {
+    start := time.Now()
+    n := 0
+    for _, c := range l.clients {
+        ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+        v, err := renewScript.Run(ctx, c, []string{l.key}, token, l.ttl.Milliseconds()).Int()
+        cancel()
+        if err == nil && v == 1 {
+            n++
+        }
+    }
+    deadline := l.deadline(start)
+    return n >= l.quorum() && time.Now().Before(deadline), deadline
+}
+
+func (l *redisLock) release(token string) (int, error) {
+    var (
+        n       int
+        lastErr error
+    )
+    for _, c := range l.clients {
+        ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+        v, err := unlockScript.Run(ctx, c, []string{l.key}, token).Int()
+        cancel()
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        n += v
+    }
+    return n, convertError(lastErr)
+}
+
+func (l *redisLock) quorum() int {
+    return len(l.clients)/2 + 1
+}
+
+// deadline is the end of the lock validity, minus the allowed clock drift.
+func (l *redisLock) deadline(start time.Time) time.Time {
+    drift := time.Duration(float64(l.ttl)*clockDriftFactor) + 2*time.Millisecond
+    return start.Add(l.ttl - drift)
+}
+
+func (l *redisLock) Unlock() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.done == nil {
+        return common.ErrLockNotHeld
+    }
+    n, err := l.stop()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return common.ErrLockLost
+    }
+    return nil
+}
+
+// stop ends the renewal of the lock held and releases it, returning the
+// number of instances it was released on. The caller holds l.mu.
+func (l *redisLock) stop() (int, error) {
+    close(l.done)
+    l.done = nil
+    return l.release(l.token)
+}
@@ -2,10 +2,15 @@ package redis
 
 import (
     "context"
+    "errors"
     "fmt"
     "github.com/DGHeroin/libkv"
     "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
     rdb "github.com/go-redis/redis/v8"
+    "net"
+    "strconv"
+    "sync"
     "time"
 )
 
@@ -16,68 +21,139 @@ func New(endpoints []string, opt *libkv.Config) (libkv.Storage, error) {
     if opt == nil {
         opt = libkv.DefaultConfig()
     }
+    if len(endpoints) == 0 {
+        return nil, errors.New("redis endpoints unspecified")
+    }
+    if opt.Redlock && (opt.Cluster || opt.MasterName != "") {
+        return nil, errors.New("redis redlock needs independent endpoints")
+    }
+    r := newStorage(newClient(endpoints, opt), opt)
+    if opt.Redlock {
+        for _, addr := range endpoints[1:] {
+            r.lockClients = append(r.lockClients, rdb.NewClient(nodeOptions(addr, opt)))
+        }
+    }
+    err := r.client.Ping(context.Background()).Err()
+    if err == nil && r.keyspace {
+        err = r.enableKeyspaceEvents(context.Background())
+    }
+    return r, convertError(err)
+}
+
+func newStorage(client rdb.UniversalClient, opt *libkv.Config) *redisImpl {
     r := &redisImpl{
-        timeout: opt.ConnectionTimeout,
+        client:      client,
+        lockClients: []rdb.UniversalClient{client},
+        timeout:     opt.ConnectionTimeout,
+        keyspace:    opt.KeyspaceEvents,
+        db:          opt.DB,
+    }
+    if _, ok := client.(*rdb.ClusterClient); ok {
+        r.db = 0
+    }
+    return r
+}
+
+// newClient picks the client of the deployment: a cluster, a master
+// monitored by sentinels or a single node.
+func newClient(endpoints []string, opt *libkv.Config) rdb.UniversalClient {
+    switch {
+    case opt.Cluster:
+        return rdb.NewClusterClient(&rdb.ClusterOptions{
+            Addrs:     endpoints,
+            Username:  opt.Username,
+            Password:  opt.Password,
+            TLSConfig: opt.TLS,
+        })
+    case opt.MasterName != "":
+        return rdb.NewFailoverClient(&rdb.FailoverOptions{
+            MasterName:    opt.MasterName,
+            SentinelAddrs: endpoints,
+            Username:      opt.Username,
+            Password:      opt.Password,
+            DB:            opt.DB,
+            TLSConfig:     opt.TLS,
+        })
     }
-    cli := rdb.NewClient(&rdb.Options{
+    return rdb.NewClient(nodeOptions(endpoints[0], opt))
+}
+
+func nodeOptions(addr string, opt *libkv.Config) *rdb.Options {
+    return &rdb.Options{
         Network:   "",
-        Addr:      endpoints[0],
+        Addr:      addr,
         Username:  opt.Username,
-        Password:  opt.Username,
+        Password:  opt.Password,
         DB:        opt.DB,
         TLSConfig: opt.TLS,
-    })
-    r.client = cli
-    err := cli.Ping(context.Background()).Err()
-    return r, err
+    }
 }
 
+var _ libkv.StorageContext = (*redisImpl)(nil)
+var _ libkv.EventWatcher = (*redisImpl)(nil)
+
 type redisImpl struct {
-    client  *rdb.Client
-    timeout time.Duration
+    client      rdb.UniversalClient
+    lockClients []rdb.UniversalClient
+    timeout     time.Duration
+    keyspace    bool // watches follow keyspace notifications
+    db          int
+    mu          sync.Mutex
+    sinks       map[*watch.Sink]struct{} // the running event watches
+}
+
+func (r *redisImpl) withTimeout() (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.Background(), r.timeout)
 }
 
 func (r *redisImpl) Put(key string, value []byte, options *libkv.WriteOptions) error {
-    ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+    ctx, cancel := r.withTimeout()
     defer cancel()
-    expiration := time.Duration(0)
-    if options != nil {
-        expiration = options.TTL
-    }
-    err := r.client.Set(ctx, key, value, expiration).Err()
+    return r.PutContext(ctx, key, value, options)
+}
+
+func (r *redisImpl) PutContext(ctx context.Context, key string, value []byte, options *libkv.WriteOptions) error {
+    _, err := r.write(ctx, key, value, options, writeAlways)
     if err != nil {
         return err
     }
-    return r.client.Publish(ctx, key, value).Err()
+    return convertError(r.client.Publish(ctx, key, value).Err())
 }
 
 func (r *redisImpl) Get(key string) (*libkv.KVPair, error) {
-    ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+    ctx, cancel := r.withTimeout()
     defer cancel()
-    cmd := r.client.Get(ctx, key)
-    if cmd.Err() != nil {
-        return nil, cmd.Err()
-    }
-    data, err := cmd.Bytes()
-    return &libkv.KVPair{
-        Key:       key,
-        Value:     data,
-        LastIndex: 0,
-    }, err
+    return r.GetContext(ctx, key)
+}
+
+func (r *redisImpl) GetContext(ctx context.Context, key string) (*libkv.KVPair, error) {
+    return r.read(ctx, key)
 }
 
 func (r *redisImpl) Delete(key string) error {
-    ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+    ctx, cancel := r.withTimeout()
     defer cancel()
-    return r.client.Del(ctx, key).Err()
+    return r.DeleteContext(ctx, key)
+}
+
+func (r *redisImpl) DeleteContext(ctx context.Context, key string) error {
+    n, err := r.client.Del(ctx, key).Result()
+    if err != nil || n == 0 {
+        return convertError(err)
+    }
+    return r.publishDeleted(ctx, r.client, key)
 }
 
 func (r *redisImpl) Exists(key string) (bool, error) {
-    ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+    ctx, cancel := r.withTimeout()
     defer cancel()
+    return r.ExistsContext(ctx, key)
+}
+
+func (r *redisImpl) ExistsContext(ctx context.Context, key string) (bool, error) {
     cmd := r.client.Exists(ctx, key)
     if cmd.Err() != nil {
-        return false, cmd.Err()
+        return false, convertError(cmd.Err())
     }
     return cmd.Val() == 1, nil
 }
@@ -100,61 +176,124 @@ func (r *redisImpl) watch(key string, watchCh chan *libkv.KVPair) func(tx *rdb.T
     return fn
 }
 func (r *redisImpl) Watch(key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
-    return r.WatchMulti(stopCh, key)
+    return r.WatchContext(context.Background(), key, stopCh)
+}
+
+func (r *redisImpl) WatchContext(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return r.WatchMultiContext(ctx, stopCh, key)
 }
 
-//
 func (r *redisImpl) WatchMulti(stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    return r.WatchMultiContext(context.Background(), stopCh, keys...)
+}
+
+//
+func (r *redisImpl) WatchMultiContext(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    if r.keyspace {
+        return r.watchKeyspace(ctx, stopCh, keys...)
+    }
     watchCh := make(chan *libkv.KVPair)
     go func() {
         defer close(watchCh)
+        send := func(pair *libkv.KVPair) bool {
+            select {
+            case watchCh <- pair:
+                return true
+            case <-stopCh:
+            case <-ctx.Done():
+            }
+            return false
+        }
         for _, key := range keys {
-            pair, err := r.Get(key)
+            pair, err := r.GetContext(ctx, key)
             if err != nil {
                 continue
             }
-            watchCh <- pair
+            if !send(pair) {
+                return
+            }
         }
-        rch := r.client.PSubscribe(context.Background(), keys...)
+        rch := r.client.PSubscribe(ctx, keys...)
+        defer rch.Close()
+        ch := rch.Channel()
         for {
             select {
             case <-stopCh:
                 return
-            case evt := <-rch.Channel():
-                if evt != nil {
-                    watchCh <- &libkv.KVPair{
-                        Key:       evt.Channel,
-                        Value:     []byte(evt.Payload),
-                        LastIndex: 0,
-                    }
+            case <-ctx.Done():
+                return
+            case evt, ok := <-ch:
+                if !ok {
+                    return
+                }
+                if isDeleted(evt.Channel) {
+                    continue
+                }
+                if !send(&libkv.KVPair{
+                    Key:       evt.Channel,
+                    Value:     []byte(evt.Payload),
+                    LastIndex: 0,
+                }) {
+                    return
                 }
             }
         }
     }()
     return watchCh, nil
 }
+
 func (r *redisImpl) WatchTree(dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    return r.WatchTreeContext(context.Background(), dir, stopCh)
+}
+
+func (r *redisImpl) WatchTreeContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    if r.keyspace {
+        return r.watchTreeKeyspace(ctx, stopCh, dir)
+    }
     watchCh := make(chan []*libkv.KVPair)
     go func() {
         defer close(watchCh)
+        send := func(list []*libkv.KVPair) bool {
+            select {
+            case watchCh <- list:
+                return true
+            case <-stopCh:
+            case <-ctx.Done():
+            }
+            return false
+        }
 
-        list, err := r.List(dir)
+        list, err := r.ListContext(ctx, dir)
         if err != nil {
             return
         }
-        watchCh <- list
-        rch := r.client.PSubscribe(context.Background(), dir+"*")
+        if !send(list) {
+            return
+        }
+        rch := r.client.PSubscribe(ctx, dir+"*")
+        defer rch.Close()
+        ch := rch.Channel()
         for {
             select {
             case <-stopCh:
                 return
-            case evt := <-rch.Channel():
-                watchCh <- []*libkv.KVPair{
+            case <-ctx.Done():
+                return
+            case evt, ok := <-ch:
+                if !ok {
+                    return
+                }
+                if isDeleted(evt.Channel) {
+                    continue
+                }
+                if !send([]*libkv.KVPair{
                     {
                         Key:       evt.Channel,
                         Value:     []byte(evt.Payload),
                         LastIndex: 0,
                     },
+                }) {
+                    return
                 }
             }
         }
@@ -162,61 +301,234 @@ func (r *redisImpl) WatchTree(dir string, stopCh <-chan struct{}) (<-chan []*lib
     return watchCh, nil
 }
 
+func (r *redisImpl) WatchEvents(stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    return r.WatchEventsContext(context.Background(), stopCh, options, keys...)
+}
+
+func (r *redisImpl) WatchEventsContext(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    if options != nil && options.Revision != 0 {
+        return nil, common.ErrAPINotSupported
+    }
+    patterns := make([]string, 0, len(keys))
+    for _, key := range keys {
+        patterns = append(patterns, escapePattern(key))
+    }
+    return r.watchEvents(ctx, stopCh, options, nil, patterns...)
+}
+
+func (r *redisImpl) WatchTreeEvents(dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    return r.WatchTreeEventsContext(context.Background(), dir, stopCh, options)
+}
+
+func (r *redisImpl) WatchTreeEventsContext(ctx context.Context, dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    if options != nil && options.Revision != 0 {
+        return nil, common.ErrAPINotSupported
+    }
+    return r.watchEvents(ctx, stopCh, options, nil, escapePattern(dir)+"*")
+}
+
+func (r *redisImpl) WatchTreeDeltas(dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return r.WatchTreeDeltasContext(context.Background(), dir, stopCh)
+}
+
+func (r *redisImpl) WatchTreeDeltasContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return r.watchEvents(ctx, stopCh, nil, func(ctx context.Context) (*libkv.WatchEvent, error) {
+        list, err := r.ListContext(ctx, dir)
+        if err != nil {
+            return nil, err
+        }
+        return watch.SnapshotEvent(dir, list, 0), nil
+    }, escapePattern(dir)+"*")
+}
+
 func (r *redisImpl) NewLock(key string, options *libkv.LockOptions) (libkv.Locker, error) {
-    panic("implement me")
+    return r.NewLockContext(context.Background(), key, options)
+}
+
+func (r *redisImpl) NewLockContext(ctx context.Context, key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return r.newLock(key, options), nil
 }
 
 func (r *redisImpl) List(dir string) ([]*libkv.KVPair, error) {
-    ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+    ctx, cancel := r.withTimeout()
     defer cancel()
+    return r.ListContext(ctx, dir)
+}
 
-    var (
-        cursor = uint64(0)
-        n      = int(0)
-        result []*libkv.KVPair
-    )
-    k := fmt.Sprintf("%s*", dir)
-
-    for {
-        var (
-            keys []string
-            err  error
-        )
-        keys, cursor, err = r.client.Scan(ctx, cursor, k, 20).Result()
-        if err != nil {
-            return result, err
-        }
-        n += len(keys)
+func (r *redisImpl) ListContext(ctx context.Context, dir string) ([]*libkv.KVPair, error) {
+    var result []*libkv.KVPair
+    err := r.scan(ctx, escapePattern(dir)+"*", func(_ rdb.Cmdable, keys []string) error {
         for _, key := range keys {
-            data, err2 := r.client.Get(ctx, key).Bytes()
-            if err2 != nil {
+            pair, err := r.read(ctx, key)
+            if err != nil {
                 continue
             }
-            result = append(result, &libkv.KVPair{
-                Key:       key,
-                Value:     data,
-                LastIndex: 0,
-            })
+            result = append(result, pair)
         }
-        if cursor == 0 {
-            break
+        return nil
+    })
+    return result, err
+}
+
+// scan calls fn with the pages of keys matching pattern and the client of the
+// node holding them, going through every master of a cluster.
+func (r *redisImpl) scan(ctx context.Context, pattern string, fn func(c rdb.Cmdable, keys []string) error) error {
+    scanNode := func(ctx context.Context, c rdb.Cmdable) error {
+        cursor := uint64(0)
+        for {
+            var (
+                keys []string
+                err  error
+            )
+            keys, cursor, err = c.Scan(ctx, cursor, pattern, 20).Result()
+            if err != nil {
+                return convertError(err)
+            }
+            if len(keys) > 0 {
+                if err = fn(c, keys); err != nil {
+                    return err
+                }
+            }
+            if cursor == 0 {
+                return nil
+            }
         }
     }
-    return result, nil
+    // the masters are scanned concurrently, fn is called by one at a time
+    var mu sync.Mutex
+    locked := fn
+    fn = func(c rdb.Cmdable, keys []string) error {
+        mu.Lock()
+        defer mu.Unlock()
+        return locked(c, keys)
+    }
+    return r.forEachMaster(ctx, func(ctx context.Context, c rdb.UniversalClient) error {
+        return scanNode(ctx, c)
+    })
+}
+
+// forEachMaster calls fn concurrently with every master of a cluster, or
+// with the client itself otherwise.
+func (r *redisImpl) forEachMaster(ctx context.Context, fn func(ctx context.Context, c rdb.UniversalClient) error) error {
+    cluster, ok := r.client.(*rdb.ClusterClient)
+    if !ok {
+        return fn(ctx, r.client)
+    }
+    err := cluster.ForEachMaster(ctx, func(ctx context.Context, c *rdb.Client) error {
+        return fn(ctx, c)
+    })
+    return convertError(err)
 }
 
 func (r *redisImpl) DeleteTree(dir string) error {
-    return r.client.Del(context.Background(), dir).Err()
+    return r.DeleteTreeContext(context.Background(), dir)
+}
+
+func (r *redisImpl) DeleteTreeContext(ctx context.Context, dir string) error {
+    _, err := r.DeleteTreeCountContext(ctx, dir)
+    return err
+}
+
+var _ libkv.TreeDeleter = (*redisImpl)(nil)
+
+func (r *redisImpl) DeleteTreeCount(dir string) (int, error) {
+    return r.DeleteTreeCountContext(context.Background(), dir)
+}
+
+// DeleteTreeCountContext unlinks the keys prefixed by dir a page at a time,
+// and returns how many were removed. Each page is unlinked on the node it
+// was scanned from.
+func (r *redisImpl) DeleteTreeCountContext(ctx context.Context, dir string) (int, error) {
+    n := 0
+    err := r.scan(ctx, escapePattern(dir)+"*", func(c rdb.Cmdable, keys []string) error {
+        pipe := c.Pipeline()
+        cmds := make([]*rdb.IntCmd, 0, len(keys))
+        for _, key := range keys {
+            cmds = append(cmds, pipe.Unlink(ctx, key))
+        }
+        if _, err := pipe.Exec(ctx); err != nil {
+            return convertError(err)
+        }
+        var deleted []string
+        for i, cmd := range cmds {
+            if cmd.Val() > 0 {
+                deleted = append(deleted, keys[i])
+            }
+        }
+        n += len(deleted)
+        return r.publishDeleted(ctx, c, deleted...)
+    })
+    return n, err
 }
 
 func (r *redisImpl) AtomicPut(key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
-    return false, nil, common.ErrAPINotSupported
+    ctx, cancel := r.withTimeout()
+    defer cancel()
+    return r.AtomicPutContext(ctx, key, value, previous, options)
+}
+
+func (r *redisImpl) AtomicPutContext(ctx context.Context, key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    condition := writeCreate
+    if previous != nil {
+        condition = strconv.FormatUint(previous.LastIndex, 10)
+    }
+    rev, err := r.write(ctx, key, value, options, condition)
+    if err != nil {
+        return false, nil, err
+    }
+    if err = r.client.Publish(ctx, key, value).Err(); err != nil {
+        r.missed(fmt.Errorf("redis atomic put committed, watches not notified: %w", convertError(err)))
+    }
+    return true, &libkv.KVPair{
+        Key:       key,
+        Value:     value,
+        LastIndex: rev,
+    }, nil
 }
 
 func (r *redisImpl) AtomicDelete(key string, previous *libkv.KVPair) (bool, error) {
-    return false, common.ErrAPINotSupported
+    ctx, cancel := r.withTimeout()
+    defer cancel()
+    return r.AtomicDeleteContext(ctx, key, previous)
+}
+
+func (r *redisImpl) AtomicDeleteContext(ctx context.Context, key string, previous *libkv.KVPair) (bool, error) {
+    if previous == nil {
+        return false, common.ErrPreviousNotSpecified
+    }
+    if err := r.compareAndDelete(ctx, key, previous.LastIndex); err != nil {
+        return false, err
+    }
+    if err := r.publishDeleted(ctx, r.client, key); err != nil {
+        r.missed(fmt.Errorf("redis atomic delete committed, watches not notified: %w", err))
+    }
+    return true, nil
 }
 
 func (r *redisImpl) Close() {
     _ = r.client.Close()
+    for _, c := range r.lockClients[1:] {
+        _ = c.Close()
+    }
+}
+
+// convertError maps redis client errors onto the common errors.
+func convertError(err error) error {
+    if err == nil {
+        return nil
+    }
+    if err == rdb.Nil {
+        return common.ErrKeyNotFound
+    }
+    if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+        return err
+    }
+    var netErr net.Error
+    if errors.As(err, &netErr) {
+        return fmt.Errorf("%w: %v", common.ErrUnreachable, err)
+    }
+    return err
 }
@@ -1,6 +1,12 @@
 package redis
 
 import (
+    "context"
+    "fmt"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/alicebob/miniredis/v2"
+    rdb "github.com/go-redis/redis/v8"
     "github.com/stretchr/testify/assert"
     "log"
     "testing"
@@ -104,3 +110,572 @@ func TestWatchTree(t *testing.T) {
         }
     }
 }
+
+func newTestStorage(t *testing.T, opt *libkv.Config, n int) libkv.Storage {
+    var endpoints []string
+    for i := 0; i < n; i++ {
+        endpoints = append(endpoints, miniredis.RunT(t).Addr())
+    }
+    kv, err := New(endpoints, opt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return kv
+}
+
+func TestLock(t *testing.T) {
+    kv := newTestStorage(t, nil, 1)
+    defer kv.Close()
+
+    l1, err := kv.NewLock("/test_lock", &libkv.LockOptions{TTL: time.Second, Value: []byte("owner")})
+    assert.Nil(t, err)
+    l2, err := kv.NewLock("/test_lock", &libkv.LockOptions{TTL: time.Second})
+    assert.Nil(t, err)
+
+    lost, err := l1.Lock(nil)
+    assert.Nil(t, err)
+    assert.NotNil(t, lost)
+    pair, err := kv.Get("/test_lock")
+    assert.Nil(t, err)
+    assert.Equal(t, "owner", string(pair.Value))
+
+    // locking again releases the lock held so far
+    relockStop := make(chan struct{})
+    time.AfterFunc(time.Second, func() { close(relockStop) })
+    relocked, err := l1.Lock(relockStop)
+    assert.Nil(t, err)
+    if assert.NotNil(t, relocked) {
+        select {
+        case <-lost:
+        case <-time.After(time.Second):
+            t.Fatal("first hold not released")
+        }
+        lost = relocked
+    }
+
+    stopCh := make(chan struct{})
+    time.AfterFunc(time.Millisecond*300, func() { close(stopCh) })
+    ch, err := l2.Lock(stopCh)
+    assert.Nil(t, err)
+    assert.Nil(t, ch)
+
+    assert.Nil(t, l1.Unlock())
+    <-lost
+    assert.Equal(t, common.ErrLockNotHeld, l1.Unlock())
+
+    ch, err = l2.Lock(nil)
+    assert.Nil(t, err)
+    assert.NotNil(t, ch)
+    assert.Nil(t, l2.Unlock())
+}
+
+func TestLockRenewStopped(t *testing.T) {
+    kv := newTestStorage(t, nil, 1)
+    defer kv.Close()
+
+    renewCh := make(chan struct{})
+    l, err := kv.NewLock("/test_lock", &libkv.LockOptions{TTL: time.Millisecond * 300, RenewLock: renewCh})
+    assert.Nil(t, err)
+    lost, err := l.Lock(nil)
+    assert.Nil(t, err)
+
+    // renewed past its ttl
+    time.Sleep(time.Millisecond * 500)
+    select {
+    case <-lost:
+        t.Fatal("lock lost while renewed")
+    default:
+    }
+
+    close(renewCh)
+    select {
+    case <-lost:
+    case <-time.After(time.Second):
+        t.Fatal("lock not lost after renewal stopped")
+    }
+}
+
+func TestRedlock(t *testing.T) {
+    opt := libkv.DefaultConfig()
+    opt.Redlock = true
+    kv := newTestStorage(t, opt, 3)
+    defer kv.Close()
+
+    l1, err := kv.NewLock("/test_redlock", nil)
+    assert.Nil(t, err)
+    lost, err := l1.Lock(nil)
+    assert.Nil(t, err)
+    assert.NotNil(t, lost)
+
+    stopCh := make(chan struct{})
+    time.AfterFunc(time.Millisecond*300, func() { close(stopCh) })
+    l2, err := kv.NewLock("/test_redlock", nil)
+    assert.Nil(t, err)
+    ch, err := l2.Lock(stopCh)
+    assert.Nil(t, err)
+    assert.Nil(t, ch)
+    assert.Nil(t, l1.Unlock())
+}
+
+func TestAtomic(t *testing.T) {
+    kv := newTestStorage(t, nil, 1)
+    defer kv.Close()
+    key := "/test_atomic"
+
+    ok, pair, err := kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    assert.NotZero(t, pair.LastIndex)
+
+    _, _, err = kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Equal(t, common.ErrKeyExists, err)
+
+    got, err := kv.Get(key)
+    assert.Nil(t, err)
+    assert.Equal(t, pair.LastIndex, got.LastIndex)
+
+    ok, next, err := kv.AtomicPut(key, []byte("v2"), got, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    assert.True(t, next.LastIndex > got.LastIndex)
+
+    _, _, err = kv.AtomicPut(key, []byte("v3"), got, nil)
+    assert.Equal(t, common.ErrKeyModified, err)
+    _, err = kv.AtomicDelete(key, got)
+    assert.Equal(t, common.ErrKeyModified, err)
+
+    ok, err = kv.AtomicDelete(key, next)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    _, err = kv.AtomicDelete(key, next)
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    _, err = kv.Get(key)
+    assert.Equal(t, common.ErrKeyNotFound, err)
+}
+
+func TestPlainStringValue(t *testing.T) {
+    mr := miniredis.RunT(t)
+    kv, err := New([]string{mr.Addr()}, nil)
+    assert.Nil(t, err)
+    defer kv.Close()
+
+    assert.Nil(t, mr.Set("/test_plain", "value"))
+    pair, err := kv.Get("/test_plain")
+    assert.Nil(t, err)
+    assert.Equal(t, "value", string(pair.Value))
+    assert.Zero(t, pair.LastIndex)
+
+    ok, _, err := kv.AtomicPut("/test_plain", []byte("next"), pair, &libkv.WriteOptions{TTL: time.Second})
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    mr.FastForward(time.Second * 2)
+    _, err = kv.Get("/test_plain")
+    assert.Equal(t, common.ErrKeyNotFound, err)
+}
+
+func TestCluster(t *testing.T) {
+    m1, m2 := miniredis.RunT(t), miniredis.RunT(t)
+    client := rdb.NewClusterClient(&rdb.ClusterOptions{
+        ClusterSlots: func(ctx context.Context) ([]rdb.ClusterSlot, error) {
+            return []rdb.ClusterSlot{
+                {Start: 0, End: 8191, Nodes: []rdb.ClusterNode{{Addr: m1.Addr()}}},
+                {Start: 8192, End: 16383, Nodes: []rdb.ClusterNode{{Addr: m2.Addr()}}},
+            }, nil
+        },
+    })
+    kv := newStorage(client, libkv.DefaultConfig())
+    defer kv.Close()
+
+    for i := 0; i < 10; i++ {
+        assert.Nil(t, kv.Put(fmt.Sprintf("/test_cluster/%d", i), []byte("value"), nil))
+    }
+    assert.Nil(t, kv.Put("/test_other", []byte("value"), nil))
+    assert.NotEmpty(t, m1.Keys())
+    assert.NotEmpty(t, m2.Keys())
+
+    pairs, err := kv.List("/test_cluster/")
+    assert.Nil(t, err)
+    assert.Len(t, pairs, 10)
+
+    n, err := kv.DeleteTreeCount("/test_cluster/")
+    assert.Nil(t, err)
+    assert.Equal(t, 10, n)
+    pairs, err = kv.List("/test_cluster/")
+    assert.Nil(t, err)
+    assert.Empty(t, pairs)
+    _, err = kv.Get("/test_other")
+    assert.Nil(t, err)
+}
+
+func TestDeleteTree(t *testing.T) {
+    kv := newTestStorage(t, nil, 1)
+    defer kv.Close()
+
+    for _, key := range []string{"/test_tree/a", "/test_tree/b/c", "/test_tree*/d", "/test_treex"} {
+        assert.Nil(t, kv.Put(key, []byte("value"), nil))
+    }
+    n, err := kv.(libkv.TreeDeleter).DeleteTreeCount("/test_tree*/")
+    assert.Nil(t, err)
+    assert.Equal(t, 1, n)
+    assert.Nil(t, kv.DeleteTree("/test_tree/"))
+    pairs, err := kv.List("/test_tree")
+    assert.Nil(t, err)
+    assert.Len(t, pairs, 1)
+    assert.Equal(t, "/test_treex", pairs[0].Key)
+}
+
+func TestRedlockModes(t *testing.T) {
+    opt := libkv.DefaultConfig()
+    opt.Redlock = true
+    opt.Cluster = true
+    _, err := New([]string{"127.0.0.1:7000"}, opt)
+    assert.NotNil(t, err)
+}
+
+// notify publishes the keyspace notification redis sends for cmd on key,
+// miniredis sending none.
+func notify(mr *miniredis.Miniredis, key, cmd string) {
+    mr.Publish("__keyspace@0__:"+key, cmd)
+}
+
+func TestKeyspaceWatch(t *testing.T) {
+    mr := miniredis.RunT(t)
+    opt := libkv.DefaultConfig()
+    opt.KeyspaceEvents = true
+    _, err := New([]string{mr.Addr()}, opt)
+    assert.NotNil(t, err, "miniredis has no CONFIG")
+
+    kv := newStorage(rdb.NewClient(&rdb.Options{Addr: mr.Addr()}), opt)
+    defer kv.Close()
+    key := "/test_keyspace/a"
+    assert.Nil(t, kv.Put(key, []byte("v1"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.Watch(key, stopCh)
+    assert.Nil(t, err)
+    tree, err := kv.WatchTree("/test_keyspace/", stopCh)
+    assert.Nil(t, err)
+    events, err := kv.WatchEvents(stopCh, nil, key)
+    assert.Nil(t, err)
+    next := func() *libkv.KVPair {
+        select {
+        case pair := <-ch:
+            return pair
+        case <-time.After(time.Second * 5):
+            t.Fatal("no event")
+        }
+        return nil
+    }
+    nextList := func() []*libkv.KVPair {
+        select {
+        case list := <-tree:
+            return list
+        case <-time.After(time.Second * 5):
+            t.Fatal("no event")
+        }
+        return nil
+    }
+    nextEvent := func() *libkv.WatchEvent {
+        select {
+        case event := <-events:
+            return event
+        case <-time.After(time.Second * 5):
+            t.Fatal("no event")
+        }
+        return nil
+    }
+    assert.Equal(t, "v1", string(next().Value))
+    assert.Len(t, nextList(), 1)
+
+    // a write with a ttl is followed by an expire the watches skip
+    assert.Nil(t, kv.Put(key, []byte("v2"), &libkv.WriteOptions{TTL: time.Second}))
+    notify(mr, key, "hset")
+    notify(mr, key, "expire")
+    assert.Equal(t, "v2", string(next().Value))
+    assert.Len(t, nextList(), 1)
+    event := nextEvent()
+    assert.Equal(t, libkv.WatchPut, event.Op)
+    assert.Equal(t, "v2", string(event.Pair.Value))
+
+    // redis removes the key once expired
+    mr.FastForward(time.Second * 2)
+    assert.False(t, mr.Exists(key))
+    notify(mr, key, "expired")
+    pair := next()
+    assert.Equal(t, key, pair.Key)
+    assert.Nil(t, pair.Value)
+    assert.Empty(t, nextList())
+    event = nextEvent()
+    assert.Equal(t, libkv.WatchExpire, event.Op)
+    assert.Equal(t, key, event.Key)
+    assert.Nil(t, event.Pair)
+
+    // a delete notified once the key is written again is left out, the
+    // write follows
+    assert.Nil(t, kv.Put(key, []byte("v3"), nil))
+    assert.Nil(t, kv.Delete(key))
+    assert.Nil(t, kv.Put(key, []byte("v4"), nil))
+    notify(mr, key, "hset")
+    notify(mr, key, "del")
+    notify(mr, key, "hset")
+    for _, want := range []string{"v4", "v4"} {
+        event = nextEvent()
+        assert.Equal(t, libkv.WatchPut, event.Op)
+        assert.Equal(t, want, string(event.Pair.Value))
+    }
+    assert.Equal(t, "v4", string(next().Value))
+    assert.Equal(t, "v4", string(next().Value))
+    nextList()
+    nextList()
+
+    assert.Nil(t, kv.Delete(key))
+    notify(mr, key, "del")
+    event = nextEvent()
+    assert.Equal(t, libkv.WatchDelete, event.Op)
+    assert.Nil(t, next().Value)
+    assert.Empty(t, nextList())
+
+    // evicted under maxmemory, which miniredis has not
+    assert.Nil(t, kv.Put(key, []byte("v5"), nil))
+    notify(mr, key, "hset")
+    assert.Equal(t, libkv.WatchPut, nextEvent().Op)
+    next()
+    nextList()
+    mr.Del(key)
+    notify(mr, key, "evicted")
+    event = nextEvent()
+    assert.Equal(t, libkv.WatchDelete, event.Op)
+    assert.Equal(t, key, event.Key)
+    assert.Nil(t, next().Value)
+    assert.Empty(t, nextList())
+}
+
+func TestWatchEvents(t *testing.T) {
+    mr := miniredis.RunT(t)
+    kv := newStorage(rdb.NewClient(&rdb.Options{Addr: mr.Addr()}), libkv.DefaultConfig())
+    defer kv.Close()
+    key := "/test_events/a"
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.WatchEvents(stopCh, nil, key)
+    assert.Nil(t, err)
+    treeCh, err := kv.WatchTreeEvents("/test_events/", stopCh, nil)
+    assert.Nil(t, err)
+
+    assert.Nil(t, kv.Put(key, []byte("v1"), nil))
+    for _, ch := range []<-chan *libkv.WatchEvent{ch, treeCh} {
+        select {
+        case event := <-ch:
+            assert.Equal(t, libkv.WatchPut, event.Op)
+            assert.Equal(t, key, event.Key)
+            assert.Equal(t, "v1", string(event.Pair.Value))
+        case <-time.After(time.Second * 5):
+            t.Fatal("no event")
+        }
+    }
+}
+
+// failPublish fails the PUBLISH commands, as a lost connection would once
+// the writes went through.
+type failPublish struct{}
+
+func (failPublish) BeforeProcess(ctx context.Context, cmd rdb.Cmder) (context.Context, error) {
+    if cmd.Name() == "publish" {
+        return ctx, fmt.Errorf("publish failed")
+    }
+    return ctx, nil
+}
+
+func (failPublish) AfterProcess(ctx context.Context, cmd rdb.Cmder) error {
+    return nil
+}
+
+func (h failPublish) BeforeProcessPipeline(ctx context.Context, cmds []rdb.Cmder) (context.Context, error) {
+    for _, cmd := range cmds {
+        if _, err := h.BeforeProcess(ctx, cmd); err != nil {
+            return ctx, err
+        }
+    }
+    return ctx, nil
+}
+
+func (failPublish) AfterProcessPipeline(ctx context.Context, cmds []rdb.Cmder) error {
+    return nil
+}
+
+func TestPublishError(t *testing.T) {
+    mr := miniredis.RunT(t)
+    client := rdb.NewClient(&rdb.Options{Addr: mr.Addr()})
+    kv := newStorage(client, libkv.DefaultConfig())
+    defer kv.Close()
+    key := "/test_publish/a"
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    errCh := make(chan error, 1)
+    _, err := kv.WatchTreeEvents("/test_publish/", stopCh, &libkv.WatchOptions{Errors: errCh})
+    assert.Nil(t, err)
+    client.AddHook(failPublish{})
+    missed := func() {
+        select {
+        case err := <-errCh:
+            assert.NotNil(t, err)
+        case <-time.After(time.Second * 5):
+            t.Fatal("publish error not reported to the watches")
+        }
+    }
+
+    // the writes went through, the watches are told of the missed change
+    ok, pair, err := kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    assert.Equal(t, "v1", string(pair.Value))
+    missed()
+
+    result, err := kv.Txn(&libkv.Txn{Then: []libkv.TxnOp{libkv.OpPut(key, []byte("v2"), nil)}})
+    assert.Nil(t, err)
+    assert.True(t, result.Succeeded)
+    missed()
+
+    pair, err = kv.Get(key)
+    assert.Nil(t, err)
+    ok, err = kv.AtomicDelete(key, pair)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    missed()
+}
+
+func TestWatchDeleteEvents(t *testing.T) {
+    mr := miniredis.RunT(t)
+    kv := newStorage(rdb.NewClient(&rdb.Options{Addr: mr.Addr()}), libkv.DefaultConfig())
+    defer kv.Close()
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.WatchEvents(stopCh, nil, "/test_events/a")
+    assert.Nil(t, err)
+    treeCh, err := kv.WatchTreeEvents("/test_events/", stopCh, nil)
+    assert.Nil(t, err)
+    next := func(ch <-chan *libkv.WatchEvent) string {
+        select {
+        case event := <-ch:
+            return event.Op.String() + " " + event.Key
+        case <-time.After(time.Second * 5):
+            t.Fatal("no event")
+        }
+        return ""
+    }
+
+    assert.Nil(t, kv.Put("/test_events/a", []byte("v1"), nil))
+    assert.Nil(t, kv.Delete("/test_events/a"))
+    assert.Equal(t, "put /test_events/a", next(ch))
+    assert.Equal(t, "delete /test_events/a", next(ch))
+    assert.Equal(t, "put /test_events/a", next(treeCh))
+    assert.Equal(t, "delete /test_events/a", next(treeCh))
+
+    ok, pair, err := kv.AtomicPut("/test_events/b", []byte("v2"), nil, nil)
+    assert.True(t, ok)
+    assert.Nil(t, err)
+    ok, err = kv.AtomicDelete("/test_events/b", pair)
+    assert.True(t, ok)
+    assert.Nil(t, err)
+    assert.Equal(t, "put /test_events/b", next(treeCh))
+    assert.Equal(t, "delete /test_events/b", next(treeCh))
+
+    assert.Nil(t, kv.Put("/test_events/c", []byte("v3"), nil))
+    assert.Nil(t, kv.DeleteTree("/test_events/"))
+    assert.Equal(t, "put /test_events/c", next(treeCh))
+    assert.Equal(t, "delete /test_events/c", next(treeCh))
+}
+
+func TestWatchTreeDeltas(t *testing.T) {
+    mr := miniredis.RunT(t)
+    kv := newStorage(rdb.NewClient(&rdb.Options{Addr: mr.Addr()}), libkv.DefaultConfig())
+    defer kv.Close()
+    assert.Nil(t, kv.Put("/test_deltas/a", []byte("v1"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.WatchTreeDeltas("/test_deltas/", stopCh)
+    assert.Nil(t, err)
+    tree := libkv.NewTree()
+    next := func() {
+        select {
+        case event := <-ch:
+            tree.Apply(event)
+        case <-time.After(time.Second * 5):
+            t.Fatal("no event")
+        }
+    }
+    next()
+    assert.Len(t, tree.List(), 1)
+
+    assert.Nil(t, kv.Put("/test_deltas/b", []byte("v2"), nil))
+    next()
+    list, err := kv.List("/test_deltas/")
+    assert.Nil(t, err)
+    assert.Equal(t, list, tree.List())
+}
+
+func TestMissingKeyspaceFlags(t *testing.T) {
+    assert.Equal(t, keyspaceFlags, missingKeyspaceFlags(""))
+    assert.Equal(t, "", missingKeyspaceFlags("AKE"))
+    assert.Equal(t, "g$he", missingKeyspaceFlags("Kx"))
+}
+
+func TestTxn(t *testing.T) {
+    kv := newTestStorage(t, nil, 1)
+    defer kv.Close()
+    blob, version := "/test_dir/blob", "/test_dir/version"
+    assert.Nil(t, kv.Put(blob, []byte("value1"), nil))
+    pair, err := kv.Get(blob)
+    assert.Nil(t, err)
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, nil)
+    assert.Nil(t, err)
+
+    txn := &libkv.Txn{
+        Compare: []libkv.Compare{libkv.RevisionEquals(blob, pair.LastIndex), libkv.KeyExists(version, false)},
+        Then:    []libkv.TxnOp{libkv.OpPut(blob, []byte("value2"), nil), libkv.OpPut(version, []byte("2"), nil), libkv.OpGet(blob)},
+        Else:    []libkv.TxnOp{libkv.OpGet(blob)},
+    }
+    result, err := kv.(libkv.Transactor).Txn(txn)
+    assert.Nil(t, err)
+    assert.True(t, result.Succeeded)
+    assert.Len(t, result.Pairs, 3)
+    assert.Equal(t, "value2", string(result.Pairs[2].Value))
+    assert.Equal(t, result.Pairs[0].LastIndex, result.Pairs[2].LastIndex)
+    pair, err = kv.Get(version)
+    assert.Nil(t, err)
+    assert.Equal(t, "2", string(pair.Value))
+
+    result, err = kv.(libkv.Transactor).Txn(txn)
+    assert.Nil(t, err)
+    assert.False(t, result.Succeeded)
+    assert.Len(t, result.Pairs, 1)
+    assert.Equal(t, "value2", string(result.Pairs[0].Value))
+
+    result, err = kv.(libkv.Transactor).Txn(&libkv.Txn{
+        Compare: []libkv.Compare{libkv.ValueEquals(version, []byte("2"))},
+        Then:    []libkv.TxnOp{libkv.OpDelete(version), libkv.OpGet(version)},
+    })
+    assert.Nil(t, err)
+    assert.True(t, result.Succeeded)
+    assert.Equal(t, []*libkv.KVPair{nil, nil}, result.Pairs)
+    exists, err := kv.Exists(version)
+    assert.Nil(t, err)
+    assert.False(t, exists)
+
+    // the writes of the transactions are published
+    for _, want := range []string{"put " + blob, "put " + version, "delete " + version} {
+        select {
+        case event := <-ch:
+            assert.Equal(t, want, event.Op.String()+" "+event.Key)
+        case <-time.After(time.Second * 5):
+            t.Fatal("no event")
+        }
+    }
+}
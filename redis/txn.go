@@ -0,0 +1,187 @@
+package redis
+
+import (
+    "context"
+    "fmt"
+    "github.com/DGHeroin/libkv"
+    rdb "github.com/go-redis/redis/v8"
+    "strconv"
+    "time"
+)
+
+// txnScript runs a transaction, its keys in the order they appear. ARGV:
+// time in microseconds, compare count, (target, value)..., then count,
+// (type, value, ttl in milliseconds)..., else count, (type, value, ttl)...
+// It returns whether the compares held and a result per operation of the
+// branch: the revision of a put, the value and revision of a get, the count
+// of a delete, 0 otherwise.
+var txnScript = rdb.NewScript(`
+local function read(key)
+    local t = redis.call("type", key)["ok"]
+    if t == "string" then
+        return redis.call("get", key), 0
+    elseif t == "hash" then
+        local v = redis.call("hmget", key, "value", "rev")
+        return v[1], tonumber(v[2]) or 0
+    end
+    return nil, 0
+end
+local function put(key, value, ttl)
+    local t = redis.call("type", key)["ok"]
+    local rev = 0
+    if t == "hash" then
+        rev = tonumber(redis.call("hget", key, "rev")) or 0
+    end
+    local next = tonumber(ARGV[1])
+    if next <= rev then
+        next = rev + 1
+    end
+    if t ~= "hash" then
+        redis.call("del", key)
+    end
+    redis.call("hset", key, "value", value, "rev", string.format("%.0f", next))
+    if tonumber(ttl) > 0 then
+        redis.call("pexpire", key, ttl)
+    else
+        redis.call("persist", key)
+    end
+    return next
+end
+local k, i = 0, 2
+local ok = true
+for c = 1, tonumber(ARGV[i]) do
+    k = k + 1
+    local target, arg = ARGV[i + 1], ARGV[i + 2]
+    i = i + 2
+    local value, rev = read(KEYS[k])
+    if target == "value" then
+        ok = ok and value == arg
+    elseif target == "rev" then
+        ok = ok and value ~= nil and rev == tonumber(arg)
+    else
+        ok = ok and (value ~= nil) == (arg == "1")
+    end
+end
+local function apply(run)
+    local results = {}
+    i = i + 1
+    for o = 1, tonumber(ARGV[i]) do
+        k = k + 1
+        local op, value, ttl = ARGV[i + 1], ARGV[i + 2], ARGV[i + 3]
+        i = i + 3
+        results[o] = 0
+        if run then
+            if op == "put" then
+                results[o] = put(KEYS[k], value, ttl)
+            elseif op == "delete" then
+                results[o] = redis.call("del", KEYS[k])
+            else
+                local v, rev = read(KEYS[k])
+                if v then
+                    results[o] = {v, string.format("%.0f", rev)}
+                end
+            end
+        end
+    end
+    return results
+end
+local thenResults = apply(ok)
+local elseResults = apply(not ok)
+if ok then
+    return {1, thenResults}
+end
+return {0, elseResults}`)
+
+var _ libkv.Transactor = (*redisImpl)(nil)
+
+func (r *redisImpl) Txn(txn *libkv.Txn) (*libkv.TxnResult, error) {
+    ctx, cancel := r.withTimeout()
+    defer cancel()
+    return r.TxnContext(ctx, txn)
+}
+
+// TxnContext runs txn as a script, so its keys must share a hash slot on a
+// cluster. The writes are published once it is committed, the event watches
+// are told about the ones failing to be.
+func (r *redisImpl) TxnContext(ctx context.Context, txn *libkv.Txn) (*libkv.TxnResult, error) {
+    now := time.Now().UnixNano() / int64(time.Microsecond)
+    var (
+        keys []string
+        args = []interface{}{now, len(txn.Compare)}
+    )
+    for _, c := range txn.Compare {
+        keys = append(keys, c.Key)
+        switch c.Target {
+        case libkv.CompareValue:
+            args = append(args, "value", c.Value)
+        case libkv.CompareRevision:
+            args = append(args, "rev", strconv.FormatUint(c.Revision, 10))
+        default:
+            exists := "0"
+            if c.Exists {
+                exists = "1"
+            }
+            args = append(args, "exists", exists)
+        }
+    }
+    for _, ops := range [][]libkv.TxnOp{txn.Then, txn.Else} {
+        args = append(args, len(ops))
+        for _, op := range ops {
+            keys = append(keys, op.Key)
+            switch op.Type {
+            case libkv.TxnPut:
+                args = append(args, "put", op.Value, ttlMilliseconds(op.Options))
+            case libkv.TxnDelete:
+                args = append(args, "delete", "", 0)
+            default:
+                args = append(args, "get", "", 0)
+            }
+        }
+    }
+    res, err := txnScript.Run(ctx, r.client, keys, args...).Result()
+    if err != nil {
+        return nil, convertError(err)
+    }
+    vals, _ := res.([]interface{})
+    if len(vals) != 2 {
+        return nil, fmt.Errorf("redis transaction returned %v", res)
+    }
+    results, _ := vals[1].([]interface{})
+    result := &libkv.TxnResult{Succeeded: vals[0] == int64(1)}
+    ops := txn.Then
+    if !result.Succeeded {
+        ops = txn.Else
+    }
+    for i, op := range ops {
+        var pair *libkv.KVPair
+        switch op.Type {
+        case libkv.TxnPut:
+            rev, _ := results[i].(int64)
+            pair = &libkv.KVPair{Key: op.Key, Value: op.Value, LastIndex: uint64(rev)}
+        case libkv.TxnGet:
+            if got, ok := results[i].([]interface{}); ok && len(got) == 2 {
+                pair = &libkv.KVPair{Key: op.Key}
+                if v, ok := got[0].(string); ok {
+                    pair.Value = []byte(v)
+                }
+                if v, ok := got[1].(string); ok {
+                    pair.LastIndex, _ = strconv.ParseUint(v, 10, 64)
+                }
+            }
+        }
+        result.Pairs = append(result.Pairs, pair)
+    }
+    for i, op := range ops {
+        switch {
+        case op.Type == libkv.TxnPut:
+            err = convertError(r.client.Publish(ctx, op.Key, op.Value).Err())
+        case op.Type == libkv.TxnDelete && results[i] == int64(1):
+            err = r.publishDeleted(ctx, r.client, op.Key)
+        }
+        if err != nil {
+            r.missed(fmt.Errorf("redis transaction committed, watches not notified: %w", err))
+            break
+        }
+    }
+    return result, nil
+}
@@ -0,0 +1,142 @@
+package redis
+
+import (
+    "context"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    rdb "github.com/go-redis/redis/v8"
+    "strconv"
+    "time"
+)
+
+// Values are kept in a hash next to their revision:
+//
+//     key => { value: <data>, rev: <revision> }
+//
+// A revision is the write time in microseconds, bumped past the previous
+// revision of the key so it always grows, even across delete and recreate.
+// Plain string values written by other clients are read with revision 0.
+
+const (
+    writeAlways = ""
+    writeCreate = "create"
+)
+
+var (
+    readScript = rdb.NewScript(`
+local t = redis.call("type", KEYS[1])["ok"]
+if t == "string" then
+    return {redis.call("get", KEYS[1]), "0"}
+elseif t == "hash" then
+    return redis.call("hmget", KEYS[1], "value", "rev")
+end
+return false`)
+    // ARGV: value, ttl in milliseconds, time in microseconds, condition
+    // (writeAlways, writeCreate or the expected revision)
+    writeScript = rdb.NewScript(`
+local t = redis.call("type", KEYS[1])["ok"]
+local rev = 0
+if t == "hash" then
+    rev = tonumber(redis.call("hget", KEYS[1], "rev")) or 0
+end
+if ARGV[4] == "create" then
+    if t ~= "none" then
+        return -1
+    end
+elseif ARGV[4] ~= "" then
+    if t == "none" or rev ~= tonumber(ARGV[4]) then
+        return -2
+    end
+end
+local next = tonumber(ARGV[3])
+if next <= rev then
+    next = rev + 1
+end
+if t ~= "hash" then
+    redis.call("del", KEYS[1])
+end
+redis.call("hset", KEYS[1], "value", ARGV[1], "rev", string.format("%.0f", next))
+if tonumber(ARGV[2]) > 0 then
+    redis.call("pexpire", KEYS[1], ARGV[2])
+else
+    redis.call("persist", KEYS[1])
+end
+return next`)
+    // ARGV: expected revision
+    deleteScript = rdb.NewScript(`
+local t = redis.call("type", KEYS[1])["ok"]
+if t == "none" then
+    return -1
+end
+local rev = 0
+if t == "hash" then
+    rev = tonumber(redis.call("hget", KEYS[1], "rev")) or 0
+end
+if rev ~= tonumber(ARGV[1]) then
+    return -2
+end
+redis.call("del", KEYS[1])
+return 1`)
+)
+
+func (r *redisImpl) read(ctx context.Context, key string) (*libkv.KVPair, error) {
+    res, err := readScript.Run(ctx, r.client, []string{key}).Result()
+    if err != nil {
+        return nil, convertError(err)
+    }
+    vals, ok := res.([]interface{})
+    if !ok || len(vals) != 2 {
+        return nil, common.ErrKeyNotFound
+    }
+    pair := &libkv.KVPair{Key: key}
+    if v, ok := vals[0].(string); ok {
+        pair.Value = []byte(v)
+    }
+    if v, ok := vals[1].(string); ok {
+        pair.LastIndex, _ = strconv.ParseUint(v, 10, 64)
+    }
+    return pair, nil
+}
+
+// write stores value under key when condition holds, and returns the new revision.
+func (r *redisImpl) write(ctx context.Context, key string, value []byte, options *libkv.WriteOptions, condition string) (uint64, error) {
+    now := time.Now().UnixNano() / int64(time.Microsecond)
+    rev, err := writeScript.Run(ctx, r.client, []string{key}, value, ttlMilliseconds(options), now, condition).Int64()
+    if err != nil {
+        return 0, convertError(err)
+    }
+    switch rev {
+    case -1:
+        return 0, common.ErrKeyExists
+    case -2:
+        return 0, common.ErrKeyModified
+    }
+    return uint64(rev), nil
+}
+
+// ttlMilliseconds returns the TTL of options rounded up to a millisecond,
+// 0 without TTL.
+func ttlMilliseconds(options *libkv.WriteOptions) int64 {
+    if options == nil || options.TTL <= 0 {
+        return 0
+    }
+    ttl := options.TTL.Milliseconds()
+    if ttl == 0 {
+        ttl = 1
+    }
+    return ttl
+}
+
+func (r *redisImpl) compareAndDelete(ctx context.Context, key string, rev uint64) error {
+    n, err := deleteScript.Run(ctx, r.client, []string{key}, rev).Int64()
+    if err != nil {
+        return convertError(err)
+    }
+    switch n {
+    case -1:
+        return common.ErrKeyNotFound
+    case -2:
+        return common.ErrKeyModified
+    }
+    return nil
+}
@@ -0,0 +1,199 @@
+package sql
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// dialect holds what differs between the databases for the kv tables.
+type dialect struct {
+    keyType  string
+    blobType string
+    numbered bool // $1 placeholders instead of ?
+}
+
+var (
+    sqliteDialect = dialect{
+        keyType:  "VARCHAR(512)",
+        blobType: "BLOB",
+    }
+    dialects = map[string]dialect{
+        "sqlite":  sqliteDialect,
+        "sqlite3": sqliteDialect,
+        "postgres": {
+            keyType:  `VARCHAR(512) COLLATE "C"`,
+            blobType: "BYTEA",
+            numbered: true,
+        },
+        "pgx": {
+            keyType:  `VARCHAR(512) COLLATE "C"`,
+            blobType: "BYTEA",
+            numbered: true,
+        },
+        "mysql": {
+            keyType:  "VARBINARY(512)",
+            blobType: "LONGBLOB",
+        },
+    }
+    tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+func dialectOf(driver string) dialect {
+    if d, ok := dialects[driver]; ok {
+        return d
+    }
+    return sqliteDialect
+}
+
+// stmt fills the table names into query, %[1]s being the kv table, %[2]s
+// its change log and %[3]s the revision counter, then rebinds the ? for
+// the dialect.
+func (s *sqlImpl) stmt(query string) string {
+    query = fmt.Sprintf(query, s.table, s.table+"_changes", s.table+"_revision")
+    if !s.dialect.numbered {
+        return query
+    }
+    var (
+        b strings.Builder
+        n int
+    )
+    for _, c := range query {
+        if c == '?' {
+            n++
+            b.WriteString("$" + strconv.Itoa(n))
+            continue
+        }
+        b.WriteRune(c)
+    }
+    return b.String()
+}
+
+// createTables creates the kv table, its change log and the revision
+// counter when missing.
+func (s *sqlImpl) createTables(ctx context.Context) error {
+    queries := []string{
+        `CREATE TABLE IF NOT EXISTS %[1]s (
+            name     ` + s.dialect.keyType + ` NOT NULL PRIMARY KEY,
+            value    ` + s.dialect.blobType + `,
+            revision BIGINT NOT NULL,
+            expire   BIGINT NOT NULL
+        )`,
+        `CREATE TABLE IF NOT EXISTS %[2]s (
+            revision BIGINT NOT NULL,
+            name     ` + s.dialect.keyType + ` NOT NULL,
+            value    ` + s.dialect.blobType + `,
+            deleted  SMALLINT NOT NULL,
+            PRIMARY KEY (revision, name)
+        )`,
+        `CREATE TABLE IF NOT EXISTS %[3]s (
+            id       INTEGER NOT NULL PRIMARY KEY,
+            revision BIGINT NOT NULL
+        )`,
+    }
+    for _, query := range queries {
+        if _, err := s.db.ExecContext(ctx, s.stmt(query)); err != nil {
+            return err
+        }
+    }
+    var n int
+    if err := s.db.QueryRowContext(ctx, s.stmt(`SELECT COUNT(*) FROM %[3]s`)).Scan(&n); err != nil || n > 0 {
+        return err
+    }
+    _, err := s.db.ExecContext(ctx, s.stmt(`INSERT INTO %[3]s (id, revision) VALUES (1, 0)`))
+    if err != nil {
+        // another storage may have created it meanwhile
+        if s.db.QueryRowContext(ctx, s.stmt(`SELECT COUNT(*) FROM %[3]s`)).Scan(&n) == nil && n == 1 {
+            return nil
+        }
+    }
+    return err
+}
+
+// prefixRange returns the arguments of a "name >= ? AND name < ?" range
+// matching the keys under prefix, end is empty when there is no bound.
+func prefixRange(prefix string) (start, end string) {
+    b := []byte(prefix)
+    for i := len(b) - 1; i >= 0; i-- {
+        if b[i] < 0xff {
+            b[i]++
+            return prefix, string(b[:i+1])
+        }
+    }
+    return prefix, ""
+}
+
+// rangeQuery appends the prefix range condition on name to query.
+func rangeQuery(query, prefix string, args []interface{}) (string, []interface{}) {
+    start, end := prefixRange(prefix)
+    query += " AND name >= ?"
+    args = append(args, start)
+    if end != "" {
+        query += " AND name < ?"
+        args = append(args, end)
+    }
+    return query, args
+}
+
+// placeholders returns n comma separated ?.
+func placeholders(n int) string {
+    return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+type change struct {
+    key     string
+    value   []byte
+    deleted bool
+    expired bool
+}
+
+// States of the changes, in the deleted column of the change log.
+const (
+    changePut     = 0
+    changeDeleted = 1
+    changeExpired = 2
+)
+
+func (c change) state() int {
+    switch {
+    case c.expired:
+        return changeExpired
+    case c.deleted:
+        return changeDeleted
+    }
+    return changePut
+}
+
+// update runs fn in a write transaction at the next revision and logs the
+// changes fn returns. Bumping the revision first serializes the writers.
+func (s *sqlImpl) update(ctx context.Context, fn func(tx *sql.Tx, rev uint64) ([]change, error)) (uint64, error) {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer func() {
+        _ = tx.Rollback()
+    }()
+    if _, err = tx.ExecContext(ctx, s.stmt(`UPDATE %[3]s SET revision = revision + 1 WHERE id = 1`)); err != nil {
+        return 0, err
+    }
+    var rev uint64
+    if err = tx.QueryRowContext(ctx, s.stmt(`SELECT revision FROM %[3]s WHERE id = 1`)).Scan(&rev); err != nil {
+        return 0, err
+    }
+    changes, err := fn(tx, rev)
+    if err != nil || len(changes) == 0 {
+        return 0, err
+    }
+    for _, c := range changes {
+        _, err = tx.ExecContext(ctx, s.stmt(`INSERT INTO %[2]s (revision, name, value, deleted) VALUES (?, ?, ?, ?)`),
+            rev, c.key, c.value, c.state())
+        if err != nil {
+            return 0, err
+        }
+    }
+    return rev, tx.Commit()
+}
@@ -0,0 +1,362 @@
+package sql
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "sync"
+    "time"
+)
+
+const defaultTable = "libkv"
+
+func init() {
+    libkv.AddStorage("sql", New)
+}
+
+// New opens the database with the driver and the data source name given as
+// endpoints, the driver has to be registered by the caller. Config.Bucket
+// names the kv table, libkv by default.
+func New(endpoints []string, opt *libkv.Config) (libkv.Storage, error) {
+    if opt == nil {
+        opt = libkv.DefaultConfig()
+    }
+    if len(endpoints) != 2 {
+        return nil, errors.New("sql endpoints must be the driver and the data source name")
+    }
+    table := opt.Bucket
+    if table == "" {
+        table = defaultTable
+    }
+    if !tableName.MatchString(table) {
+        return nil, errors.New("sql table name invalid: " + table)
+    }
+    db, err := sql.Open(endpoints[0], endpoints[1])
+    if err != nil {
+        return nil, err
+    }
+    v := &sqlImpl{
+        db:      db,
+        dialect: dialectOf(endpoints[0]),
+        table:   table,
+        timeout: opt.ConnectionTimeout,
+        done:    make(chan struct{}),
+    }
+    if v.dialect == sqliteDialect {
+        // sqlite allows a single writer, and every connection to :memory:
+        // opens a database of its own
+        db.SetMaxOpenConns(1)
+    }
+    ctx, cancel := v.withTimeout()
+    defer cancel()
+    if err = v.createTables(ctx); err != nil {
+        _ = db.Close()
+        return nil, err
+    }
+    v.wg.Add(1)
+    go v.sweep()
+    return v, nil
+}
+
+var _ libkv.StorageContext = (*sqlImpl)(nil)
+var _ libkv.EventWatcher = (*sqlImpl)(nil)
+
+// Every write is logged in the change log at its revision, which watchers
+// poll. Expired keys are hidden until the sweeper deletes them.
+type sqlImpl struct {
+    db      *sql.DB
+    dialect dialect
+    table   string
+    timeout time.Duration
+    done    chan struct{}
+    closed  sync.Once
+    wg      sync.WaitGroup
+}
+
+func (s *sqlImpl) withTimeout() (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func expireAt(options *libkv.WriteOptions) int64 {
+    if options == nil || options.TTL <= 0 {
+        return 0
+    }
+    return time.Now().Add(options.TTL).UnixNano() / int64(time.Millisecond)
+}
+
+func now() int64 {
+    return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// put writes key at rev inside tx.
+func (s *sqlImpl) put(ctx context.Context, tx *sql.Tx, key string, value []byte, rev uint64, expire int64) error {
+    res, err := tx.ExecContext(ctx, s.stmt(`UPDATE %[1]s SET value = ?, revision = ?, expire = ? WHERE name = ?`),
+        value, rev, expire, key)
+    if err != nil {
+        return err
+    }
+    if n, err := res.RowsAffected(); err != nil || n > 0 {
+        return err
+    }
+    _, err = tx.ExecContext(ctx, s.stmt(`INSERT INTO %[1]s (name, value, revision, expire) VALUES (?, ?, ?, ?)`),
+        key, value, rev, expire)
+    return err
+}
+
+// get reads the live revision of key inside tx.
+func (s *sqlImpl) get(ctx context.Context, tx *sql.Tx, key string) (uint64, error) {
+    var rev uint64
+    err := tx.QueryRowContext(ctx, s.stmt(`SELECT revision FROM %[1]s WHERE name = ? AND (expire = 0 OR expire > ?)`),
+        key, now()).Scan(&rev)
+    if err == sql.ErrNoRows {
+        return 0, common.ErrKeyNotFound
+    }
+    return rev, err
+}
+
+func (s *sqlImpl) Put(key string, value []byte, options *libkv.WriteOptions) error {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.PutContext(ctx, key, value, options)
+}
+
+func (s *sqlImpl) PutContext(ctx context.Context, key string, value []byte, options *libkv.WriteOptions) error {
+    _, err := s.update(ctx, func(tx *sql.Tx, rev uint64) ([]change, error) {
+        err := s.put(ctx, tx, key, value, rev, expireAt(options))
+        return []change{{key: key, value: value}}, err
+    })
+    return err
+}
+
+func (s *sqlImpl) Get(key string) (*libkv.KVPair, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.GetContext(ctx, key)
+}
+
+func (s *sqlImpl) GetContext(ctx context.Context, key string) (*libkv.KVPair, error) {
+    pair := &libkv.KVPair{Key: key}
+    err := s.db.QueryRowContext(ctx, s.stmt(`SELECT value, revision FROM %[1]s WHERE name = ? AND (expire = 0 OR expire > ?)`),
+        key, now()).Scan(&pair.Value, &pair.LastIndex)
+    if err == sql.ErrNoRows {
+        return nil, common.ErrKeyNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return pair, nil
+}
+
+func (s *sqlImpl) Delete(key string) error {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.DeleteContext(ctx, key)
+}
+
+func (s *sqlImpl) DeleteContext(ctx context.Context, key string) error {
+    _, err := s.update(ctx, func(tx *sql.Tx, rev uint64) ([]change, error) {
+        res, err := tx.ExecContext(ctx, s.stmt(`DELETE FROM %[1]s WHERE name = ?`), key)
+        if err != nil {
+            return nil, err
+        }
+        if n, err := res.RowsAffected(); err != nil || n == 0 {
+            return nil, err
+        }
+        return []change{{key: key, deleted: true}}, nil
+    })
+    return err
+}
+
+func (s *sqlImpl) Exists(key string) (bool, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.ExistsContext(ctx, key)
+}
+
+func (s *sqlImpl) ExistsContext(ctx context.Context, key string) (bool, error) {
+    _, err := s.GetContext(ctx, key)
+    if err == common.ErrKeyNotFound {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+func (s *sqlImpl) Watch(key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchContext(context.Background(), key, stopCh)
+}
+
+func (s *sqlImpl) WatchContext(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(ctx, stopCh, key)
+}
+
+func (s *sqlImpl) WatchMulti(stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(context.Background(), stopCh, keys...)
+}
+
+func (s *sqlImpl) WatchTree(dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    return s.WatchTreeContext(context.Background(), dir, stopCh)
+}
+
+func (s *sqlImpl) WatchEvents(stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchEventsContext(context.Background(), stopCh, options, keys...)
+}
+
+func (s *sqlImpl) WatchTreeEvents(dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeEventsContext(context.Background(), dir, stopCh, options)
+}
+
+func (s *sqlImpl) WatchTreeDeltas(dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeDeltasContext(context.Background(), dir, stopCh)
+}
+
+func (s *sqlImpl) NewLock(key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    return s.NewLockContext(context.Background(), key, options)
+}
+
+func (s *sqlImpl) NewLockContext(ctx context.Context, key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    return nil, common.ErrAPINotSupported
+}
+
+func (s *sqlImpl) List(dir string) ([]*libkv.KVPair, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.ListContext(ctx, dir)
+}
+
+func (s *sqlImpl) ListContext(ctx context.Context, dir string) ([]*libkv.KVPair, error) {
+    return s.list(ctx, s.db.QueryContext, dir)
+}
+
+// list reads the live pairs under dir through query, of the database or of
+// a transaction.
+func (s *sqlImpl) list(ctx context.Context, query func(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error), dir string) ([]*libkv.KVPair, error) {
+    q, args := rangeQuery(`SELECT name, value, revision FROM %[1]s WHERE (expire = 0 OR expire > ?)`, dir, []interface{}{now()})
+    rows, err := query(ctx, s.stmt(q+" ORDER BY name"), args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    kvs := make([]*libkv.KVPair, 0)
+    for rows.Next() {
+        pair := &libkv.KVPair{}
+        if err = rows.Scan(&pair.Key, &pair.Value, &pair.LastIndex); err != nil {
+            return nil, err
+        }
+        kvs = append(kvs, pair)
+    }
+    return kvs, rows.Err()
+}
+
+func (s *sqlImpl) DeleteTree(dir string) error {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.DeleteTreeContext(ctx, dir)
+}
+
+func (s *sqlImpl) DeleteTreeContext(ctx context.Context, dir string) error {
+    _, err := s.update(ctx, func(tx *sql.Tx, rev uint64) ([]change, error) {
+        query, args := rangeQuery(`SELECT name FROM %[1]s WHERE 1 = 1`, dir, nil)
+        changes, err := s.deleted(ctx, tx, query, args)
+        if err != nil || len(changes) == 0 {
+            return nil, err
+        }
+        query, args = rangeQuery(`DELETE FROM %[1]s WHERE 1 = 1`, dir, nil)
+        _, err = tx.ExecContext(ctx, s.stmt(query), args...)
+        return changes, err
+    })
+    return err
+}
+
+// deleted returns the deletions of the keys selected by query.
+func (s *sqlImpl) deleted(ctx context.Context, tx *sql.Tx, query string, args []interface{}) ([]change, error) {
+    rows, err := tx.QueryContext(ctx, s.stmt(query), args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var changes []change
+    for rows.Next() {
+        c := change{deleted: true}
+        if err = rows.Scan(&c.key); err != nil {
+            return nil, err
+        }
+        changes = append(changes, c)
+    }
+    return changes, rows.Err()
+}
+
+func (s *sqlImpl) AtomicPut(key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.AtomicPutContext(ctx, key, value, previous, options)
+}
+
+func (s *sqlImpl) AtomicPutContext(ctx context.Context, key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    rev, err := s.update(ctx, func(tx *sql.Tx, rev uint64) ([]change, error) {
+        if previous == nil {
+            _, err := s.get(ctx, tx, key)
+            if err == nil {
+                return nil, common.ErrKeyExists
+            }
+            if err != common.ErrKeyNotFound {
+                return nil, err
+            }
+            // an expired key may still be there
+            err = s.put(ctx, tx, key, value, rev, expireAt(options))
+            return []change{{key: key, value: value}}, err
+        }
+        res, err := tx.ExecContext(ctx, s.stmt(`UPDATE %[1]s SET value = ?, revision = ?, expire = ? WHERE name = ? AND revision = ? AND (expire = 0 OR expire > ?)`),
+            value, rev, expireAt(options), key, previous.LastIndex, now())
+        if err != nil {
+            return nil, err
+        }
+        if n, err := res.RowsAffected(); err != nil || n == 0 {
+            if err == nil {
+                err = common.ErrKeyModified
+            }
+            return nil, err
+        }
+        return []change{{key: key, value: value}}, nil
+    })
+    if err != nil {
+        return false, nil, err
+    }
+    return true, &libkv.KVPair{Key: key, Value: value, LastIndex: rev}, nil
+}
+
+func (s *sqlImpl) AtomicDelete(key string, previous *libkv.KVPair) (bool, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.AtomicDeleteContext(ctx, key, previous)
+}
+
+func (s *sqlImpl) AtomicDeleteContext(ctx context.Context, key string, previous *libkv.KVPair) (bool, error) {
+    if previous == nil {
+        return false, common.ErrPreviousNotSpecified
+    }
+    _, err := s.update(ctx, func(tx *sql.Tx, rev uint64) ([]change, error) {
+        current, err := s.get(ctx, tx, key)
+        if err != nil {
+            return nil, err
+        }
+        if current != previous.LastIndex {
+            return nil, common.ErrKeyModified
+        }
+        _, err = tx.ExecContext(ctx, s.stmt(`DELETE FROM %[1]s WHERE name = ?`), key)
+        return []change{{key: key, deleted: true}}, err
+    })
+    if err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+func (s *sqlImpl) Close() {
+    s.closed.Do(func() {
+        close(s.done)
+        s.wg.Wait()
+        _ = s.db.Close()
+    })
+}
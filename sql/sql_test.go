@@ -0,0 +1,254 @@
+package sql
+
+import (
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    _ "github.com/glebarez/go-sqlite"
+    "github.com/stretchr/testify/assert"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func newTestStorage(t *testing.T) libkv.Storage {
+    kv, err := libkv.NewStorage("sql", []string{"sqlite", filepath.Join(t.TempDir(), "kv.db")}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return kv
+}
+
+func TestPrefixRange(t *testing.T) {
+    start, end := prefixRange("/a/")
+    assert.Equal(t, "/a/", start)
+    assert.Equal(t, "/a0", end)
+    _, end = prefixRange("a\xff")
+    assert.Equal(t, "b", end)
+    _, end = prefixRange("")
+    assert.Equal(t, "", end)
+}
+
+func TestNew(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+
+    _, err := kv.Get("/test_dir/node1")
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+    assert.Nil(t, kv.Put("/test_dir2/node1", []byte("other"), nil))
+
+    pair, err := kv.Get("/test_dir/node1")
+    assert.Nil(t, err)
+    assert.Equal(t, "value1", string(pair.Value))
+    list, err := kv.List("/test_dir/")
+    assert.Nil(t, err)
+    assert.Len(t, list, 2)
+    assert.Equal(t, pair.LastIndex, list[0].LastIndex)
+    assert.True(t, list[1].LastIndex > list[0].LastIndex)
+
+    assert.Nil(t, kv.DeleteTree("/test_dir/"))
+    list, err = kv.List("/test_dir")
+    assert.Nil(t, err)
+    assert.Len(t, list, 1)
+    assert.Nil(t, kv.Delete("/test_dir2/node1"))
+    assert.Nil(t, kv.Delete("/test_dir2/node1"))
+
+    // Close may be called again
+    kv.Close()
+    kv.Close()
+}
+
+func TestTTL(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+
+    assert.Nil(t, kv.Put("/ttl/short", []byte("v"), &libkv.WriteOptions{TTL: time.Millisecond * 50}))
+    assert.Nil(t, kv.Put("/ttl/long", []byte("v"), &libkv.WriteOptions{TTL: time.Hour}))
+    time.Sleep(time.Millisecond * 100)
+    ok, err := kv.Exists("/ttl/short")
+    assert.Nil(t, err)
+    assert.False(t, ok)
+    list, err := kv.List("/ttl/")
+    assert.Nil(t, err)
+    assert.Len(t, list, 1)
+
+    // an expired key can be created again
+    ok, _, err = kv.AtomicPut("/ttl/short", []byte("v2"), nil, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+
+    assert.Nil(t, kv.Put("/ttl/gone", []byte("v"), &libkv.WriteOptions{TTL: time.Millisecond}))
+    time.Sleep(time.Millisecond * 10)
+    assert.Nil(t, kv.(*sqlImpl).sweepExpired())
+    var n int
+    assert.Nil(t, kv.(*sqlImpl).db.QueryRow(`SELECT COUNT(*) FROM libkv WHERE name = '/ttl/gone'`).Scan(&n))
+    assert.Equal(t, 0, n)
+}
+
+func TestAtomic(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/atomic/node"
+
+    _, err := kv.AtomicDelete(key, nil)
+    assert.Equal(t, common.ErrPreviousNotSpecified, err)
+    ok, pair, err := kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    _, _, err = kv.AtomicPut(key, []byte("v1"), nil, nil)
+    assert.Equal(t, common.ErrKeyExists, err)
+
+    ok, next, err := kv.AtomicPut(key, []byte("v2"), pair, nil)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    assert.True(t, next.LastIndex > pair.LastIndex)
+    _, _, err = kv.AtomicPut(key, []byte("v3"), pair, nil)
+    assert.Equal(t, common.ErrKeyModified, err)
+    _, err = kv.AtomicDelete(key, pair)
+    assert.Equal(t, common.ErrKeyModified, err)
+
+    ok, err = kv.AtomicDelete(key, next)
+    assert.Nil(t, err)
+    assert.True(t, ok)
+    _, err = kv.AtomicDelete(key, next)
+    assert.Equal(t, common.ErrKeyNotFound, err)
+    _, _, err = kv.AtomicPut(key, []byte("v4"), next, nil)
+    assert.Equal(t, common.ErrKeyModified, err)
+}
+
+func TestWatch(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.Watch(key, stopCh)
+    assert.Nil(t, err)
+    treeCh, err := kv.WatchTree("/test_dir/", stopCh)
+    assert.Nil(t, err)
+
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("other"), nil))
+    assert.Nil(t, kv.Delete(key))
+
+    for _, want := range []string{"value0", "value1", ""} {
+        select {
+        case pair := <-ch:
+            assert.Equal(t, want, string(pair.Value))
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for watch")
+        }
+    }
+    for _, want := range []int{1, 1} {
+        select {
+        case list := <-treeCh:
+            assert.Len(t, list, want)
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for tree watch")
+        }
+    }
+}
+
+// receiveEvents reads n events from ch, formatted as "op key value (previous)".
+func receiveEvents(t *testing.T, ch <-chan *libkv.WatchEvent, n int) []string {
+    var events []string
+    for i := 0; i < n; i++ {
+        select {
+        case event := <-ch:
+            s := event.Op.String() + " " + event.Key
+            if event.Pair != nil {
+                s += " " + string(event.Pair.Value)
+            }
+            if event.Previous != nil {
+                s += " (" + string(event.Previous.Value) + ")"
+            }
+            events = append(events, s)
+        case <-time.After(time.Second * 2):
+            t.Fatal("timeout waiting for events")
+        }
+    }
+    return events
+}
+
+func TestWatchEvents(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    key := "/test_dir/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.(libkv.EventWatcher).WatchEvents(stopCh, nil, key)
+    assert.Nil(t, err)
+    treeCh, err := kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, nil)
+    assert.Nil(t, err)
+
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    assert.Nil(t, kv.Delete(key))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("other"), &libkv.WriteOptions{TTL: time.Millisecond}))
+    time.Sleep(time.Millisecond * 10)
+    assert.Nil(t, kv.(*sqlImpl).sweepExpired())
+
+    assert.Equal(t, []string{
+        "put /test_dir/node1 value1 (value0)",
+        "delete /test_dir/node1 (value1)",
+    }, receiveEvents(t, ch, 2))
+    assert.Equal(t, []string{
+        "put /test_dir/node1 value1 (value0)",
+        "delete /test_dir/node1 (value1)",
+        "put /test_dir/node2 other",
+        "expire /test_dir/node2 (other)",
+    }, receiveEvents(t, treeCh, 4))
+}
+
+func TestWatchTreeDeltas(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.(libkv.EventWatcher).WatchTreeDeltas("/test_dir/", stopCh)
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node3", []byte("value3"), nil))
+    assert.Nil(t, kv.Delete("/test_dir/node1"))
+
+    tree := libkv.NewTree()
+    for i := 0; i < 3; i++ {
+        select {
+        case event := <-ch:
+            tree.Apply(event)
+        case <-time.After(time.Second):
+            t.Fatal("timeout waiting for events")
+        }
+    }
+    list, err := kv.List("/test_dir/")
+    assert.Nil(t, err)
+    assert.Equal(t, list, tree.List())
+    assert.Equal(t, uint64(4), tree.Revision())
+}
+
+func TestWatchResume(t *testing.T) {
+    kv := newTestStorage(t)
+    defer kv.Close()
+    assert.Nil(t, kv.Put("/test_dir/node1", []byte("value1"), nil))
+    pair, err := kv.Get("/test_dir/node1")
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node2", []byte("value2"), nil))
+    assert.Nil(t, kv.Delete("/test_dir/node1"))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.(libkv.EventWatcher).WatchTreeEvents("/test_dir/", stopCh, &libkv.WatchOptions{Revision: pair.LastIndex})
+    assert.Nil(t, err)
+    assert.Nil(t, kv.Put("/test_dir/node3", []byte("value3"), nil))
+    assert.Equal(t, []string{
+        "put /test_dir/node2 value2",
+        "delete /test_dir/node1 (value1)",
+        "put /test_dir/node3 value3",
+    }, receiveEvents(t, ch, 3))
+}
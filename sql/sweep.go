@@ -0,0 +1,68 @@
+package sql
+
+import (
+    "database/sql"
+    "time"
+)
+
+const (
+    sweepInterval  = 10 * time.Second
+    sweepBatchSize = 256
+    changeLogSize  = 10000 // revisions kept in the change log
+)
+
+// sweep deletes the expired keys and trims the change log until Close.
+func (s *sqlImpl) sweep() {
+    defer s.wg.Done()
+    ticker := time.NewTicker(sweepInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.done:
+            return
+        case <-ticker.C:
+            _ = s.sweepExpired()
+            _ = s.trimChanges()
+        }
+    }
+}
+
+// sweepExpired deletes the expired keys in batches, logging their deletion
+// for the watchers.
+func (s *sqlImpl) sweepExpired() error {
+    for {
+        var n int
+        ctx, cancel := s.withTimeout()
+        _, err := s.update(ctx, func(tx *sql.Tx, rev uint64) ([]change, error) {
+            expire := now()
+            changes, err := s.deleted(ctx, tx, `SELECT name FROM %[1]s WHERE expire <> 0 AND expire <= ? ORDER BY name LIMIT ?`,
+                []interface{}{expire, sweepBatchSize})
+            if err != nil {
+                return nil, err
+            }
+            for i, c := range changes {
+                if _, err = tx.ExecContext(ctx, s.stmt(`DELETE FROM %[1]s WHERE name = ?`), c.key); err != nil {
+                    return nil, err
+                }
+                changes[i].expired = true
+            }
+            n = len(changes)
+            return changes, nil
+        })
+        cancel()
+        if err != nil || n < sweepBatchSize {
+            return err
+        }
+    }
+}
+
+func (s *sqlImpl) trimChanges() error {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    var rev uint64
+    if err := s.db.QueryRowContext(ctx, s.stmt(`SELECT revision FROM %[3]s WHERE id = 1`)).Scan(&rev); err != nil || rev <= changeLogSize {
+        return err
+    }
+    _, err := s.db.ExecContext(ctx, s.stmt(`DELETE FROM %[2]s WHERE revision <= ?`), rev-changeLogSize)
+    return err
+}
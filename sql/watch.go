@@ -0,0 +1,290 @@
+package sql
+
+import (
+    "context"
+    "database/sql"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
+    "time"
+)
+
+const pollInterval = 250 * time.Millisecond
+
+func (s *sqlImpl) WatchMultiContext(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    rev, initial, err := s.snapshot(ctx, keys)
+    if err != nil {
+        return nil, err
+    }
+    watchCh := make(chan *libkv.KVPair)
+    go func() {
+        defer close(watchCh)
+        send := func(pair *libkv.KVPair) bool {
+            select {
+            case watchCh <- pair:
+                return true
+            case <-stopCh:
+            case <-ctx.Done():
+            case <-s.done:
+            }
+            return false
+        }
+        for _, pair := range initial {
+            if !send(pair) {
+                return
+            }
+        }
+        filter, args := keysFilter(keys)
+        for s.poll(ctx, stopCh) {
+            var events []*libkv.WatchEvent
+            events, rev, err = s.changes(ctx, rev, filter, args)
+            if err != nil {
+                return
+            }
+            for _, event := range events {
+                if !send(watch.Pair(event)) {
+                    return
+                }
+            }
+        }
+    }()
+    return watchCh, nil
+}
+
+func (s *sqlImpl) WatchTreeContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    var rev uint64
+    if err := s.db.QueryRowContext(ctx, s.stmt(`SELECT revision FROM %[3]s WHERE id = 1`)).Scan(&rev); err != nil {
+        return nil, err
+    }
+    list, err := s.ListContext(ctx, dir)
+    if err != nil {
+        return nil, err
+    }
+    watchCh := make(chan []*libkv.KVPair)
+    go func() {
+        defer close(watchCh)
+        for {
+            select {
+            case watchCh <- list:
+            case <-stopCh:
+                return
+            case <-ctx.Done():
+                return
+            case <-s.done:
+                return
+            }
+            for {
+                if !s.poll(ctx, stopCh) {
+                    return
+                }
+                var last sql.NullInt64
+                query, args := rangeQuery(`SELECT MAX(revision) FROM %[2]s WHERE revision > ?`, dir, []interface{}{rev})
+                if err = s.db.QueryRowContext(ctx, s.stmt(query), args...).Scan(&last); err != nil {
+                    return
+                }
+                if last.Valid {
+                    rev = uint64(last.Int64)
+                    break
+                }
+            }
+            if list, err = s.ListContext(ctx, dir); err != nil {
+                return
+            }
+        }
+    }()
+    return watchCh, nil
+}
+
+func (s *sqlImpl) WatchEventsContext(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    filter, args := keysFilter(keys)
+    return s.resume(ctx, stopCh, options, filter, args)
+}
+
+func (s *sqlImpl) WatchTreeEventsContext(ctx context.Context, dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    filter, args := rangeQuery("", dir, nil)
+    return s.resume(ctx, stopCh, options, filter, args)
+}
+
+// resume watches the keys matching filter from now on, or after the revision
+// of options, sending first the changes logged since.
+func (s *sqlImpl) resume(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, filter string, args []interface{}) (<-chan *libkv.WatchEvent, error) {
+    var current uint64
+    if options == nil || options.Revision == 0 {
+        if err := s.db.QueryRowContext(ctx, s.stmt(`SELECT revision FROM %[3]s WHERE id = 1`)).Scan(&current); err != nil {
+            return nil, err
+        }
+        return s.watchEvents(ctx, stopCh, options, filter, args, current, nil), nil
+    }
+    events, rev, err := s.changes(ctx, options.Revision, filter, args)
+    if err != nil {
+        return nil, err
+    }
+    // the log keeps the last changeLogSize revisions, the revision read after
+    // the changes covers the trims done before them
+    if err = s.db.QueryRowContext(ctx, s.stmt(`SELECT revision FROM %[3]s WHERE id = 1`)).Scan(&current); err != nil {
+        return nil, err
+    }
+    if current > changeLogSize && options.Revision < current-changeLogSize {
+        return nil, common.ErrCompacted
+    }
+    return s.watchEvents(ctx, stopCh, options, filter, args, rev, events), nil
+}
+
+func (s *sqlImpl) WatchTreeDeltasContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    snapshot, err := s.treeSnapshot(ctx, dir)
+    if err != nil {
+        return nil, err
+    }
+    filter, args := rangeQuery("", dir, nil)
+    return s.watchEvents(ctx, stopCh, nil, filter, args, snapshot.Revision, []*libkv.WatchEvent{snapshot}), nil
+}
+
+// treeSnapshot returns the pairs under dir along with the current revision.
+// Without snapshot isolation the listing may already hold some of the
+// following changes, applying them again leaves the same tree.
+func (s *sqlImpl) treeSnapshot(ctx context.Context, dir string) (*libkv.WatchEvent, error) {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer func() {
+        _ = tx.Rollback()
+    }()
+    snapshot := &libkv.WatchEvent{Op: libkv.WatchSnapshot, Key: dir}
+    if err = tx.QueryRowContext(ctx, s.stmt(`SELECT revision FROM %[3]s WHERE id = 1`)).Scan(&snapshot.Revision); err != nil {
+        return nil, err
+    }
+    if snapshot.Snapshot, err = s.list(ctx, tx.QueryContext, dir); err != nil {
+        return nil, err
+    }
+    return snapshot, nil
+}
+
+// watchEvents sends initial, then the changes logged after rev for the keys
+// matching filter, through a sink set up by options. The failed reads are
+// reported and tried again at the next poll.
+func (s *sqlImpl) watchEvents(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, filter string, args []interface{}, rev uint64, initial []*libkv.WatchEvent) <-chan *libkv.WatchEvent {
+    stop, release := watch.Stop(ctx, stopCh, s.done)
+    sink := watch.NewSink(stop, options)
+    go func() {
+        defer release()
+        defer sink.Close()
+        send := func(events []*libkv.WatchEvent) bool {
+            for _, event := range events {
+                if !sink.Send(event) {
+                    return false
+                }
+            }
+            return true
+        }
+        if !send(initial) {
+            return
+        }
+        for s.poll(ctx, stopCh) {
+            events, next, err := s.changes(ctx, rev, filter, args)
+            if err != nil {
+                sink.Error(err)
+                continue
+            }
+            rev = next
+            if !send(events) {
+                return
+            }
+        }
+    }()
+    return sink.C()
+}
+
+// keysFilter returns the condition on name selecting keys.
+func keysFilter(keys []string) (string, []interface{}) {
+    args := make([]interface{}, 0, len(keys))
+    for _, key := range keys {
+        args = append(args, key)
+    }
+    return " AND name IN (" + placeholders(len(keys)) + ")", args
+}
+
+// poll waits for the next poll, it returns false once the watch is stopped.
+func (s *sqlImpl) poll(ctx context.Context, stopCh <-chan struct{}) bool {
+    select {
+    case <-time.After(pollInterval):
+        return true
+    case <-stopCh:
+    case <-ctx.Done():
+    case <-s.done:
+    }
+    return false
+}
+
+// snapshot returns the current revision along with the values of keys.
+func (s *sqlImpl) snapshot(ctx context.Context, keys []string) (uint64, []*libkv.KVPair, error) {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, nil, err
+    }
+    defer func() {
+        _ = tx.Rollback()
+    }()
+    var rev uint64
+    if err = tx.QueryRowContext(ctx, s.stmt(`SELECT revision FROM %[3]s WHERE id = 1`)).Scan(&rev); err != nil {
+        return 0, nil, err
+    }
+    var initial []*libkv.KVPair
+    for _, key := range keys {
+        pair := &libkv.KVPair{Key: key}
+        err = tx.QueryRowContext(ctx, s.stmt(`SELECT value, revision FROM %[1]s WHERE name = ? AND (expire = 0 OR expire > ?)`),
+            key, now()).Scan(&pair.Value, &pair.LastIndex)
+        if err == sql.ErrNoRows {
+            continue
+        }
+        if err != nil {
+            return 0, nil, err
+        }
+        initial = append(initial, pair)
+    }
+    return rev, initial, nil
+}
+
+// changes returns the changes logged after rev for the keys matching filter,
+// in order, and the last revision seen. The previous values come from the
+// log, they are unknown once trimmed.
+func (s *sqlImpl) changes(ctx context.Context, rev uint64, filter string, filterArgs []interface{}) ([]*libkv.WatchEvent, uint64, error) {
+    args := append([]interface{}{rev}, filterArgs...)
+    rows, err := s.db.QueryContext(ctx, s.stmt(`SELECT c.revision, c.name, c.value, c.deleted, p.revision, p.value, p.deleted
+        FROM (SELECT revision, name, value, deleted FROM %[2]s WHERE revision > ?`+filter+`) c
+        LEFT JOIN %[2]s p ON p.name = c.name
+            AND p.revision = (SELECT MAX(revision) FROM %[2]s WHERE name = c.name AND revision < c.revision)
+        ORDER BY c.revision, c.name`), args...)
+    if err != nil {
+        return nil, rev, err
+    }
+    defer rows.Close()
+    var events []*libkv.WatchEvent
+    for rows.Next() {
+        var (
+            event     = &libkv.WatchEvent{Op: libkv.WatchPut}
+            value     []byte
+            state     int
+            prevRev   sql.NullInt64
+            prevValue []byte
+            prevState sql.NullInt64
+        )
+        if err = rows.Scan(&event.Revision, &event.Key, &value, &state, &prevRev, &prevValue, &prevState); err != nil {
+            return nil, rev, err
+        }
+        switch state {
+        case changeDeleted:
+            event.Op = libkv.WatchDelete
+        case changeExpired:
+            event.Op = libkv.WatchExpire
+        default:
+            event.Pair = &libkv.KVPair{Key: event.Key, Value: value, LastIndex: event.Revision}
+        }
+        if prevRev.Valid && prevState.Int64 == changePut {
+            event.Previous = &libkv.KVPair{Key: event.Key, Value: prevValue, LastIndex: uint64(prevRev.Int64)}
+        }
+        rev = event.Revision
+        events = append(events, event)
+    }
+    return events, rev, rows.Err()
+}
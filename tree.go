@@ -0,0 +1,58 @@
+package libkv
+
+import "sort"
+
+// Tree rebuilds a watched tree from the events of WatchTreeDeltas.
+type Tree struct {
+    pairs    map[string]*KVPair
+    revision uint64
+}
+
+func NewTree() *Tree {
+    return &Tree{pairs: make(map[string]*KVPair)}
+}
+
+// Apply updates the tree with event, a snapshot replacing it as a whole.
+func (t *Tree) Apply(event *WatchEvent) {
+    switch event.Op {
+    case WatchSnapshot:
+        t.pairs = make(map[string]*KVPair, len(event.Snapshot))
+        for _, pair := range event.Snapshot {
+            t.pairs[pair.Key] = pair
+        }
+    case WatchPut:
+        t.pairs[event.Key] = event.Pair
+    case WatchDelete, WatchExpire:
+        delete(t.pairs, event.Key)
+    }
+    if event.Revision != 0 {
+        t.revision = event.Revision
+    }
+}
+
+// Get returns the pair of key, nil when missing.
+func (t *Tree) Get(key string) *KVPair {
+    return t.pairs[key]
+}
+
+// List returns the pairs of the tree ordered by key.
+func (t *Tree) List() []*KVPair {
+    list := make([]*KVPair, 0, len(t.pairs))
+    for _, pair := range t.pairs {
+        list = append(list, pair)
+    }
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Key < list[j].Key
+    })
+    return list
+}
+
+func (t *Tree) Len() int {
+    return len(t.pairs)
+}
+
+// Revision returns the revision of the last event applied, 0 when the
+// backend does not report them.
+func (t *Tree) Revision() uint64 {
+    return t.revision
+}
@@ -0,0 +1,93 @@
+package libkv
+
+import "context"
+
+// Transactor is implemented by the storages applying a Txn atomically. The
+// others cannot guarantee it and leave it out, so a type assertion on the
+// Storage tells whether transactions are available.
+type Transactor interface {
+    Txn(txn *Txn) (*TxnResult, error)
+    TxnContext(ctx context.Context, txn *Txn) (*TxnResult, error)
+}
+
+// Txn applies Then when every Compare holds, Else otherwise, as a single
+// atomic change. The operations run in order.
+type Txn struct {
+    Compare []Compare
+    Then    []TxnOp
+    Else    []TxnOp
+}
+
+type CompareTarget int
+
+const (
+    CompareValue    CompareTarget = iota // the key exists with Value
+    CompareRevision                      // the key exists with LastIndex Revision
+    CompareExists                        // the key exists or not, as Exists says
+)
+
+type Compare struct {
+    Target   CompareTarget
+    Key      string
+    Value    []byte
+    Revision uint64
+    Exists   bool
+}
+
+func ValueEquals(key string, value []byte) Compare {
+    return Compare{Target: CompareValue, Key: key, Value: value}
+}
+
+func RevisionEquals(key string, revision uint64) Compare {
+    return Compare{Target: CompareRevision, Key: key, Revision: revision}
+}
+
+func KeyExists(key string, exists bool) Compare {
+    return Compare{Target: CompareExists, Key: key, Exists: exists}
+}
+
+type TxnOpType int
+
+const (
+    TxnPut TxnOpType = iota
+    TxnDelete
+    TxnGet
+)
+
+type TxnOp struct {
+    Type    TxnOpType
+    Key     string
+    Value   []byte        // TxnPut only
+    Options *WriteOptions // TxnPut only
+}
+
+func OpPut(key string, value []byte, options *WriteOptions) TxnOp {
+    return TxnOp{Type: TxnPut, Key: key, Value: value, Options: options}
+}
+
+func OpDelete(key string) TxnOp {
+    return TxnOp{Type: TxnDelete, Key: key}
+}
+
+func OpGet(key string) TxnOp {
+    return TxnOp{Type: TxnGet, Key: key}
+}
+
+// TxnResult tells which branch was applied, with a pair per operation of
+// that branch: the pair written by a put, the pair read by a get, and nil
+// for a delete or a missing key.
+type TxnResult struct {
+    Succeeded bool // the compares held, Then was applied
+    Pairs     []*KVPair
+}
+
+// Holds reports whether c holds for pair, nil when the key is missing.
+func (c Compare) Holds(pair *KVPair) bool {
+    switch c.Target {
+    case CompareValue:
+        return pair != nil && string(pair.Value) == string(c.Value)
+    case CompareRevision:
+        return pair != nil && pair.LastIndex == c.Revision
+    }
+    return (pair != nil) == c.Exists
+}
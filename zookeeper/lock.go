@@ -0,0 +1,184 @@
+package zookeeper
+
+import (
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/go-zookeeper/zk"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const defaultLockTTL = 20 * time.Second
+
+// zookeeperLock follows the lock recipe of zookeeper: every contender
+// creates an ephemeral sequential znode below the lock znode, the lowest
+// sequence holds the lock and the others wait for their predecessor to go.
+type zookeeperLock struct {
+    s       *zookeeperImpl
+    path    string
+    value   []byte
+    ttl     time.Duration
+    renewCh chan struct{}
+
+    mu   sync.Mutex
+    node string
+    done chan struct{}
+}
+
+func (s *zookeeperImpl) newLock(key string, options *libkv.LockOptions) *zookeeperLock {
+    l := &zookeeperLock{
+        s:    s,
+        path: znode(key),
+        ttl:  defaultLockTTL,
+    }
+    if options != nil {
+        l.value = options.Value
+        l.renewCh = options.RenewLock
+        if options.TTL > 0 {
+            l.ttl = options.TTL
+        }
+    }
+    return l
+}
+
+// The lock is lost along with its node, which goes with the session.
+func (l *zookeeperLock) Lock(stopChan chan struct{}) (<-chan struct{}, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.done != nil {
+        // locking again deletes the node held so far, which would come first
+        if err := l.release(); err != nil && err != zk.ErrNoNode {
+            return nil, convertError(err)
+        }
+    }
+
+    err := l.s.create(l.path, nil, false)
+    if err != nil && err != zk.ErrNodeExists {
+        return nil, convertError(err)
+    }
+    node, err := l.s.conn.CreateProtectedEphemeralSequential(l.path+"/lock-", l.value, l.s.acl)
+    if err != nil {
+        return nil, convertError(err)
+    }
+    for {
+        prev, err := l.predecessor(node)
+        if err == nil && prev == "" {
+            break
+        }
+        var (
+            ok     bool
+            events <-chan zk.Event
+        )
+        if err == nil {
+            ok, _, events, err = l.s.conn.ExistsW(l.path + "/" + prev)
+        }
+        if err != nil {
+            _ = l.s.conn.Delete(node, -1)
+            return nil, convertError(err)
+        }
+        if !ok {
+            continue
+        }
+        select {
+        case <-events:
+        case <-stopChan:
+            _ = l.s.conn.Delete(node, -1)
+            return nil, nil
+        }
+    }
+
+    l.node = node
+    l.done = make(chan struct{})
+    lostCh := make(chan struct{})
+    go l.holdLock(node, l.done, lostCh)
+    return lostCh, nil
+}
+
+// predecessor returns the contender right before node, or "" when node
+// holds the lock.
+func (l *zookeeperLock) predecessor(node string) (string, error) {
+    children, _, err := l.s.conn.Children(l.path)
+    if err != nil {
+        return "", err
+    }
+    seq, err := parseSeq(node)
+    if err != nil {
+        return "", err
+    }
+    var (
+        prev    string
+        prevSeq = -1
+    )
+    for _, child := range children {
+        n, err := parseSeq(child)
+        if err != nil {
+            continue
+        }
+        if n < seq && n > prevSeq {
+            prev, prevSeq = child, n
+        }
+    }
+    return prev, nil
+}
+
+// parseSeq returns the sequence number zookeeper appended to a lock node.
+func parseSeq(node string) (int, error) {
+    i := strings.LastIndex(node, "lock-")
+    if i < 0 {
+        return 0, zk.ErrBadArguments
+    }
+    return strconv.Atoi(node[i+len("lock-"):])
+}
+
+// holdLock closes lostCh once node is deleted. The session keeps the node
+// alive, closing RenewLock releases it after the ttl instead.
+func (l *zookeeperLock) holdLock(node string, done, lostCh chan struct{}) {
+    defer close(lostCh)
+    var (
+        renewCh = l.renewCh
+        expire  <-chan time.Time
+    )
+    for {
+        ok, _, events, err := l.s.conn.ExistsW(node)
+        if err != nil || !ok {
+            return
+        }
+        select {
+        case event := <-events:
+            if event.Type == zk.EventNodeDeleted || event.Type == zk.EventNotWatching {
+                return
+            }
+        case <-renewCh:
+            renewCh = nil
+            expire = time.After(l.ttl)
+        case <-expire:
+            _ = l.s.conn.Delete(node, -1)
+            return
+        case <-done:
+            return
+        }
+    }
+}
+
+func (l *zookeeperLock) Unlock() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.done == nil {
+        return common.ErrLockNotHeld
+    }
+    err := l.release()
+    if err == zk.ErrNoNode {
+        return common.ErrLockLost
+    }
+    return convertError(err)
+}
+
+// release stops watching the node held and deletes it. The caller holds
+// l.mu.
+func (l *zookeeperLock) release() error {
+    close(l.done)
+    l.done = nil
+    return l.s.conn.Delete(l.node, -1)
+}
@@ -0,0 +1,768 @@
+package zookeeper
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/DGHeroin/libkv/internal/watch"
+    "github.com/go-zookeeper/zk"
+    "path"
+    "strings"
+    "sync"
+    "time"
+)
+
+const defaultSessionTimeout = 10 * time.Second
+
+func init() {
+    libkv.AddStorage("zookeeper", New)
+}
+func New(endpoints []string, opt *libkv.Config) (libkv.Storage, error) {
+    if opt == nil {
+        opt = libkv.DefaultConfig()
+    }
+    if len(endpoints) == 0 {
+        return nil, errors.New("zookeeper endpoints unspecified")
+    }
+    conn, events, err := zk.Connect(endpoints, defaultSessionTimeout, zk.WithLogInfo(false))
+    if err != nil {
+        return nil, err
+    }
+    timeout := time.After(opt.ConnectionTimeout)
+    for connected := false; !connected; {
+        select {
+        case event := <-events:
+            connected = event.State == zk.StateHasSession
+        case <-timeout:
+            conn.Close()
+            return nil, fmt.Errorf("%w: zookeeper session not established", common.ErrUnreachable)
+        }
+    }
+    v := &zookeeperImpl{
+        conn:    conn,
+        acl:     zk.WorldACL(zk.PermAll),
+        timeout: opt.ConnectionTimeout,
+        done:    make(chan struct{}),
+    }
+    if opt.Username != "" {
+        if err = conn.AddAuth("digest", []byte(opt.Username+":"+opt.Password)); err != nil {
+            conn.Close()
+            return nil, convertError(err)
+        }
+        v.acl = zk.AuthACL(zk.PermAll)
+    }
+    return v, nil
+}
+
+var _ libkv.StorageContext = (*zookeeperImpl)(nil)
+var _ libkv.EventWatcher = (*zookeeperImpl)(nil)
+
+// Keys map to znodes, "/a/b/" and "a/b" both being the znode "/a/b". The
+// LastIndex of a key is the zxid of its last modification.
+type zookeeperImpl struct {
+    conn    *zk.Conn
+    acl     []zk.ACL
+    timeout time.Duration
+    done    chan struct{}
+    closed  sync.Once
+}
+
+func (s *zookeeperImpl) withTimeout() (context.Context, context.CancelFunc) {
+    return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// run calls fn until ctx is done. zk requests can't be cancelled, so fn is
+// left to complete in the background once ctx is done.
+func run(ctx context.Context, fn func() error) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    errCh := make(chan error, 1)
+    go func() {
+        errCh <- fn()
+    }()
+    select {
+    case err := <-errCh:
+        return convertError(err)
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func znode(key string) string {
+    return path.Clean("/" + key)
+}
+
+// createParents creates the missing ancestors of p as persistent znodes.
+func (s *zookeeperImpl) createParents(p string) error {
+    parts := strings.Split(strings.TrimPrefix(path.Dir(p), "/"), "/")
+    node := ""
+    for _, part := range parts {
+        if part == "" {
+            continue
+        }
+        node += "/" + part
+        _, err := s.conn.Create(node, nil, 0, s.acl)
+        if err != nil && err != zk.ErrNodeExists {
+            return err
+        }
+    }
+    return nil
+}
+
+// create creates p along with its parents, ephemeral nodes last as long as
+// the session.
+func (s *zookeeperImpl) create(p string, value []byte, ephemeral bool) error {
+    flags := int32(0)
+    if ephemeral {
+        flags = zk.FlagEphemeral
+    }
+    _, err := s.conn.Create(p, value, flags, s.acl)
+    if err == zk.ErrNoNode {
+        if err = s.createParents(p); err == nil {
+            _, err = s.conn.Create(p, value, flags, s.acl)
+        }
+    }
+    return err
+}
+
+// put writes p. A ttl write turns p into an ephemeral node and a write
+// without ttl into a persistent one, the node being replaced for that.
+func (s *zookeeperImpl) put(p string, value []byte, ephemeral bool) error {
+    for {
+        _, stat, err := s.conn.Exists(p)
+        if err != nil {
+            return err
+        }
+        if stat == nil {
+            err = s.create(p, value, ephemeral)
+        } else if ephemeral != (stat.EphemeralOwner != 0) {
+            if err = s.conn.Delete(p, stat.Version); err == nil {
+                err = s.create(p, value, ephemeral)
+            }
+        } else {
+            _, err = s.conn.Set(p, value, stat.Version)
+        }
+        // retry when the node changed in between
+        if err == zk.ErrNodeExists || err == zk.ErrNoNode || err == zk.ErrBadVersion {
+            continue
+        }
+        return err
+    }
+}
+
+// removeOnClose deletes an ephemeral node once keepAlive is closed.
+func (s *zookeeperImpl) removeOnClose(p string, options *libkv.WriteOptions) {
+    if options == nil || options.TTL <= 0 || options.KeepAlive == nil {
+        return
+    }
+    go func() {
+        select {
+        case <-options.KeepAlive:
+            _ = s.conn.Delete(p, -1)
+        case <-s.done:
+        }
+    }()
+}
+
+func (s *zookeeperImpl) Put(key string, value []byte, options *libkv.WriteOptions) error {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.PutContext(ctx, key, value, options)
+}
+
+func (s *zookeeperImpl) PutContext(ctx context.Context, key string, value []byte, options *libkv.WriteOptions) error {
+    p := znode(key)
+    ephemeral := options != nil && options.TTL > 0
+    err := run(ctx, func() error {
+        return s.put(p, value, ephemeral)
+    })
+    if err == nil {
+        s.removeOnClose(p, options)
+    }
+    return err
+}
+
+func (s *zookeeperImpl) Get(key string) (*libkv.KVPair, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.GetContext(ctx, key)
+}
+
+func (s *zookeeperImpl) GetContext(ctx context.Context, key string) (*libkv.KVPair, error) {
+    var (
+        value []byte
+        stat  *zk.Stat
+    )
+    err := run(ctx, func() (err error) {
+        value, stat, err = s.conn.Get(znode(key))
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return &libkv.KVPair{
+        Key:       key,
+        Value:     value,
+        LastIndex: uint64(stat.Mzxid),
+    }, nil
+}
+
+func (s *zookeeperImpl) Delete(key string) error {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.DeleteContext(ctx, key)
+}
+
+func (s *zookeeperImpl) DeleteContext(ctx context.Context, key string) error {
+    err := run(ctx, func() error {
+        return s.conn.Delete(znode(key), -1)
+    })
+    if err == common.ErrKeyNotFound {
+        return nil
+    }
+    return err
+}
+
+func (s *zookeeperImpl) Exists(key string) (bool, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.ExistsContext(ctx, key)
+}
+
+func (s *zookeeperImpl) ExistsContext(ctx context.Context, key string) (bool, error) {
+    var ok bool
+    err := run(ctx, func() (err error) {
+        ok, _, err = s.conn.Exists(znode(key))
+        return err
+    })
+    return ok, err
+}
+
+func (s *zookeeperImpl) Watch(key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchContext(context.Background(), key, stopCh)
+}
+
+func (s *zookeeperImpl) WatchContext(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(ctx, stopCh, key)
+}
+
+func (s *zookeeperImpl) WatchMulti(stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    return s.WatchMultiContext(context.Background(), stopCh, keys...)
+}
+
+func (s *zookeeperImpl) WatchMultiContext(ctx context.Context, stopCh <-chan struct{}, keys ...string) (<-chan *libkv.KVPair, error) {
+    watchCh := make(chan *libkv.KVPair)
+    stop := s.stopped(ctx, stopCh)
+    var wg sync.WaitGroup
+    for _, key := range keys {
+        wg.Add(1)
+        go func(key string) {
+            defer wg.Done()
+            s.watchKey(key, stop, watchCh)
+        }(key)
+    }
+    go func() {
+        wg.Wait()
+        close(watchCh)
+    }()
+    return watchCh, nil
+}
+
+// stopped returns a channel closed once the watch is stopped by stopCh, ctx
+// or Close.
+func (s *zookeeperImpl) stopped(ctx context.Context, stopCh <-chan struct{}) <-chan struct{} {
+    stop := make(chan struct{})
+    go func() {
+        defer close(stop)
+        select {
+        case <-stopCh:
+        case <-ctx.Done():
+        case <-s.done:
+        }
+    }()
+    return stop
+}
+
+// watchKey sends the current value of key, then re-arms a zk watch after
+// every fire and sends the changes. A deleted key is sent with an empty value.
+func (s *zookeeperImpl) watchKey(key string, stop <-chan struct{}, watchCh chan<- *libkv.KVPair) {
+    var (
+        p        = znode(key)
+        modified int64
+    )
+    for {
+        value, stat, events, err := s.conn.GetW(p)
+        if err == zk.ErrNoNode {
+            var ok bool
+            ok, stat, events, err = s.conn.ExistsW(p)
+            if ok {
+                // created in between, read it again
+                continue
+            }
+        }
+        if err != nil {
+            return
+        }
+        var pair *libkv.KVPair
+        switch {
+        case stat != nil && stat.Mzxid != modified:
+            modified = stat.Mzxid
+            pair = &libkv.KVPair{Key: key, Value: value, LastIndex: uint64(modified)}
+        case stat == nil && modified != 0:
+            modified = 0
+            pair = &libkv.KVPair{Key: key}
+        }
+        if pair != nil {
+            select {
+            case watchCh <- pair:
+            case <-stop:
+                return
+            }
+        }
+        select {
+        case event := <-events:
+            if event.Type == zk.EventNotWatching {
+                return
+            }
+        case <-stop:
+            return
+        }
+    }
+}
+
+func (s *zookeeperImpl) WatchTree(dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    return s.WatchTreeContext(context.Background(), dir, stopCh)
+}
+
+func (s *zookeeperImpl) WatchTreeContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan []*libkv.KVPair, error) {
+    watchCh := make(chan []*libkv.KVPair)
+    stop := s.stopped(ctx, stopCh)
+    go func() {
+        defer close(watchCh)
+        for {
+            changed := make(chan struct{}, 1)
+            quit := make(chan struct{})
+            list, err := s.walk(dir, func(events <-chan zk.Event) {
+                go func() {
+                    select {
+                    case <-events:
+                        select {
+                        case changed <- struct{}{}:
+                        default:
+                        }
+                    case <-quit:
+                    }
+                }()
+            })
+            if err != nil {
+                close(quit)
+                return
+            }
+            select {
+            case watchCh <- list:
+            case <-stop:
+                close(quit)
+                return
+            }
+            select {
+            case <-changed:
+                close(quit)
+            case <-stop:
+                close(quit)
+                return
+            }
+        }
+    }()
+    return watchCh, nil
+}
+
+func (s *zookeeperImpl) WatchEvents(stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchEventsContext(context.Background(), stopCh, options, keys...)
+}
+
+func (s *zookeeperImpl) WatchEventsContext(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, keys ...string) (<-chan *libkv.WatchEvent, error) {
+    if options != nil && options.Revision != 0 {
+        return nil, common.ErrAPINotSupported
+    }
+    return s.watchEvents(ctx, stopCh, options, func(watch func(<-chan zk.Event)) ([]*libkv.KVPair, error) {
+        var pairs []*libkv.KVPair
+        for _, key := range keys {
+            pair, err := s.readKey(key, watch)
+            if err != nil {
+                return nil, err
+            }
+            if pair != nil {
+                pairs = append(pairs, pair)
+            }
+        }
+        return pairs, nil
+    }, nil)
+}
+
+// readKey reads key and arms a zk watch on it, the pair is nil when missing.
+func (s *zookeeperImpl) readKey(key string, watch func(<-chan zk.Event)) (*libkv.KVPair, error) {
+    p := znode(key)
+    for {
+        value, stat, events, err := s.conn.GetW(p)
+        if err == zk.ErrNoNode {
+            var ok bool
+            ok, _, events, err = s.conn.ExistsW(p)
+            if ok {
+                // created in between, read it again
+                continue
+            }
+            if err != nil {
+                return nil, err
+            }
+            watch(events)
+            return nil, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        watch(events)
+        return &libkv.KVPair{Key: key, Value: value, LastIndex: uint64(stat.Mzxid)}, nil
+    }
+}
+
+func (s *zookeeperImpl) WatchTreeEvents(dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeEventsContext(context.Background(), dir, stopCh, options)
+}
+
+func (s *zookeeperImpl) WatchTreeEventsContext(ctx context.Context, dir string, stopCh <-chan struct{}, options *libkv.WatchOptions) (<-chan *libkv.WatchEvent, error) {
+    if options != nil && options.Revision != 0 {
+        return nil, common.ErrAPINotSupported
+    }
+    return s.watchEvents(ctx, stopCh, options, func(watch func(<-chan zk.Event)) ([]*libkv.KVPair, error) {
+        return s.walk(dir, watch)
+    }, nil)
+}
+
+func (s *zookeeperImpl) WatchTreeDeltas(dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return s.WatchTreeDeltasContext(context.Background(), dir, stopCh)
+}
+
+func (s *zookeeperImpl) WatchTreeDeltasContext(ctx context.Context, dir string, stopCh <-chan struct{}) (<-chan *libkv.WatchEvent, error) {
+    return s.watchEvents(ctx, stopCh, nil, func(watch func(<-chan zk.Event)) ([]*libkv.KVPair, error) {
+        return s.walk(dir, watch)
+    }, func(pairs []*libkv.KVPair) *libkv.WatchEvent {
+        return watch.SnapshotEvent(dir, pairs, 0)
+    })
+}
+
+// watchEvents sends the differences between the successive results of read,
+// starting from the current one, itself sent first through snapshot when
+// given. read arms the zk watches of what it reads, the first to fire
+// triggers the next read. The events go through a sink set up by options,
+// the failed reads are reported and tried again.
+func (s *zookeeperImpl) watchEvents(ctx context.Context, stopCh <-chan struct{}, options *libkv.WatchOptions, read func(watch func(<-chan zk.Event)) ([]*libkv.KVPair, error), snapshot func(pairs []*libkv.KVPair) *libkv.WatchEvent) (<-chan *libkv.WatchEvent, error) {
+    // arm reads the values, changed is signalled by the first watch to fire
+    // until quit is closed
+    arm := func() (pairs []*libkv.KVPair, changed chan struct{}, quit chan struct{}, err error) {
+        changed = make(chan struct{}, 1)
+        quit = make(chan struct{})
+        pairs, err = read(func(events <-chan zk.Event) {
+            go func() {
+                select {
+                case <-events:
+                    select {
+                    case changed <- struct{}{}:
+                    default:
+                    }
+                case <-quit:
+                }
+            }()
+        })
+        if err != nil {
+            close(quit)
+        }
+        return pairs, changed, quit, err
+    }
+    pairs, changed, quit, err := arm()
+    if err != nil {
+        return nil, err
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    stop := s.stopped(ctx, stopCh)
+    sink := watch.NewSink(stop, options)
+    go func() {
+        defer sink.Close()
+        defer cancel()
+        var events []*libkv.WatchEvent
+        if snapshot != nil {
+            events = append(events, snapshot(pairs))
+        }
+        last := watch.Snapshot(pairs)
+        for {
+            for _, event := range events {
+                if !sink.Send(event) {
+                    close(quit)
+                    return
+                }
+            }
+            select {
+            case <-changed:
+                close(quit)
+            case <-stop:
+                close(quit)
+                return
+            }
+            // the session reconnects on its own, until then the reads fail
+            for {
+                if pairs, changed, quit, err = arm(); err == nil {
+                    break
+                }
+                if !sink.Retry(err) {
+                    return
+                }
+            }
+            events = watch.Diff(last, pairs, 0)
+            last = watch.Snapshot(pairs)
+        }
+    }()
+    return sink.C(), nil
+}
+
+func (s *zookeeperImpl) NewLock(key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    return s.NewLockContext(context.Background(), key, options)
+}
+
+func (s *zookeeperImpl) NewLockContext(ctx context.Context, key string, options *libkv.LockOptions) (libkv.Locker, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return s.newLock(key, options), nil
+}
+
+func (s *zookeeperImpl) List(dir string) ([]*libkv.KVPair, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.ListContext(ctx, dir)
+}
+
+func (s *zookeeperImpl) ListContext(ctx context.Context, dir string) ([]*libkv.KVPair, error) {
+    var list []*libkv.KVPair
+    err := run(ctx, func() (err error) {
+        list, err = s.walk(dir, nil)
+        return err
+    })
+    return list, err
+}
+
+// walk lists the znodes below dir, leaving out the intermediate znodes that
+// hold no value. With watch set, every znode visited is watched for data
+// and children changes, and watch is given their event channels.
+func (s *zookeeperImpl) walk(dir string, watch func(<-chan zk.Event)) ([]*libkv.KVPair, error) {
+    var (
+        root = znode(dir)
+        lead = strings.TrimSuffix(dir, "/")
+        list = make([]*libkv.KVPair, 0)
+    )
+    // the keys returned are spelled after dir
+    key := func(p string) string {
+        if root == "/" {
+            return lead + p
+        }
+        return lead + strings.TrimPrefix(p, root)
+    }
+    var visit func(p string) error
+    visit = func(p string) error {
+        var (
+            children []string
+            value    []byte
+            stat     *zk.Stat
+            err      error
+        )
+        if watch == nil {
+            children, _, err = s.conn.Children(p)
+        } else {
+            var events <-chan zk.Event
+            children, _, events, err = s.conn.ChildrenW(p)
+            if err == zk.ErrNoNode && p == root {
+                _, _, events, err = s.conn.ExistsW(p)
+            }
+            if events != nil {
+                watch(events)
+            }
+        }
+        if err == zk.ErrNoNode {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if p != root {
+            if watch == nil {
+                value, stat, err = s.conn.Get(p)
+            } else {
+                var events <-chan zk.Event
+                value, stat, events, err = s.conn.GetW(p)
+                if events != nil {
+                    watch(events)
+                }
+            }
+            if err == zk.ErrNoNode {
+                return nil
+            }
+            if err != nil {
+                return err
+            }
+            if len(children) == 0 || len(value) > 0 {
+                list = append(list, &libkv.KVPair{
+                    Key:       key(p),
+                    Value:     value,
+                    LastIndex: uint64(stat.Mzxid),
+                })
+            }
+        }
+        for _, child := range children {
+            if p == "/" && child == "zookeeper" {
+                // the quota and config znodes of the server
+                continue
+            }
+            if err = visit(path.Join(p, child)); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    return list, visit(root)
+}
+
+func (s *zookeeperImpl) DeleteTree(dir string) error {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.DeleteTreeContext(ctx, dir)
+}
+
+func (s *zookeeperImpl) DeleteTreeContext(ctx context.Context, dir string) error {
+    return run(ctx, func() error {
+        return s.deleteTree(znode(dir))
+    })
+}
+
+// deleteTree deletes p and its children, children first.
+func (s *zookeeperImpl) deleteTree(p string) error {
+    children, _, err := s.conn.Children(p)
+    if err == zk.ErrNoNode {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    for _, child := range children {
+        if err = s.deleteTree(path.Join(p, child)); err != nil {
+            return err
+        }
+    }
+    if p == "/" {
+        return nil
+    }
+    err = s.conn.Delete(p, -1)
+    if err == zk.ErrNoNode {
+        return nil
+    }
+    return err
+}
+
+func (s *zookeeperImpl) AtomicPut(key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.AtomicPutContext(ctx, key, value, previous, options)
+}
+
+func (s *zookeeperImpl) AtomicPutContext(ctx context.Context, key string, value []byte, previous *libkv.KVPair, options *libkv.WriteOptions) (bool, *libkv.KVPair, error) {
+    var (
+        p    = znode(key)
+        zxid int64
+    )
+    err := run(ctx, func() error {
+        if previous == nil {
+            if err := s.create(p, value, options != nil && options.TTL > 0); err != nil {
+                return err
+            }
+            // the node was created by this write, even if it changed since
+            _, stat, err := s.conn.Exists(p)
+            if err == nil && stat != nil {
+                zxid = stat.Czxid
+            }
+            return err
+        }
+        _, stat, err := s.conn.Exists(p)
+        if err != nil {
+            return err
+        }
+        if stat == nil || stat.Mzxid != int64(previous.LastIndex) {
+            return common.ErrKeyModified
+        }
+        stat, err = s.conn.Set(p, value, stat.Version)
+        if err == zk.ErrNoNode {
+            return common.ErrKeyModified
+        }
+        if err != nil {
+            return err
+        }
+        zxid = stat.Mzxid
+        return nil
+    })
+    if err != nil {
+        return false, nil, err
+    }
+    s.removeOnClose(p, options)
+    return true, &libkv.KVPair{Key: key, Value: value, LastIndex: uint64(zxid)}, nil
+}
+
+func (s *zookeeperImpl) AtomicDelete(key string, previous *libkv.KVPair) (bool, error) {
+    ctx, cancel := s.withTimeout()
+    defer cancel()
+    return s.AtomicDeleteContext(ctx, key, previous)
+}
+
+func (s *zookeeperImpl) AtomicDeleteContext(ctx context.Context, key string, previous *libkv.KVPair) (bool, error) {
+    if previous == nil {
+        return false, common.ErrPreviousNotSpecified
+    }
+    p := znode(key)
+    err := run(ctx, func() error {
+        _, stat, err := s.conn.Exists(p)
+        if err != nil {
+            return err
+        }
+        if stat == nil {
+            return zk.ErrNoNode
+        }
+        if stat.Mzxid != int64(previous.LastIndex) {
+            return common.ErrKeyModified
+        }
+        return s.conn.Delete(p, stat.Version)
+    })
+    if err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+func (s *zookeeperImpl) Close() {
+    s.closed.Do(func() {
+        close(s.done)
+        s.conn.Close()
+    })
+}
+
+// convertError maps zk errors onto the common errors.
+func convertError(err error) error {
+    switch err {
+    case zk.ErrNoNode:
+        return common.ErrKeyNotFound
+    case zk.ErrNodeExists:
+        return common.ErrKeyExists
+    case zk.ErrBadVersion:
+        return common.ErrKeyModified
+    case zk.ErrConnectionClosed, zk.ErrNoServer, zk.ErrSessionExpired, zk.ErrClosing:
+        return fmt.Errorf("%w: %v", common.ErrUnreachable, err)
+    }
+    return err
+}
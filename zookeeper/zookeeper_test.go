@@ -0,0 +1,230 @@
+package zookeeper
+
+import (
+    "errors"
+    "github.com/DGHeroin/libkv"
+    "github.com/DGHeroin/libkv/common"
+    "github.com/go-zookeeper/zk"
+    "github.com/stretchr/testify/assert"
+    "os"
+    "testing"
+    "time"
+)
+
+// newTestStorage connects to the zookeeper server of ZOOKEEPER_ENDPOINT,
+// 127.0.0.1:2181 by default, skipping the test when none answers. The keys
+// of the test are removed along with it.
+func newTestStorage(t *testing.T) *zookeeperImpl {
+    endpoint := os.Getenv("ZOOKEEPER_ENDPOINT")
+    if endpoint == "" {
+        endpoint = "127.0.0.1:2181"
+    }
+    opt := libkv.DefaultConfig()
+    opt.ConnectionTimeout = time.Second
+    kv, err := New([]string{endpoint}, opt)
+    if errors.Is(err, common.ErrUnreachable) {
+        t.Skipf("zookeeper unavailable at %s", endpoint)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        _ = kv.DeleteTree("/libkv_test/")
+        kv.Close()
+    })
+    return kv.(*zookeeperImpl)
+}
+
+func TestUnreachable(t *testing.T) {
+    opt := libkv.DefaultConfig()
+    opt.ConnectionTimeout = time.Millisecond * 100
+    _, err := New([]string{"127.0.0.1:1"}, opt)
+    assert.True(t, errors.Is(err, common.ErrUnreachable))
+}
+
+func TestClose(t *testing.T) {
+    conn, _, err := zk.Connect([]string{"127.0.0.1:1"}, time.Second, zk.WithLogInfo(false))
+    assert.Nil(t, err)
+    kv := &zookeeperImpl{conn: conn, done: make(chan struct{})}
+    kv.Close()
+    kv.Close()
+}
+
+func TestZnode(t *testing.T) {
+    assert.Equal(t, "/a/b", znode("/a/b"))
+    assert.Equal(t, "/a/b", znode("a/b"))
+    assert.Equal(t, "/a/b", znode("/a/b/"))
+    assert.Equal(t, "/", znode(""))
+}
+
+func TestParseSeq(t *testing.T) {
+    seq, err := parseSeq("_c_0123456789abcdef0123456789abcdef-lock-0000000042")
+    assert.Nil(t, err)
+    assert.Equal(t, 42, seq)
+    _, err = parseSeq("other")
+    assert.NotNil(t, err)
+}
+
+func TestConvertError(t *testing.T) {
+    assert.Equal(t, common.ErrKeyNotFound, convertError(zk.ErrNoNode))
+    assert.Equal(t, common.ErrKeyExists, convertError(zk.ErrNodeExists))
+    assert.Equal(t, common.ErrKeyModified, convertError(zk.ErrBadVersion))
+    assert.True(t, errors.Is(convertError(zk.ErrSessionExpired), common.ErrUnreachable))
+}
+
+func TestEphemeral(t *testing.T) {
+    kv := newTestStorage(t)
+    other := newTestStorage(t)
+    key := "/libkv_test/ephemeral/node1"
+    ephemeral := func() bool {
+        _, stat, err := kv.conn.Exists(znode(key))
+        assert.Nil(t, err)
+        return stat != nil && stat.EphemeralOwner != 0
+    }
+
+    assert.Nil(t, kv.Put(key, []byte("value1"), nil))
+    assert.False(t, ephemeral())
+    assert.Nil(t, kv.Put(key, []byte("value2"), &libkv.WriteOptions{TTL: time.Second}))
+    assert.True(t, ephemeral())
+    // a write without ttl makes the node persistent again
+    assert.Nil(t, kv.Put(key, []byte("value3"), nil))
+    assert.False(t, ephemeral())
+    pair, err := kv.Get(key)
+    assert.Nil(t, err)
+    assert.Equal(t, "value3", string(pair.Value))
+
+    // ephemeral nodes go with the session of their writer
+    assert.Nil(t, other.Put(key, []byte("value4"), &libkv.WriteOptions{TTL: time.Second}))
+    other.Close()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        if _, err = kv.Get(key); err == common.ErrKeyNotFound || time.Now().After(deadline) {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    assert.Equal(t, common.ErrKeyNotFound, err)
+}
+
+func TestAtomic(t *testing.T) {
+    kv := newTestStorage(t)
+    key := "/libkv_test/atomic/node"
+
+    ok, pair, err := kv.AtomicPut(key, []byte("value1"), nil, nil)
+    assert.True(t, ok)
+    assert.Nil(t, err)
+    _, _, err = kv.AtomicPut(key, []byte("value1"), nil, nil)
+    assert.Equal(t, common.ErrKeyExists, err)
+
+    ok, updated, err := kv.AtomicPut(key, []byte("value2"), pair, nil)
+    assert.True(t, ok)
+    assert.Nil(t, err)
+    _, _, err = kv.AtomicPut(key, []byte("value3"), pair, nil)
+    assert.Equal(t, common.ErrKeyModified, err)
+
+    _, err = kv.AtomicDelete(key, pair)
+    assert.Equal(t, common.ErrKeyModified, err)
+    ok, err = kv.AtomicDelete(key, updated)
+    assert.True(t, ok)
+    assert.Nil(t, err)
+    _, err = kv.AtomicDelete(key, updated)
+    assert.Equal(t, common.ErrKeyNotFound, err)
+}
+
+func TestWatch(t *testing.T) {
+    kv := newTestStorage(t)
+    key := "/libkv_test/watch/node1"
+    assert.Nil(t, kv.Put(key, []byte("value0"), nil))
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+    ch, err := kv.Watch(key, stopCh)
+    assert.Nil(t, err)
+    receive := func() *libkv.KVPair {
+        select {
+        case pair := <-ch:
+            return pair
+        case <-time.After(5 * time.Second):
+            t.Fatal("timeout waiting for the watch")
+        }
+        return nil
+    }
+    assert.Equal(t, "value0", string(receive().Value))
+    // the zk watch is armed again after each change
+    for _, value := range []string{"value1", "value2"} {
+        assert.Nil(t, kv.Put(key, []byte(value), nil))
+        assert.Equal(t, value, string(receive().Value))
+    }
+    assert.Nil(t, kv.Delete(key))
+    assert.Nil(t, receive().Value)
+    assert.Nil(t, kv.Put(key, []byte("value3"), nil))
+    assert.Equal(t, "value3", string(receive().Value))
+}
+
+func TestLock(t *testing.T) {
+    kv := newTestStorage(t)
+    l1, err := kv.NewLock("/libkv_test/lock", &libkv.LockOptions{Value: []byte("owner")})
+    assert.Nil(t, err)
+    l2, err := kv.NewLock("/libkv_test/lock", nil)
+    assert.Nil(t, err)
+
+    lost, err := l1.Lock(nil)
+    assert.Nil(t, err)
+    assert.NotNil(t, lost)
+    children, _, err := kv.conn.Children("/libkv_test/lock")
+    assert.Nil(t, err)
+    assert.Len(t, children, 1)
+
+    // locking again releases the node held so far
+    relockStop := make(chan struct{})
+    time.AfterFunc(time.Second, func() { close(relockStop) })
+    relocked, err := l1.Lock(relockStop)
+    assert.Nil(t, err)
+    if assert.NotNil(t, relocked) {
+        select {
+        case <-lost:
+        case <-time.After(time.Second):
+            t.Fatal("first hold not released")
+        }
+        lost = relocked
+    }
+    children, _, err = kv.conn.Children("/libkv_test/lock")
+    assert.Nil(t, err)
+    assert.Len(t, children, 1)
+
+    // the second contender waits on the sequential node of the first
+    stopCh := make(chan struct{})
+    go func() {
+        time.Sleep(100 * time.Millisecond)
+        close(stopCh)
+    }()
+    ch, err := l2.Lock(stopCh)
+    assert.Nil(t, err)
+    assert.Nil(t, ch)
+
+    acquired := make(chan struct{})
+    go func() {
+        defer close(acquired)
+        ch, err := l2.Lock(nil)
+        assert.Nil(t, err)
+        assert.NotNil(t, ch)
+    }()
+    select {
+    case <-acquired:
+        t.Fatal("lock acquired twice")
+    case <-time.After(100 * time.Millisecond):
+    }
+    assert.Nil(t, l1.Unlock())
+    select {
+    case <-lost:
+    case <-time.After(time.Second):
+        t.Fatal("lock channel not closed on unlock")
+    }
+    select {
+    case <-acquired:
+    case <-time.After(5 * time.Second):
+        t.Fatal("lock not handed over")
+    }
+    assert.Equal(t, common.ErrLockNotHeld, l1.Unlock())
+    assert.Nil(t, l2.Unlock())
+}